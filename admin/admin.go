@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/listeners"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/metrics"
+)
+
+// Server serves the operational endpoints, such as `/metrics`, and the admin API under `/api`, apart from the git
+// traffic, so that it can be bound to an internal interface only.
+type Server struct {
+	Config     *config.Admin
+	Logger     log_driver.Logger
+	mux        *http.ServeMux
+	httpServer *http.Server
+}
+
+func NewServer(adminConfig *config.Admin, logger log_driver.Logger) *Server {
+	server := &Server{Config: adminConfig, Logger: logger, mux: http.NewServeMux()}
+	server.httpServer = &http.Server{Addr: fmt.Sprintf("%s:%d", adminConfig.ListenHost, adminConfig.ListenPort),
+		Handler: server}
+	server.Handle("/metrics", metrics.Handler())
+	return server
+}
+
+// Handle serves requests to path by handler, it must be called before Start.
+func (server *Server) Handle(path string, handler http.Handler) {
+	server.mux.Handle(path, handler)
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.Logger.Debugf("%s %s from %s", r.Method, r.URL.String(), r.RemoteAddr)
+	server.mux.ServeHTTP(w, r)
+}
+
+// Start serves until Shutdown is called
+func (server *Server) Start() error {
+	listener, err := listeners.Listen("admin", server.httpServer.Addr)
+	if err != nil {
+		server.Logger.Errorf("Failed to listen on %s due to %s", server.httpServer.Addr, err)
+		return err
+	}
+	server.Logger.Infof("Listening on %s for admin", server.httpServer.Addr)
+	err = server.httpServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	server.Logger.Errorf("Failed to serve admin on %s due to %s", server.httpServer.Addr, err)
+	return err
+}
+
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.httpServer.Shutdown(ctx)
+}
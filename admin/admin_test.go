@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	server := httptest.NewServer(NewServer(&config.Admin{}, logger))
+	defer server.Close()
+
+	// The counters are global, so only their increase is asserted
+	before := scrape(t, server.URL)
+	metrics.CacheHits.Add(3)
+	metrics.SshAuthFailures.WithLabelValues("publickey").Inc()
+	after := scrape(t, server.URL)
+	assert.EqualValues(t, after["pages_cache_hits_total"]-before["pages_cache_hits_total"], 3)
+	failures := `pages_sshd_auth_failures_total{method="publickey"}`
+	assert.EqualValues(t, after[failures]-before[failures], 1)
+	assert.Contains(t, after, "go_goroutines")
+
+	response, err := http.Get(server.URL + "/other")
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.EqualValues(t, response.StatusCode, http.StatusNotFound)
+}
+
+// scrape returns the value of every sample exposed at `/metrics`, by its name and labels
+func scrape(t *testing.T, url string) map[string]float64 {
+	response, err := http.Get(url + "/metrics")
+	assert.Nil(t, err)
+	defer response.Body.Close()
+	assert.EqualValues(t, response.StatusCode, http.StatusOK)
+	body, err := ioutil.ReadAll(response.Body)
+	assert.Nil(t, err)
+	samples := map[string]float64{}
+	for _, line := range strings.Split(string(body), "\n") {
+		index := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || index < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[index+1:], 64)
+		assert.Nil(t, err)
+		samples[line[:index]] = value
+	}
+	return samples
+}
@@ -0,0 +1,451 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/bachue/pages/audit"
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/publish"
+	"github.com/bachue/pages/repos"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultHistoryLimit = 20
+
+type route struct {
+	method  string
+	pattern *regexp.Regexp
+	handle  func(server *Server, w http.ResponseWriter, r *http.Request, params []string)
+}
+
+var routes = []route{
+	{"GET", regexp.MustCompile(`^/users$`), (*Server).listUsers},
+	{"POST", regexp.MustCompile(`^/users$`), (*Server).createUser},
+	{"GET", regexp.MustCompile(`^/users/([^/]+)$`), (*Server).showUser},
+	{"DELETE", regexp.MustCompile(`^/users/([^/]+)$`), (*Server).deleteUser},
+	{"POST", regexp.MustCompile(`^/users/([^/]+)/keys$`), (*Server).addKey},
+	// Fingerprints are like `SHA256:<base64>` which may contain slashes
+	{"DELETE", regexp.MustCompile(`^/users/([^/]+)/keys/(.+)$`), (*Server).revokeKey},
+	{"POST", regexp.MustCompile(`^/users/([^/]+)/tokens$`), (*Server).addToken},
+	{"GET", regexp.MustCompile(`^/repos$`), (*Server).listRepos},
+	{"POST", regexp.MustCompile(`^/repos$`), (*Server).createRepo},
+	{"GET", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)$`), (*Server).showRepo},
+	{"DELETE", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)$`), (*Server).deleteRepo},
+	{"PUT", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/branch$`), (*Server).setBranch},
+	{"POST", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/publish$`), (*Server).republish},
+	{"GET", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/history$`), (*Server).history},
+	{"GET", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/deploy_keys$`), (*Server).listDeployKeys},
+	{"POST", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/deploy_keys$`), (*Server).addDeployKey},
+	{"DELETE", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/deploy_keys/(.+)$`), (*Server).revokeDeployKey},
+}
+
+// Server is the JSON admin API, only admin users may use it with HTTP basic auth and one of their tokens.
+// Changes are made through the same stores the SSH and HTTP servers authenticate with, so they
+// take effect at once.
+type Server struct {
+	GitRepoDir string
+	Users      *auth.Store
+	// Publisher is nil if publishing is disabled
+	Publisher *publish.Publisher
+	Auditor   *audit.Auditor
+	Logger    log_driver.Logger
+}
+
+func NewServer(gitRepoDir string, users *auth.Store, publisher *publish.Publisher, auditor *audit.Auditor,
+	logger log_driver.Logger) *Server {
+	return &Server{GitRepoDir: gitRepoDir, Users: users, Publisher: publisher, Auditor: auditor, Logger: logger}
+}
+
+// statusRecorder remembers the status written, to audit the outcome of the changes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, token, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pages"`)
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	identity, err := server.Users.AuthenticateToken(name, token)
+	if err != nil {
+		server.Logger.Infof("Failed to authenticate %s from %s: %s", name, r.RemoteAddr, err)
+		server.Auditor.Record(&audit.Entry{Action: audit.ApiAuth, Outcome: audit.Failure, User: name,
+			Source: r.RemoteAddr, Error: err.Error()})
+		w.Header().Set("WWW-Authenticate", `Basic realm="pages"`)
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	} else if !identity.Admin {
+		server.Auditor.Record(&audit.Entry{Action: audit.ApiAuth, Outcome: audit.Denied, User: name,
+			Source: r.RemoteAddr, Details: map[string]interface{}{"method": r.Method, "path": r.URL.Path}})
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	pathMatched := false
+	for _, route := range routes {
+		params := route.pattern.FindStringSubmatch(r.URL.Path)
+		if params == nil {
+			continue
+		}
+		pathMatched = true
+		if route.method == r.Method {
+			server.Logger.Infof("%s %s by %s from %s", r.Method, r.URL.Path, identity.User, r.RemoteAddr)
+			if r.Method == "GET" {
+				route.handle(server, w, r, params[1:])
+				return
+			}
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			route.handle(server, recorder, r, params[1:])
+			outcome := audit.Success
+			if recorder.status >= 400 {
+				outcome = audit.Failure
+			}
+			server.Auditor.Record(&audit.Entry{Action: audit.ApiChange, Outcome: outcome, User: identity.User,
+				Source: r.RemoteAddr, Details: map[string]interface{}{"method": r.Method, "path": r.URL.Path,
+					"status": recorder.status}})
+			return
+		}
+	}
+	if pathMatched {
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	} else {
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+type keyJson struct {
+	Fingerprint string `json:"fingerprint"`
+	Key         string `json:"key"`
+}
+
+type deployKeyJson struct {
+	Fingerprint string `json:"fingerprint"`
+	Key         string `json:"key"`
+	Write       bool   `json:"write"`
+}
+
+type userJson struct {
+	Name   string    `json:"name"`
+	Admin  bool      `json:"admin"`
+	Keys   []keyJson `json:"keys"`
+	Tokens int       `json:"tokens"`
+}
+
+type repoJson struct {
+	Name          string `json:"name"`
+	PublishBranch string `json:"publish_branch"`
+}
+
+func (server *Server) listUsers(w http.ResponseWriter, r *http.Request, params []string) {
+	users := []*userJson{}
+	for _, name := range server.Users.Users() {
+		if user := server.Users.User(name); user != nil {
+			users = append(users, toUserJson(name, user))
+		}
+	}
+	writeJson(w, http.StatusOK, users)
+}
+
+func (server *Server) createUser(w http.ResponseWriter, r *http.Request, params []string) {
+	var body struct {
+		Name  string `json:"name"`
+		Admin bool   `json:"admin"`
+	}
+	if !readJson(w, r, &body) {
+		return
+	}
+	err := server.Users.AddUser(body.Name, body.Admin)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJson(w, http.StatusCreated, toUserJson(body.Name, server.Users.User(body.Name)))
+}
+
+func (server *Server) showUser(w http.ResponseWriter, r *http.Request, params []string) {
+	user := server.Users.User(params[0])
+	if user == nil {
+		writeError(w, http.StatusNotFound, "User "+params[0]+" is not found")
+		return
+	}
+	writeJson(w, http.StatusOK, toUserJson(params[0], user))
+}
+
+func (server *Server) deleteUser(w http.ResponseWriter, r *http.Request, params []string) {
+	if server.Users.User(params[0]) == nil {
+		writeError(w, http.StatusNotFound, "User "+params[0]+" is not found")
+		return
+	}
+	err := server.Users.DeleteUser(params[0])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) addKey(w http.ResponseWriter, r *http.Request, params []string) {
+	var body struct {
+		Key string `json:"key"`
+	}
+	if !readJson(w, r, &body) {
+		return
+	}
+	if server.Users.User(params[0]) == nil {
+		writeError(w, http.StatusNotFound, "User "+params[0]+" is not found")
+		return
+	}
+	fingerprint, err := server.Users.AddKey(params[0], body.Key)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJson(w, http.StatusCreated, &keyJson{Fingerprint: fingerprint, Key: body.Key})
+}
+
+func (server *Server) revokeKey(w http.ResponseWriter, r *http.Request, params []string) {
+	err := server.Users.RevokeKey(params[0], params[1])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) addToken(w http.ResponseWriter, r *http.Request, params []string) {
+	if server.Users.User(params[0]) == nil {
+		writeError(w, http.StatusNotFound, "User "+params[0]+" is not found")
+		return
+	}
+	token, err := server.Users.AddToken(params[0])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, http.StatusCreated, map[string]string{"token": token})
+}
+
+func (server *Server) listRepos(w http.ResponseWriter, r *http.Request, params []string) {
+	user := r.URL.Query().Get("user")
+	if user != "" && !repos.IsValidName(user) {
+		writeError(w, http.StatusUnprocessableEntity, "Invalid user name `"+user+"`")
+		return
+	}
+	names, err := repos.List(server.GitRepoDir, user)
+	if err != nil && !os.IsNotExist(err) {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	list := []*repoJson{}
+	for _, name := range names {
+		list = append(list, &repoJson{Name: name})
+	}
+	writeJson(w, http.StatusOK, list)
+}
+
+func (server *Server) createRepo(w http.ResponseWriter, r *http.Request, params []string) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if !readJson(w, r, &body) {
+		return
+	}
+	user, repoName, err := repos.Split(body.Name)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	} else if server.Users.User(user) == nil {
+		writeError(w, http.StatusUnprocessableEntity, "User "+user+" is not found")
+		return
+	}
+	_, err = repos.Create(server.GitRepoDir, user, repoName)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJson(w, http.StatusCreated, &repoJson{Name: user + "/" + repoName})
+}
+
+func (server *Server) showRepo(w http.ResponseWriter, r *http.Request, params []string) {
+	repo, ok := server.openRepo(w, params)
+	if !ok {
+		return
+	}
+	branch, err := repo.PublishBranch()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, &repoJson{Name: params[0] + "/" + params[1], PublishBranch: branch})
+}
+
+func (server *Server) deleteRepo(w http.ResponseWriter, r *http.Request, params []string) {
+	if _, ok := server.openRepo(w, params); !ok {
+		return
+	}
+	err := repos.Remove(server.GitRepoDir, params[0], params[1])
+	if err == nil {
+		err = server.Users.RemoveDeployKeys(params[0] + "/" + params[1])
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) setBranch(w http.ResponseWriter, r *http.Request, params []string) {
+	var body struct {
+		Branch string `json:"branch"`
+	}
+	if !readJson(w, r, &body) {
+		return
+	}
+	repo, ok := server.openRepo(w, params)
+	if !ok {
+		return
+	}
+	err := repo.SetPublishBranch(body.Branch)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, &repoJson{Name: params[0] + "/" + params[1], PublishBranch: body.Branch})
+}
+
+func (server *Server) republish(w http.ResponseWriter, r *http.Request, params []string) {
+	if _, ok := server.openRepo(w, params); !ok {
+		return
+	}
+	if server.Publisher == nil {
+		writeError(w, http.StatusServiceUnavailable, "Publishing is disabled")
+		return
+	}
+	pusher, _, _ := r.BasicAuth()
+	event, err := server.Publisher.Republish(params[0]+"/"+params[1], pusher)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJson(w, http.StatusAccepted, event)
+}
+
+func (server *Server) history(w http.ResponseWriter, r *http.Request, params []string) {
+	repo, ok := server.openRepo(w, params)
+	if !ok {
+		return
+	}
+	limit := defaultHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusUnprocessableEntity, "Invalid limit `"+value+"`")
+			return
+		}
+	}
+	history, err := publish.History(repo, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, history)
+}
+
+func (server *Server) listDeployKeys(w http.ResponseWriter, r *http.Request, params []string) {
+	if _, ok := server.openRepo(w, params); !ok {
+		return
+	}
+	list := []*deployKeyJson{}
+	for _, deployKey := range server.Users.DeployKeys(params[0] + "/" + params[1]) {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(deployKey.Key))
+		if err == nil {
+			list = append(list, &deployKeyJson{Fingerprint: ssh.FingerprintSHA256(key), Key: deployKey.Key,
+				Write: deployKey.Write})
+		}
+	}
+	writeJson(w, http.StatusOK, list)
+}
+
+func (server *Server) addDeployKey(w http.ResponseWriter, r *http.Request, params []string) {
+	var body struct {
+		Key   string `json:"key"`
+		Write bool   `json:"write"`
+	}
+	if !readJson(w, r, &body) {
+		return
+	}
+	if _, ok := server.openRepo(w, params); !ok {
+		return
+	}
+	fingerprint, err := server.Users.AddDeployKey(params[0]+"/"+params[1], body.Key, body.Write)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJson(w, http.StatusCreated, &deployKeyJson{Fingerprint: fingerprint, Key: body.Key, Write: body.Write})
+}
+
+func (server *Server) revokeDeployKey(w http.ResponseWriter, r *http.Request, params []string) {
+	err := server.Users.RevokeDeployKey(params[0]+"/"+params[1], params[2])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) openRepo(w http.ResponseWriter, params []string) (*repos.Repo, bool) {
+	user, repo, err := repos.Split(params[0] + "/" + params[1])
+	if err == nil {
+		path := repos.Path(server.GitRepoDir, user, repo)
+		if _, err = os.Stat(path); err == nil {
+			return repos.Open(path), true
+		}
+	}
+	writeError(w, http.StatusNotFound, "Repository "+params[0]+"/"+params[1]+" is not found")
+	return nil, false
+}
+
+func toUserJson(name string, user *auth.User) *userJson {
+	result := &userJson{Name: name, Admin: user.Admin, Keys: []keyJson{}, Tokens: len(user.Tokens)}
+	for _, line := range user.Keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil {
+			result.Keys = append(result.Keys, keyJson{Fingerprint: ssh.FingerprintSHA256(key), Key: line})
+		}
+	}
+	return result
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, body interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
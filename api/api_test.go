@@ -0,0 +1,116 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/repos"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAdminApi(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/.users.yml", []byte("users:\n  root:\n    admin: true\n    tokens:\n      - "+
+		auth.HashToken("s3cr3t")+"\n"), 0600)
+	assert.Nil(t, err)
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	users, err := auth.NewStore(dir + "/.users.yml")
+	assert.Nil(t, err)
+	server := httptest.NewServer(NewServer(dir, users, nil, nil, logger))
+	defer server.Close()
+
+	call := func(method string, path string, body string, result interface{}) int {
+		request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.Nil(t, err)
+		request.SetBasicAuth("root", "s3cr3t")
+		response, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		if result != nil {
+			assert.Nil(t, json.NewDecoder(response.Body).Decode(result))
+		}
+		return response.StatusCode
+	}
+
+	assert.EqualValues(t, call("POST", "/users", `{"name":"pry"}`, nil), http.StatusCreated)
+	assert.EqualValues(t, call("POST", "/users", `{"name":"pry"}`, nil), http.StatusUnprocessableEntity)
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	key, err := ssh.NewPublicKey(publicKey)
+	assert.Nil(t, err)
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	added := keyJson{}
+	assert.EqualValues(t, call("POST", "/users/pry/keys", `{"key":"`+line+`"}`, &added), http.StatusCreated)
+	assert.EqualValues(t, added.Fingerprint, ssh.FingerprintSHA256(key))
+	identity, err := users.AuthenticateKey(key)
+	assert.Nil(t, err)
+	assert.EqualValues(t, identity.User, "pry")
+
+	// Changes are saved, so they survive a reload
+	err = users.Reload()
+	assert.Nil(t, err)
+	user := userJson{}
+	assert.EqualValues(t, call("GET", "/users/pry", "", &user), http.StatusOK)
+	assert.EqualValues(t, user.Keys, []keyJson{{Fingerprint: added.Fingerprint, Key: line}})
+
+	assert.EqualValues(t, call("DELETE", "/users/pry/keys/"+added.Fingerprint, "", nil), http.StatusNoContent)
+	_, err = users.AuthenticateKey(key)
+	assert.NotNil(t, err)
+
+	assert.EqualValues(t, call("POST", "/repos", `{"name":"pry/ruby-pry"}`, nil), http.StatusCreated)
+	assert.EqualValues(t, call("POST", "/repos", `{"name":"nobody/repo"}`, nil), http.StatusUnprocessableEntity)
+	list := []repoJson{}
+	assert.EqualValues(t, call("GET", "/repos", "", &list), http.StatusOK)
+	assert.EqualValues(t, list, []repoJson{{Name: "pry/ruby-pry"}})
+
+	assert.EqualValues(t, call("PUT", "/repos/pry/ruby-pry/branch", `{"branch":"gh-pages"}`, nil), http.StatusOK)
+	branch, err := repos.Open(repos.Path(dir, "pry", "ruby-pry")).PublishBranch()
+	assert.Nil(t, err)
+	assert.EqualValues(t, branch, "gh-pages")
+	assert.EqualValues(t, call("PUT", "/repos/pry/ruby-pry/branch", `{"branch":"bad..name"}`, nil), http.StatusUnprocessableEntity)
+	assert.EqualValues(t, call("POST", "/repos/pry/ruby-pry/publish", "", nil), http.StatusServiceUnavailable)
+
+	history := []interface{}{}
+	assert.EqualValues(t, call("GET", "/repos/pry/ruby-pry/history", "", &history), http.StatusOK)
+	assert.Empty(t, history)
+
+	deployKey := deployKeyJson{}
+	assert.EqualValues(t, call("POST", "/repos/pry/ruby-pry/deploy_keys", `{"key":"`+line+`","write":true}`, &deployKey),
+		http.StatusCreated)
+	assert.EqualValues(t, deployKey.Fingerprint, ssh.FingerprintSHA256(key))
+	assert.EqualValues(t, call("POST", "/repos/pry/ruby-pry/deploy_keys", `{"key":"`+line+`"}`, nil),
+		http.StatusUnprocessableEntity)
+	assert.EqualValues(t, call("POST", "/repos/pry/missing/deploy_keys", `{"key":"`+line+`"}`, nil), http.StatusNotFound)
+	deployKeys := []deployKeyJson{}
+	assert.EqualValues(t, call("GET", "/repos/pry/ruby-pry/deploy_keys", "", &deployKeys), http.StatusOK)
+	assert.EqualValues(t, deployKeys, []deployKeyJson{{Fingerprint: deployKey.Fingerprint, Key: line, Write: true}})
+	identity, err = users.AuthenticateKey(key)
+	assert.Nil(t, err)
+	assert.True(t, identity.CanWrite("pry", "ruby-pry"))
+	assert.EqualValues(t, call("DELETE", "/repos/pry/ruby-pry/deploy_keys/"+deployKey.Fingerprint, "", nil),
+		http.StatusNoContent)
+	assert.EqualValues(t, call("DELETE", "/repos/pry/ruby-pry/deploy_keys/"+deployKey.Fingerprint, "", nil),
+		http.StatusNotFound)
+	assert.EqualValues(t, call("POST", "/repos/pry/ruby-pry/deploy_keys", `{"key":"`+line+`"}`, nil), http.StatusCreated)
+
+	assert.EqualValues(t, call("DELETE", "/repos/pry/ruby-pry", "", nil), http.StatusNoContent)
+	assert.Empty(t, users.DeployKeys("pry/ruby-pry"))
+	assert.EqualValues(t, call("GET", "/repos/pry/ruby-pry", "", nil), http.StatusNotFound)
+	assert.EqualValues(t, call("DELETE", "/users/pry", "", nil), http.StatusNoContent)
+	assert.EqualValues(t, call("PATCH", "/users", "", nil), http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	conf "github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+)
+
+// Actions recorded
+const (
+	SshAuth    = "ssh.auth"
+	SshBan     = "ssh.ban"
+	SshCommand = "ssh.command"
+	ApiAuth    = "api.auth"
+	ApiChange  = "api.change"
+	HttpAuth   = "http.auth"
+	HttpGit    = "http.git"
+	Publish    = "publish"
+)
+
+// Outcomes of the actions
+const (
+	Success = "success"
+	Failure = "failure"
+	Denied  = "denied"
+)
+
+var Facilities = map[string]syslog.Priority{
+	"AUTH":     syslog.LOG_AUTH,
+	"AUTHPRIV": syslog.LOG_AUTHPRIV,
+	"DAEMON":   syslog.LOG_DAEMON,
+	"USER":     syslog.LOG_USER,
+	"LOCAL0":   syslog.LOG_LOCAL0,
+	"LOCAL1":   syslog.LOG_LOCAL1,
+	"LOCAL2":   syslog.LOG_LOCAL2,
+	"LOCAL3":   syslog.LOG_LOCAL3,
+	"LOCAL4":   syslog.LOG_LOCAL4,
+	"LOCAL5":   syslog.LOG_LOCAL5,
+	"LOCAL6":   syslog.LOG_LOCAL6,
+	"LOCAL7":   syslog.LOG_LOCAL7,
+}
+
+// Entry is a line of the audit log
+type Entry struct {
+	Time    time.Time              `json:"time"`
+	Action  string                 `json:"action"`
+	Outcome string                 `json:"outcome"`
+	User    string                 `json:"user,omitempty"`
+	Source  string                 `json:"source,omitempty"`
+	Repo    string                 `json:"repo,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// Auditor appends the entries as JSON lines to the audit file or syslog, apart from the debug log.
+// A nil Auditor records nothing, so that auditing may be left out.
+type Auditor struct {
+	config *conf.Audit
+	logger log_driver.Logger
+	mutex  sync.Mutex
+	out    io.WriteCloser
+}
+
+// New opens the audit file or connects to syslog, it returns nil if neither is configured.
+func New(config *conf.Audit, logger log_driver.Logger) (*Auditor, error) {
+	if config.File == "" && config.Syslog.Protocol == "" {
+		return nil, nil
+	}
+	auditor := &Auditor{config: config, logger: logger}
+	out, err := auditor.open()
+	if err != nil {
+		return nil, err
+	}
+	auditor.out = out
+	return auditor, nil
+}
+
+func (auditor *Auditor) open() (io.WriteCloser, error) {
+	if auditor.config.File != "" {
+		return os.OpenFile(auditor.config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	syslogConfig := auditor.config.Syslog
+	return syslog.Dial(syslogConfig.Protocol, syslogConfig.Host,
+		Facilities[syslogConfig.Facility]|syslog.LOG_NOTICE, syslogConfig.Tag)
+}
+
+// Record appends entry, with the current time if its time is not set.
+func (auditor *Auditor) Record(entry *Entry) {
+	if auditor == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		auditor.logger.Errorf("Failed to encode audit entry %s due to %s", entry.Action, err)
+		return
+	}
+	auditor.mutex.Lock()
+	defer auditor.mutex.Unlock()
+	_, err = auditor.out.Write(append(line, '\n'))
+	if err != nil {
+		auditor.logger.Errorf("Failed to record audit entry %s due to %s", string(line), err)
+	}
+}
+
+// Reopen opens the audit file again after it's rotated externally, or reconnects to syslog.
+func (auditor *Auditor) Reopen() error {
+	if auditor == nil {
+		return nil
+	}
+	out, err := auditor.open()
+	if err != nil {
+		return err
+	}
+	auditor.mutex.Lock()
+	defer auditor.mutex.Unlock()
+	previous := auditor.out
+	auditor.out = out
+	return previous.Close()
+}
+
+func (auditor *Auditor) Close() error {
+	if auditor == nil {
+		return nil
+	}
+	auditor.mutex.Lock()
+	defer auditor.mutex.Unlock()
+	return auditor.out.Close()
+}
+
+// Handle records the finished publishes, it's meant to be subscribed to the event bus
+func (auditor *Auditor) Handle(event *events.Event) {
+	if event.Type != events.PublishSucceeded && event.Type != events.PublishFailed {
+		return
+	}
+	outcome := Success
+	if event.Type == events.PublishFailed {
+		outcome = Failure
+	}
+	details := map[string]interface{}{"event": event.Id, "push": event.Parent, "ref": event.Ref, "sha": event.NewSha}
+	auditor.Record(&Entry{Time: event.Time, Action: Publish, Outcome: outcome, User: event.Pusher, Repo: event.Repo,
+		Details: details, Error: event.Error})
+}
@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/audit.log"
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+
+	auditor, err := New(&config.Audit{}, logger)
+	assert.Nil(t, err)
+	assert.Nil(t, auditor)
+	auditor.Record(&Entry{Action: SshAuth, Outcome: Failure})
+
+	auditor, err = New(&config.Audit{File: path}, logger)
+	assert.Nil(t, err)
+	auditor.Record(&Entry{Action: SshAuth, Outcome: Failure, Source: "127.0.0.1:40000",
+		Details: map[string]interface{}{"method": "publickey", "login": "git"}, Error: "Unknown public key"})
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.Nil(t, auditor.Reopen())
+	bus := events.NewBus(logger)
+	bus.Subscribe(auditor.Handle)
+	push := &events.Event{Type: events.Push, Repo: "pry/ruby-pry", Ref: "refs/heads/master", NewSha: "abc", Pusher: "pry"}
+	bus.Emit(push)
+	bus.Emit(push.Derive(events.PublishStarted))
+	failed := push.Derive(events.PublishFailed)
+	failed.Error = "No space left on device"
+	bus.Emit(failed)
+	assert.Nil(t, auditor.Close())
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.EqualValues(t, info.Mode().Perm(), 0600)
+
+	readEntries := func(path string) []*Entry {
+		content, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		var entries []*Entry
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			entry := &Entry{}
+			assert.Nil(t, json.Unmarshal([]byte(line), entry))
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+	entries := readEntries(path + ".1")
+	assert.Len(t, entries, 1)
+	assert.EqualValues(t, entries[0].Action, SshAuth)
+	assert.EqualValues(t, entries[0].Outcome, Failure)
+	assert.EqualValues(t, entries[0].Source, "127.0.0.1:40000")
+	assert.EqualValues(t, entries[0].Details["method"], "publickey")
+	assert.False(t, entries[0].Time.IsZero())
+
+	entries = readEntries(path)
+	assert.Len(t, entries, 1)
+	assert.EqualValues(t, entries[0].Action, Publish)
+	assert.EqualValues(t, entries[0].Outcome, Failure)
+	assert.EqualValues(t, entries[0].User, "pry")
+	assert.EqualValues(t, entries[0].Repo, "pry/ruby-pry")
+	assert.EqualValues(t, entries[0].Details["sha"], "abc")
+	assert.NotEmpty(t, push.Id)
+	assert.EqualValues(t, entries[0].Details["push"], push.Id)
+	assert.EqualValues(t, entries[0].Error, "No space left on device")
+}
@@ -0,0 +1,457 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bachue/pages/repos"
+	"golang.org/x/crypto/ssh"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type User struct {
+	// Admin users may use the admin API
+	Admin bool `yaml:"admin,omitempty"`
+	// Keys are SSH public keys in the authorized_keys format
+	Keys []string `yaml:"keys,omitempty"`
+	// Tokens are the SHA-256 hex digests of the tokens authenticating the user over HTTP
+	Tokens []string `yaml:"tokens,omitempty"`
+}
+
+func (user *User) clone() *User {
+	return &User{Admin: user.Admin, Keys: append([]string{}, user.Keys...), Tokens: append([]string{}, user.Tokens...)}
+}
+
+// DeployKey is an SSH public key in the authorized_keys format, which may only fetch from its repository,
+// and push to it if write is set
+type DeployKey struct {
+	Key   string `yaml:"key"`
+	Write bool   `yaml:"write,omitempty"`
+}
+
+type usersFile struct {
+	Users map[string]*User `yaml:"users"`
+	// DeployKeys are the deploy keys of each repository `<user>/<repo>`
+	DeployKeys map[string][]*DeployKey `yaml:"deploy_keys,omitempty"`
+}
+
+func (file *usersFile) clone() *usersFile {
+	cloned := &usersFile{Users: make(map[string]*User, len(file.Users)), DeployKeys: map[string][]*DeployKey{}}
+	for name, user := range file.Users {
+		cloned.Users[name] = user.clone()
+	}
+	for repo, deployKeys := range file.DeployKeys {
+		for _, deployKey := range deployKeys {
+			copied := *deployKey
+			cloned.DeployKeys[repo] = append(cloned.DeployKeys[repo], &copied)
+		}
+	}
+	return cloned
+}
+
+// Identity is who an SSH or HTTP client is authenticated as. A deploy key is authenticated as the
+// synthetic user `deploy:<user>/<repo>`, which is confined to that repository.
+type Identity struct {
+	User  string
+	Admin bool
+	// Repo is the only repository of a deploy key, which may push to it if Write is set
+	Repo  string
+	Write bool
+}
+
+// DeployUser is the synthetic user name of the deploy keys of repo `<user>/<repo>`
+func DeployUser(repo string) string {
+	return "deploy:" + repo
+}
+
+// CanRead tells if identity may fetch from the repository owner/repo
+func (identity *Identity) CanRead(owner string, repo string) bool {
+	if identity.Repo != "" {
+		return identity.Repo == owner+"/"+repo
+	}
+	return identity.User == owner
+}
+
+// CanBrowse tells if identity may read some of the repositories of owner
+func (identity *Identity) CanBrowse(owner string) bool {
+	if identity.Repo != "" {
+		return strings.HasPrefix(identity.Repo, owner+"/")
+	}
+	return identity.User == owner
+}
+
+// CanWrite tells if identity may push to the repository owner/repo
+func (identity *Identity) CanWrite(owner string, repo string) bool {
+	if identity.Repo != "" {
+		return identity.Repo == owner+"/"+repo && identity.Write
+	}
+	return identity.User == owner
+}
+
+// Store keeps the users with their credentials in a YAML file, such as
+//
+//	users:
+//	    bachue:
+//	        admin: true
+//	        keys:
+//	            - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG... bachue@laptop
+//	        tokens:
+//	            - 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	deploy_keys:
+//	    bachue/blog:
+//	        - key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIH... ci
+//	          write: true
+type Store struct {
+	Path  string
+	mutex sync.RWMutex
+	file  *usersFile
+	// keys are the identities authenticated by each public key, including the deploy keys
+	keys map[string]*Identity
+}
+
+func NewStore(path string) (*Store, error) {
+	store := &Store{Path: path}
+	err := store.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads the users file again, a missing file means no user at all.
+func (store *Store) Reload() error {
+	file := usersFile{}
+	content, err := ioutil.ReadFile(store.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = yaml.Unmarshal(content, &file)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %s", store.Path, err)
+	}
+	if file.Users == nil {
+		file.Users = map[string]*User{}
+	}
+	for name, user := range file.Users {
+		if user == nil {
+			file.Users[name] = &User{}
+		}
+	}
+	keys, err := indexKeys(&file)
+	if err != nil {
+		return fmt.Errorf("%s in %s", err, store.Path)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.file = &file
+	store.keys = keys
+	return nil
+}
+
+func indexKeys(file *usersFile) (map[string]*Identity, error) {
+	keys := map[string]*Identity{}
+	index := func(line string, identity *Identity) error {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("Invalid key of %s: %s", identity.User, err)
+		}
+		if owner, ok := keys[string(key.Marshal())]; ok && owner.User != identity.User {
+			return fmt.Errorf("Key %s is used by both %s and %s", ssh.FingerprintSHA256(key), owner.User, identity.User)
+		}
+		keys[string(key.Marshal())] = identity
+		return nil
+	}
+	for name, user := range file.Users {
+		for _, line := range user.Keys {
+			err := index(line, &Identity{User: name, Admin: user.Admin})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for repo, deployKeys := range file.DeployKeys {
+		for _, deployKey := range deployKeys {
+			err := index(deployKey.Key, &Identity{User: DeployUser(repo), Repo: repo, Write: deployKey.Write})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Users returns the names of all the users, sorted
+func (store *Store) Users() []string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	names := make([]string, 0, len(store.file.Users))
+	for name := range store.file.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// User returns a copy of the user name, or nil if there is no such user
+func (store *Store) User(name string) *User {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	user, ok := store.file.Users[name]
+	if !ok {
+		return nil
+	}
+	return user.clone()
+}
+
+func (store *Store) AddUser(name string, admin bool) error {
+	if !repos.IsValidName(name) {
+		return fmt.Errorf("Invalid user name `%s`", name)
+	}
+	return store.update(func(file *usersFile) error {
+		if _, ok := file.Users[name]; ok {
+			return fmt.Errorf("User %s already exists", name)
+		}
+		file.Users[name] = &User{Admin: admin}
+		return nil
+	})
+}
+
+// DeleteUser deletes user name along with the deploy keys of their repositories
+func (store *Store) DeleteUser(name string) error {
+	return store.update(func(file *usersFile) error {
+		if _, ok := file.Users[name]; !ok {
+			return fmt.Errorf("User %s is not found", name)
+		}
+		delete(file.Users, name)
+		for repo := range file.DeployKeys {
+			if strings.HasPrefix(repo, name+"/") {
+				delete(file.DeployKeys, repo)
+			}
+		}
+		return nil
+	})
+}
+
+// AddKey authorizes the public key line, in the authorized_keys format, for user name and
+// returns its fingerprint.
+func (store *Store) AddKey(name string, line string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", fmt.Errorf("Invalid public key: %s", err)
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	err = store.update(func(file *usersFile) error {
+		user, ok := file.Users[name]
+		if !ok {
+			return fmt.Errorf("User %s is not found", name)
+		}
+		if owner, ok := store.keys[string(key.Marshal())]; ok {
+			return fmt.Errorf("Key %s is already used by %s", fingerprint, owner.User)
+		}
+		user.Keys = append(user.Keys, strings.TrimSpace(line))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fingerprint, nil
+}
+
+// RevokeKey removes the key of user name whose SHA-256 fingerprint is fingerprint
+func (store *Store) RevokeKey(name string, fingerprint string) error {
+	return store.update(func(file *usersFile) error {
+		user, ok := file.Users[name]
+		if !ok {
+			return fmt.Errorf("User %s is not found", name)
+		}
+		for i, line := range user.Keys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err == nil && ssh.FingerprintSHA256(key) == fingerprint {
+				user.Keys = append(user.Keys[:i], user.Keys[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("Key %s of user %s is not found", fingerprint, name)
+	})
+}
+
+// AddToken generates a new token for user name, only its digest is kept so the token
+// itself can't be retrieved later.
+func (store *Store) AddToken(name string) (string, error) {
+	buffer := make([]byte, 20)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buffer)
+	err = store.update(func(file *usersFile) error {
+		user, ok := file.Users[name]
+		if !ok {
+			return fmt.Errorf("User %s is not found", name)
+		}
+		user.Tokens = append(user.Tokens, HashToken(token))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DeployKeys returns copies of the deploy keys of repo `<user>/<repo>`
+func (store *Store) DeployKeys(repo string) []*DeployKey {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var deployKeys []*DeployKey
+	for _, deployKey := range store.file.DeployKeys[repo] {
+		copied := *deployKey
+		deployKeys = append(deployKeys, &copied)
+	}
+	return deployKeys
+}
+
+// AddDeployKey authorizes the public key line, in the authorized_keys format, for repo `<user>/<repo>`
+// only, which may push if write is set, and returns its fingerprint.
+func (store *Store) AddDeployKey(repo string, line string, write bool) (string, error) {
+	owner, name, err := repos.Split(repo)
+	if err != nil {
+		return "", err
+	}
+	repo = owner + "/" + name
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", fmt.Errorf("Invalid public key: %s", err)
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	err = store.update(func(file *usersFile) error {
+		if _, ok := file.Users[owner]; !ok {
+			return fmt.Errorf("User %s is not found", owner)
+		}
+		if identity, ok := store.keys[string(key.Marshal())]; ok {
+			return fmt.Errorf("Key %s is already used by %s", fingerprint, identity.User)
+		}
+		file.DeployKeys[repo] = append(file.DeployKeys[repo], &DeployKey{Key: strings.TrimSpace(line), Write: write})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fingerprint, nil
+}
+
+// RevokeDeployKey removes the deploy key of repo `<user>/<repo>` whose SHA-256 fingerprint is fingerprint
+func (store *Store) RevokeDeployKey(repo string, fingerprint string) error {
+	return store.update(func(file *usersFile) error {
+		for i, deployKey := range file.DeployKeys[repo] {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(deployKey.Key))
+			if err == nil && ssh.FingerprintSHA256(key) == fingerprint {
+				file.DeployKeys[repo] = append(file.DeployKeys[repo][:i], file.DeployKeys[repo][i+1:]...)
+				if len(file.DeployKeys[repo]) == 0 {
+					delete(file.DeployKeys, repo)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("Deploy key %s of %s is not found", fingerprint, repo)
+	})
+}
+
+// RemoveDeployKeys removes all the deploy keys of repo `<user>/<repo>`, such as when it's deleted
+func (store *Store) RemoveDeployKeys(repo string) error {
+	if len(store.DeployKeys(repo)) == 0 {
+		return nil
+	}
+	return store.update(func(file *usersFile) error {
+		delete(file.DeployKeys, repo)
+		return nil
+	})
+}
+
+// update applies change to a copy of the users and the deploy keys, then saves them into the users
+// file and makes them effective at once.
+func (store *Store) update(change func(file *usersFile) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	file := store.file.clone()
+	err := change(file)
+	if err != nil {
+		return err
+	}
+	keys, err := indexKeys(file)
+	if err != nil {
+		return err
+	}
+	err = store.save(file)
+	if err != nil {
+		return err
+	}
+	store.file = file
+	store.keys = keys
+	return nil
+}
+
+func (store *Store) save(file *usersFile) error {
+	content, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(store.Path), ".users")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), store.Path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("Failed to save %s: %s", store.Path, err)
+	}
+	return nil
+}
+
+func (store *Store) AuthenticateKey(key ssh.PublicKey) (*Identity, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	identity, ok := store.keys[string(key.Marshal())]
+	if !ok {
+		return nil, fmt.Errorf("Unknown public key %s", ssh.FingerprintSHA256(key))
+	}
+	copied := *identity
+	return &copied, nil
+}
+
+func (store *Store) AuthenticateToken(name string, token string) (*Identity, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	user, ok := store.file.Users[name]
+	if ok {
+		digest := HashToken(token)
+		for _, expected := range user.Tokens {
+			if subtle.ConstantTimeCompare([]byte(digest), []byte(expected)) == 1 {
+				return &Identity{User: name, Admin: user.Admin}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Invalid token for user %s", name)
+}
+
+func HashToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestStore(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	key, err := ssh.NewPublicKey(publicKey)
+	assert.Nil(t, err)
+
+	file, err := ioutil.TempFile("", "users")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("users:\n  pry:\n    keys:\n      - " + string(ssh.MarshalAuthorizedKey(key)) +
+		"    tokens:\n      - " + HashToken("s3cr3t") + "\n  rails:\n")
+	assert.Nil(t, err)
+	file.Close()
+
+	store, err := NewStore(file.Name())
+	assert.Nil(t, err)
+	identity, err := store.AuthenticateKey(key)
+	assert.Nil(t, err)
+	assert.EqualValues(t, identity.User, "pry")
+	assert.True(t, identity.CanWrite("pry", "ruby-pry"))
+	assert.False(t, identity.CanRead("rails", "rails"))
+
+	identity, err = store.AuthenticateToken("pry", "s3cr3t")
+	assert.Nil(t, err)
+	assert.EqualValues(t, identity.User, "pry")
+	_, err = store.AuthenticateToken("pry", "wrong")
+	assert.NotNil(t, err)
+	_, err = store.AuthenticateToken("rails", "s3cr3t")
+	assert.NotNil(t, err)
+
+	store, err = NewStore(file.Name() + ".missing")
+	assert.Nil(t, err)
+	_, err = store.AuthenticateKey(key)
+	assert.NotNil(t, err)
+}
+
+func TestDeployKeys(t *testing.T) {
+	newKey := func() (ssh.PublicKey, string) {
+		publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+		key, err := ssh.NewPublicKey(publicKey)
+		assert.Nil(t, err)
+		return key, string(ssh.MarshalAuthorizedKey(key))
+	}
+	userKey, userLine := newKey()
+	readKey, readLine := newKey()
+	writeKey, writeLine := newKey()
+
+	file, err := ioutil.TempFile("", "users")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("users:\n  pry:\n    keys:\n      - " + userLine)
+	assert.Nil(t, err)
+	file.Close()
+	store, err := NewStore(file.Name())
+	assert.Nil(t, err)
+
+	fingerprint, err := store.AddDeployKey("pry/ruby-pry", readLine, false)
+	assert.Nil(t, err)
+	assert.EqualValues(t, fingerprint, ssh.FingerprintSHA256(readKey))
+	_, err = store.AddDeployKey("pry/pry-doc", writeLine, true)
+	assert.Nil(t, err)
+	_, err = store.AddDeployKey("pry/pry-doc", userLine, true)
+	assert.NotNil(t, err)
+	_, err = store.AddDeployKey("pry/pry-doc", readLine, true)
+	assert.NotNil(t, err)
+	_, err = store.AddDeployKey("rails/rails", string(ssh.MarshalAuthorizedKey(userKey)), false)
+	assert.NotNil(t, err)
+
+	// Changes are saved, so they survive a reload
+	assert.Nil(t, store.Reload())
+	identity, err := store.AuthenticateKey(readKey)
+	assert.Nil(t, err)
+	assert.EqualValues(t, identity.User, DeployUser("pry/ruby-pry"))
+	assert.True(t, identity.CanRead("pry", "ruby-pry"))
+	assert.False(t, identity.CanWrite("pry", "ruby-pry"))
+	assert.False(t, identity.CanRead("pry", "pry-doc"))
+	assert.True(t, identity.CanBrowse("pry"))
+	assert.False(t, identity.CanBrowse("pr"))
+	identity, err = store.AuthenticateKey(writeKey)
+	assert.Nil(t, err)
+	assert.True(t, identity.CanWrite("pry", "pry-doc"))
+	assert.False(t, identity.CanRead("pry", "ruby-pry"))
+
+	assert.Nil(t, store.RevokeDeployKey("pry/ruby-pry", fingerprint))
+	assert.NotNil(t, store.RevokeDeployKey("pry/ruby-pry", fingerprint))
+	_, err = store.AuthenticateKey(readKey)
+	assert.NotNil(t, err)
+	assert.Len(t, store.DeployKeys("pry/pry-doc"), 1)
+
+	assert.Nil(t, store.DeleteUser("pry"))
+	assert.Empty(t, store.DeployKeys("pry/pry-doc"))
+	_, err = store.AuthenticateKey(writeKey)
+	assert.NotNil(t, err)
+}
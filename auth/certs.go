@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertAuthority authenticates the SSH user certificates signed by its keys, the principals of a
+// certificate are the names of the users it may authenticate as.
+type CertAuthority struct {
+	users       *Store
+	keys        map[string]bool
+	revocations *RevocationList
+	checker     *ssh.CertChecker
+}
+
+// NewCertAuthority trusts the CA keys in the authorized_keys format, revocationList is the path of
+// the revoked keys and certificates, or "" if there is none.
+func NewCertAuthority(users *Store, keys []string, revocationList string) (*CertAuthority, error) {
+	authority := &CertAuthority{users: users, keys: map[string]bool{}}
+	for _, line := range keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CA key: %s", err)
+		}
+		authority.keys[string(key.Marshal())] = true
+	}
+	if revocationList != "" {
+		revocations, err := NewRevocationList(revocationList)
+		if err != nil {
+			return nil, err
+		}
+		authority.revocations = revocations
+	}
+	authority.checker = &ssh.CertChecker{
+		IsUserAuthority: func(key ssh.PublicKey) bool {
+			return authority.keys[string(key.Marshal())]
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return authority.IsRevoked(cert.Key) || authority.IsRevoked(cert.SignatureKey) ||
+				authority.revocations.isRevokedCert(cert)
+		},
+		// sshd checks the source address of the permissions returned, the others are refused
+		SupportedCriticalOptions: []string{"source-address"},
+	}
+	return authority, nil
+}
+
+// Authenticate verifies cert for login, which is the user name of the SSH client. The identity is
+// login if it's one of the principals, otherwise the first principal which is a user.
+func (authority *CertAuthority) Authenticate(login string, cert *ssh.Certificate) (*Identity, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("Certificate %s is not a user certificate", cert.KeyId)
+	}
+	// Unlike CertChecker.Authenticate, CheckCert doesn't check the CA
+	if !authority.checker.IsUserAuthority(cert.SignatureKey) {
+		return nil, fmt.Errorf("Certificate %s is signed by an unknown CA", cert.KeyId)
+	}
+	principal := ""
+	for _, candidate := range cert.ValidPrincipals {
+		if authority.users.User(candidate) == nil {
+			continue
+		}
+		if candidate == login {
+			principal = candidate
+			break
+		} else if principal == "" {
+			principal = candidate
+		}
+	}
+	if principal == "" {
+		return nil, fmt.Errorf("Certificate %s has no principal of any user", cert.KeyId)
+	}
+	err := authority.checker.CheckCert(principal, cert)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{User: principal, Admin: authority.users.User(principal).Admin}, nil
+}
+
+// IsRevoked tells if key is in the revocation list
+func (authority *CertAuthority) IsRevoked(key ssh.PublicKey) bool {
+	return authority != nil && authority.revocations.isRevokedKey(key)
+}
+
+// RevocationList is a file of the revoked keys and certificates, in the text format of the key
+// revocation lists of `ssh-keygen -k`, such as
+//
+//	# The CA key, key or certificate revoked
+//	ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG...
+//	key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG...
+//	hash: SHA256:1NplGk/nt8rT0vVPA5OPvsFx8ju5XHqi4PcOZaKTSdo
+//	# The serials and the key ids of the certificates revoked
+//	serial: 10
+//	serial: 20-29
+//	id: bachue@laptop
+//
+// The serials apply to the certificates of every CA. The file is read again once it's modified.
+type RevocationList struct {
+	Path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	hashes  map[string]bool
+	serials [][2]uint64
+	ids     map[string]bool
+}
+
+func NewRevocationList(path string) (*RevocationList, error) {
+	list := &RevocationList{Path: path}
+	err := list.reload()
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// reload reads the file again if it's modified
+func (list *RevocationList) reload() error {
+	info, err := os.Stat(list.Path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(list.modTime) {
+		return nil
+	}
+	content, err := ioutil.ReadFile(list.Path)
+	if err != nil {
+		return err
+	}
+	hashes, serials, ids, err := parseRevocations(content)
+	if err != nil {
+		return fmt.Errorf("%s in %s", err, list.Path)
+	}
+	list.modTime = info.ModTime()
+	list.hashes, list.serials, list.ids = hashes, serials, ids
+	return nil
+}
+
+func parseRevocations(content []byte) (map[string]bool, [][2]uint64, map[string]bool, error) {
+	hashes := map[string]bool{}
+	var serials [][2]uint64
+	ids := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value := "key", line
+		if colon := strings.Index(line, ":"); colon > 0 && !strings.Contains(line[:colon], " ") {
+			kind, value = strings.ToLower(line[:colon]), strings.TrimSpace(line[colon+1:])
+		}
+		switch kind {
+		case "key":
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("Invalid key at line %d: %s", number, err)
+			}
+			hashes[ssh.FingerprintSHA256(key)] = true
+		case "hash":
+			if !strings.HasPrefix(value, "SHA256:") {
+				return nil, nil, nil, fmt.Errorf("Invalid hash at line %d, expected a SHA256 fingerprint", number)
+			}
+			hashes[value] = true
+		case "serial":
+			bounds := strings.SplitN(value, "-", 2)
+			low, err := strconv.ParseUint(bounds[0], 10, 64)
+			high := low
+			if err == nil && len(bounds) == 2 {
+				high, err = strconv.ParseUint(bounds[1], 10, 64)
+			}
+			if err != nil || low > high {
+				return nil, nil, nil, fmt.Errorf("Invalid serial at line %d", number)
+			}
+			serials = append(serials, [2]uint64{low, high})
+		case "id":
+			ids[value] = true
+		default:
+			return nil, nil, nil, fmt.Errorf("Unknown revocation `%s` at line %d", kind, number)
+		}
+	}
+	return hashes, serials, ids, scanner.Err()
+}
+
+// isRevoked reloads the file if it's modified, then tells if revoked holds. Everything is revoked if the
+// file can't be read, the same as OpenSSH does.
+func (list *RevocationList) isRevoked(revoked func() bool) bool {
+	if list == nil {
+		return false
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if list.reload() != nil {
+		return true
+	}
+	return revoked()
+}
+
+func (list *RevocationList) isRevokedKey(key ssh.PublicKey) bool {
+	return list.isRevoked(func() bool {
+		return list.hashes[ssh.FingerprintSHA256(key)]
+	})
+}
+
+func (list *RevocationList) isRevokedCert(cert *ssh.Certificate) bool {
+	return list.isRevoked(func() bool {
+		if list.ids[cert.KeyId] {
+			return true
+		}
+		for _, serials := range list.serials {
+			if cert.Serial >= serials[0] && cert.Serial <= serials[1] {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/users.yml", []byte("users:\n  pry:\n  rails:\n    admin: true\n"), 0600)
+	assert.Nil(t, err)
+	users, err := NewStore(dir + "/users.yml")
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(dir+"/revoked", []byte("# Nothing yet\n"), 0600)
+	assert.Nil(t, err)
+
+	_, caPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	ca, err := ssh.NewSignerFromKey(caPrivateKey)
+	assert.Nil(t, err)
+	authority, err := NewCertAuthority(users, []string{string(ssh.MarshalAuthorizedKey(ca.PublicKey()))}, dir+"/revoked")
+	assert.Nil(t, err)
+
+	newCert := func(serial uint64, principals []string, validBefore time.Time, options map[string]string) *ssh.Certificate {
+		publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+		key, err := ssh.NewPublicKey(publicKey)
+		assert.Nil(t, err)
+		cert := &ssh.Certificate{Key: key, Serial: serial, CertType: ssh.UserCert, KeyId: "laptop",
+			ValidPrincipals: principals, ValidAfter: uint64(time.Now().Add(-time.Minute).Unix()),
+			ValidBefore: uint64(validBefore.Unix()), Permissions: ssh.Permissions{CriticalOptions: options}}
+		assert.Nil(t, cert.SignCert(rand.Reader, ca))
+		return cert
+	}
+	later := time.Now().Add(time.Hour)
+
+	identity, err := authority.Authenticate("git", newCert(1, []string{"unknown", "pry", "rails"}, later, nil))
+	assert.Nil(t, err)
+	assert.EqualValues(t, identity.User, "pry")
+	identity, err = authority.Authenticate("rails", newCert(2, []string{"pry", "rails"}, later, nil))
+	assert.Nil(t, err)
+	assert.EqualValues(t, identity.User, "rails")
+	assert.True(t, identity.Admin)
+	_, err = authority.Authenticate("git", newCert(3, []string{"unknown"}, later, nil))
+	assert.NotNil(t, err)
+	_, err = authority.Authenticate("git", newCert(4, []string{"pry"}, time.Now().Add(-time.Second), nil))
+	assert.NotNil(t, err)
+	_, err = authority.Authenticate("git", newCert(5, []string{"pry"}, later,
+		map[string]string{"source-address": "10.0.0.0/8"}))
+	assert.Nil(t, err)
+	_, err = authority.Authenticate("git", newCert(6, []string{"pry"}, later, map[string]string{"force-command": "true"}))
+	assert.NotNil(t, err)
+
+	// Signed by another CA
+	_, otherPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	other, err := ssh.NewSignerFromKey(otherPrivateKey)
+	assert.Nil(t, err)
+	cert := newCert(7, []string{"pry"}, later, nil)
+	assert.Nil(t, cert.SignCert(rand.Reader, other))
+	_, err = authority.Authenticate("git", cert)
+	assert.NotNil(t, err)
+
+	cert = newCert(8, []string{"pry"}, later, nil)
+	revokedKey := newCert(20, []string{"pry"}, later, nil)
+	err = ioutil.WriteFile(dir+"/revoked", []byte("serial: 8\nid: stolen\nkey: "+
+		string(ssh.MarshalAuthorizedKey(revokedKey.Key))), 0600)
+	assert.Nil(t, err)
+	// Make sure the modification is noticed
+	assert.Nil(t, os.Chtimes(dir+"/revoked", later, later))
+	_, err = authority.Authenticate("git", cert)
+	assert.NotNil(t, err)
+	_, err = authority.Authenticate("git", revokedKey)
+	assert.NotNil(t, err)
+	assert.True(t, authority.IsRevoked(revokedKey.Key))
+	stolen := newCert(9, []string{"pry"}, later, nil)
+	stolen.KeyId = "stolen"
+	assert.Nil(t, stolen.SignCert(rand.Reader, ca))
+	_, err = authority.Authenticate("git", stolen)
+	assert.NotNil(t, err)
+	_, err = authority.Authenticate("git", newCert(10, []string{"pry"}, later, nil))
+	assert.Nil(t, err)
+
+	// Everything is revoked once the list can't be read
+	assert.Nil(t, os.Remove(dir+"/revoked"))
+	_, err = authority.Authenticate("git", newCert(11, []string{"pry"}, later, nil))
+	assert.NotNil(t, err)
+
+	_, err = NewRevocationList(dir + "/users.yml")
+	assert.NotNil(t, err)
+}
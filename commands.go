@@ -0,0 +1,322 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+
+	"github.com/bachue/pages/audit"
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/publish"
+	"github.com/bachue/pages/repos"
+	"github.com/bachue/pages/webhook"
+	"golang.org/x/crypto/ssh"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const redacted = "<redacted>"
+
+func mount(args []string) int {
+	if len(args) != 1 {
+		return badUsage("mount")
+	}
+	logger := loadConfig()
+	config.Current.Fuse.MountPoint = args[0]
+	manager := newManager(logger)
+	gitfs := addGitFs(manager, false, logger)
+	config.Subscribe(func(current *config.Environmental) {
+		gitfs.Reconfigure(&current.Fuse)
+	})
+	manager.OnReload(func() {
+		_, err := config.Reload()
+		if err != nil {
+			logger.Errorf("Failed to reload config, keep the current one: %s", err)
+		}
+	})
+	return manager.Run()
+}
+
+func checkConfig(args []string) int {
+	if len(args) != 0 {
+		return badUsage("config check")
+	}
+	err := config.Check()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s is valid\n", config.LoadedFile)
+	return 0
+}
+
+func dumpConfig(args []string) int {
+	if len(args) != 0 {
+		return badUsage("config dump")
+	}
+	err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	current := *config.Current
+	if current.Sshd.PrivateKey != "" {
+		current.Sshd.PrivateKey = redacted
+	}
+	content, err := yaml.Marshal(&current)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to dump config: %s\n", err)
+		return 1
+	}
+	fmt.Print(string(content))
+	return 0
+}
+
+func createRepo(args []string) int {
+	if len(args) != 1 {
+		return badUsage("repo create")
+	}
+	owner, name, err := repos.Split(args[0])
+	if err == nil {
+		err = loadConfigQuietly()
+	}
+	if err == nil {
+		_, err = repos.Create(config.Current.Fuse.GitRepoDir, owner, name)
+	}
+	return report(err, "Created repository %s/%s", owner, name)
+}
+
+func listRepos(args []string) int {
+	if len(args) > 1 {
+		return badUsage("repo list")
+	}
+	owner := ""
+	if len(args) == 1 {
+		owner = args[0]
+		if !repos.IsValidName(owner) {
+			fmt.Fprintf(os.Stderr, "Invalid user name `%s`\n", owner)
+			return 1
+		}
+	}
+	err := loadConfigQuietly()
+	if err != nil {
+		return report(err, "")
+	}
+	names, err := repos.List(config.Current.Fuse.GitRepoDir, owner)
+	if err != nil {
+		return report(err, "")
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return 0
+}
+
+func deleteRepo(args []string) int {
+	if len(args) != 1 {
+		return badUsage("repo delete")
+	}
+	owner, name, err := repos.Split(args[0])
+	if err == nil {
+		err = loadConfigQuietly()
+	}
+	if err == nil {
+		err = repos.Remove(config.Current.Fuse.GitRepoDir, owner, name)
+	}
+	var users *auth.Store
+	if err == nil {
+		users, err = auth.NewStore(config.Current.Auth.UsersFile)
+	}
+	if err == nil {
+		err = users.RemoveDeployKeys(owner + "/" + name)
+	}
+	return report(err, "Deleted repository %s/%s", owner, name)
+}
+
+func addKey(args []string) int {
+	if len(args) != 2 {
+		return badUsage("user add-key")
+	}
+	name, path := args[0], args[1]
+	content, err := readKey(path)
+	if err == nil {
+		err = loadConfigQuietly()
+	}
+	var users *auth.Store
+	if err == nil {
+		users, err = auth.NewStore(config.Current.Auth.UsersFile)
+	}
+	if err == nil && users.User(name) == nil {
+		err = users.AddUser(name, false)
+	}
+	fingerprint := ""
+	if err == nil {
+		fingerprint, err = users.AddKey(name, string(content))
+	}
+	return report(err, "Added key %s to user %s", fingerprint, name)
+}
+
+func addDeployKey(args []string) int {
+	flags := flag.NewFlagSet("deploy-key add", flag.ExitOnError)
+	write := flags.Bool("write", false, "allow the key to push")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return badUsage("deploy-key add")
+	}
+	repo, path := flags.Arg(0), flags.Arg(1)
+	content, err := readKey(path)
+	var users *auth.Store
+	if err == nil {
+		users, err = openRepoUsers(repo)
+	}
+	fingerprint := ""
+	if err == nil {
+		fingerprint, err = users.AddDeployKey(repo, string(content), *write)
+	}
+	return report(err, "Added deploy key %s to %s", fingerprint, repo)
+}
+
+func listDeployKeys(args []string) int {
+	if len(args) != 1 {
+		return badUsage("deploy-key list")
+	}
+	users, err := openRepoUsers(args[0])
+	if err != nil {
+		return report(err, "")
+	}
+	owner, name, _ := repos.Split(args[0])
+	for _, deployKey := range users.DeployKeys(owner + "/" + name) {
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(deployKey.Key))
+		if err != nil {
+			continue
+		}
+		access := "read-only"
+		if deployKey.Write {
+			access = "read-write"
+		}
+		fmt.Printf("%s %s %s\n", ssh.FingerprintSHA256(key), access, comment)
+	}
+	return 0
+}
+
+func revokeDeployKey(args []string) int {
+	if len(args) != 2 {
+		return badUsage("deploy-key revoke")
+	}
+	users, err := openRepoUsers(args[0])
+	if err == nil {
+		owner, name, _ := repos.Split(args[0])
+		err = users.RevokeDeployKey(owner+"/"+name, args[1])
+	}
+	return report(err, "Revoked deploy key %s of %s", args[1], args[0])
+}
+
+// openRepoUsers loads the users after checking the repository `<user>/<repo>` exists
+func openRepoUsers(repo string) (*auth.Store, error) {
+	owner, name, err := repos.Split(repo)
+	if err != nil {
+		return nil, err
+	}
+	err = loadConfigQuietly()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(repos.Path(config.Current.Fuse.GitRepoDir, owner, name)); err != nil {
+		return nil, fmt.Errorf("Repository %s/%s is not found", owner, name)
+	}
+	return auth.NewStore(config.Current.Auth.UsersFile)
+}
+
+func publishRepo(args []string) int {
+	if len(args) != 1 {
+		return badUsage("publish")
+	}
+	owner, name, err := repos.Split(args[0])
+	if err != nil {
+		return report(err, "")
+	}
+	logger := loadConfig()
+	if config.Current.Storage.Root == "" {
+		fmt.Fprintln(os.Stderr, "Publishing is disabled since no storage root is configured")
+		return 1
+	}
+	bus := events.NewBus(logger)
+	dispatcher := webhook.NewDispatcher(&config.Current.Webhooks, config.Current.Fuse.GitRepoDir, logger)
+	bus.Subscribe(dispatcher.Handle)
+	defer dispatcher.Close()
+	auditor, err := audit.New(&config.Current.Audit, logger)
+	if err != nil {
+		return report(err, "")
+	}
+	if auditor != nil {
+		bus.Subscribe(auditor.Handle)
+		defer auditor.Close()
+	}
+	publisher, err := publish.New(&config.Current.Storage, &config.Current.Build, config.Current.Fuse.GitRepoDir,
+		bus, logger)
+	if err != nil {
+		return report(err, "")
+	}
+	publisher.Subscribe()
+
+	event, err := publisher.HeadEvent(owner+"/"+name, currentUser())
+	if err != nil {
+		return report(err, "")
+	}
+	result, err := publisher.Publish(event)
+	if err != nil {
+		return report(err, "")
+	}
+	fmt.Printf("Published %s at %s: %d files, %d bytes in %s\n",
+		event.Repo, event.NewSha, result.Files, result.Bytes, result.Duration)
+	return 0
+}
+
+// readKey reads the public key file path, or the standard input if path is -
+func readKey(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// loadConfigQuietly loads the config for commands which don't need the logger
+func loadConfigQuietly() error {
+	err := config.Load()
+	if err != nil {
+		return fmt.Errorf("Failed to load config: %s", err)
+	}
+	return nil
+}
+
+func currentUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return "cli"
+	}
+	return current.Username
+}
+
+// report prints err and returns the exit code of failure, or prints the message of success if any
+func report(err error, format string, args ...interface{}) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if format != "" {
+		fmt.Printf(format+"\n", args...)
+	}
+	return 0
+}
+
+func badUsage(name string) int {
+	for _, command := range commands {
+		if command.name == name {
+			fmt.Fprintf(os.Stderr, "Usage: %s [flags] %s %s\n", os.Args[0], name, command.args)
+		}
+	}
+	return 2
+}
@@ -5,21 +5,136 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
-
-	yaml "gopkg.in/yaml.v2"
 )
 
 type Fuse struct {
 	GitRepoDir string `yaml:"repo_dir"`
 	Debug      bool
+	CacheSize  int `yaml:"cache_size"`
+	// MountPoint is where GitFs is mounted, a temporary directory if not set
+	MountPoint string `yaml:"mount_point"`
 }
 
 type Sshd struct {
+	ListenHost     string        `yaml:"host"`
+	ListenPort     int32         `yaml:"port"`
+	PrivateKey     string        `yaml:"private_key"`
+	PrivateKeyFile string        `yaml:"private_key_file"`
+	HostKeys       []HostKey     `yaml:"host_keys"`
+	CertAuthority  CertAuthority `yaml:"cert_authority"`
+	MaxClient      int32         `yaml:"max_client"`
+	Timeouts       Timeouts
+	Limits         Limits
+	Ban            Ban
+	// Allow and deny are lists of CIDRs, only the source IPs within allow are accepted if it's set, and
+	// those within deny are always rejected
+	Allow []string
+	Deny  []string
+	// ShellPath is deprecated and ignored, the site commands are run in place of a shell
+	ShellPath string `yaml:"shell"`
+}
+
+// HostKey is a private key file of sshd, which is generated of type on the first start if it's missing.
+// A pending key is only advertised to the clients, so that they learn it before it replaces a key of
+// the same type.
+type HostKey struct {
+	File    string
+	Type    string
+	Pending bool
+}
+
+// CertAuthority lists the public keys of the CAs signing the SSH user certificates accepted, in the
+// authorized_keys format, and the file of the keys and certificates revoked.
+type CertAuthority struct {
+	Keys           []string
+	RevocationList string `yaml:"revocation_list"`
+}
+
+// Timeouts of sshd in seconds. Handshake bounds the SSH handshake, idle bounds each read and write of
+// a connection, a keepalive request is sent every keepalive seconds and the connection is closed once
+// keepalive_max of them are unanswered, and the commands are killed after max_session, which is
+// disabled if it's 0.
+type Timeouts struct {
+	Handshake    int
+	Idle         int
+	Keepalive    int
+	KeepaliveMax int `yaml:"keepalive_max"`
+	MaxSession   int `yaml:"max_session"`
+}
+
+// Limit is a token bucket holding up to burst tokens, which is refilled by rate tokens per minute,
+// disabled if rate is 0
+type Limit struct {
+	Rate  int
+	Burst int
+}
+
+// Limits of sshd, on each source IP and each authenticated user, 0 disables each of them
+type Limits struct {
+	Connections     Limit
+	Auth            Limit
+	UserConnections Limit `yaml:"user_connections"`
+	Pushes          Limit
+	// MaxPerIp and MaxPerUser cap the concurrent connections of each source IP and each user
+	MaxPerIp   int32 `yaml:"max_per_ip"`
+	MaxPerUser int32 `yaml:"max_per_user"`
+}
+
+// Ban rejects a source IP for duration seconds once it fails to authenticate max_failures times within
+// window seconds, disabled if max_failures is 0
+type Ban struct {
+	MaxFailures int `yaml:"max_failures"`
+	Window      int
+	Duration    int
+}
+
+// Http serves HTTPS if cert_file and key_file are set, otherwise the tokens of the clients are sent in the
+// clear unless a TLS proxy is in front of it
+type Http struct {
+	ListenHost string `yaml:"host"`
+	ListenPort int32  `yaml:"port"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+}
+
+// Admin is the listener of the operational endpoints such as `/metrics` and of the admin API, disabled if port is 0
+type Admin struct {
 	ListenHost string `yaml:"host"`
 	ListenPort int32  `yaml:"port"`
-	PrivateKey string `yaml:"private_key"`
-	MaxClient  int32  `yaml:"max_client"`
-	ShellPath  string `yaml:"shell"`
+}
+
+type Auth struct {
+	UsersFile string `yaml:"users_file"`
+}
+
+type Hooks struct {
+	MaxRepoSize    int64    `yaml:"max_repo_size"`
+	MaxBlobSize    int64    `yaml:"max_blob_size"`
+	ForbiddenPaths []string `yaml:"forbidden_paths"`
+}
+
+// Storage is where the sites are published. Url is the URL the bucket is served at, such as
+// `https://pages.example.com`, so that the site of `<user>/<repo>` is at `<url>/<user>/<repo>/`.
+type Storage struct {
+	Type   string
+	Root   string
+	Bucket string
+	Url    string
+}
+
+// Build is how the `build` commands of the manifests run: as user, with a clean environment, killed
+// after timeout seconds, and at most workers of them at once. The builds are disabled unless user is
+// set to another one than pages runs as, it defaults to `nobody` if pages runs as root.
+type Build struct {
+	User    string
+	Timeout int
+	Workers int
+}
+
+type Webhooks struct {
+	MaxAttempts int `yaml:"max_attempts"`
+	Timeout     int
+	Workers     int
 }
 
 type Syslog struct {
@@ -29,16 +144,52 @@ type Syslog struct {
 	Tag      string
 }
 
+// Rotation of the local log file, it's rotated once it grows over max_size megabytes or gets older than
+// interval hours, then the rotated files are compressed if compress is set, and removed once more than
+// max_backups of them are kept or older than max_age days. 0 disables each of them.
+type Rotation struct {
+	MaxSize    int `yaml:"max_size"`
+	Interval   int
+	Compress   bool
+	MaxBackups int `yaml:"max_backups"`
+	MaxAge     int `yaml:"max_age"`
+}
+
 type Log struct {
-	Local  string
-	Level  string
-	Syslog Syslog
+	Local    string
+	Level    string
+	Format   string
+	Rotation Rotation
+	Syslog   Syslog
+}
+
+type AuditSyslog struct {
+	Protocol string
+	Host     string
+	Facility string
+	Tag      string
+}
+
+// Audit is where the audit log is appended to, either file or syslog, disabled if neither is set
+type Audit struct {
+	File   string
+	Syslog AuditSyslog
 }
 
 type Environmental struct {
-	Sshd Sshd
-	Fuse Fuse
-	Log  Log
+	Sshd     Sshd
+	Fuse     Fuse
+	Http     Http
+	Admin    Admin
+	Auth     Auth
+	Log      Log
+	Audit    Audit
+	Hooks    Hooks
+	Storage  Storage
+	Build    Build
+	Webhooks Webhooks
+	// ShutdownTimeout is how many seconds running commands are given to finish on shutdown
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
 }
 
 type Config struct {
@@ -47,7 +198,16 @@ type Config struct {
 	Test        Environmental
 }
 
+var DefaultForbiddenPaths = []string{
+	".env", "*.pem", "*.key", "*.p12", "id_rsa", "id_dsa", "id_ecdsa", "id_ed25519",
+}
+
+var Environments = []string{"development", "test", "production"}
+
 var Current *Environmental
+
+// LoadedFile is the path of the config file last loaded
+var LoadedFile string
 var Candidates = []string{
 	os.Getenv("PAGES_CONFIG"),
 	"/etc/pages.yml",
@@ -57,51 +217,197 @@ var Candidates = []string{
 }
 
 func Load() error {
-	config := Config{}
-	env := getEnvironment()
+	current, err := parse()
+	if err != nil {
+		return err
+	}
+	Current = current
+	return nil
+}
+
+func parse() (*Environmental, error) {
+	content, err := loadConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	config, err := decode(content)
+	if err != nil {
+		return nil, err
+	}
+	return prepare(content, config, getEnvironment())
+}
+
+// Check validates every environment of the config file, with the overrides applied, and reports
+// all the problems found at once.
+func Check() error {
 	content, err := loadConfigFile()
 	if err != nil {
 		return err
 	}
-	err = yaml.Unmarshal(content, &config)
+	config, err := decode(content)
 	if err != nil {
 		return err
 	}
+	var errs ValidationErrors
+	for _, env := range Environments {
+		if lineOf(content, env) == 0 {
+			continue
+		}
+		_, err = prepare(content, config, env)
+		if validationErrors, ok := err.(ValidationErrors); ok {
+			errs = append(errs, validationErrors...)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func decode(content []byte) (*Config, error) {
+	config := &Config{}
+	err := unmarshalStrict(content, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// prepare selects the environment env of config, then applies the overrides and the defaults to it
+// before validating it.
+func prepare(content []byte, config *Config, env string) (*Environmental, error) {
+	var current *Environmental
 	switch env {
 	case "development":
-		Current = &config.Development
+		current = &config.Development
 	case "test":
-		Current = &config.Test
+		current = &config.Test
 	case "production":
-		Current = &config.Production
+		current = &config.Production
 	default:
-		return fmt.Errorf("Invalid environment `%v`", env)
+		return nil, fmt.Errorf("Invalid environment `%v`", env)
+	}
+	v := &validator{content: content}
+	applyOverrides(current, v)
+	if current.Sshd.PrivateKeyFile != "" {
+		if current.Sshd.PrivateKey != "" {
+			v.add("only one of private_key and private_key_file may be set", env, "sshd", "private_key_file")
+		} else if key, err := ioutil.ReadFile(current.Sshd.PrivateKeyFile); err != nil {
+			v.add("failed to read private key: "+err.Error(), env, "sshd", "private_key_file")
+		} else {
+			current.Sshd.PrivateKey = string(key)
+		}
 	}
-	if Current.Sshd.ListenPort == 0 {
-		Current.Sshd.ListenPort = 22
+	for i := range current.Sshd.HostKeys {
+		hostKey := &current.Sshd.HostKeys[i]
+		if hostKey.Type == "" {
+			hostKey.Type = "ed25519"
+		}
+		hostKey.Type = strings.ToLower(hostKey.Type)
 	}
-	if Current.Sshd.PrivateKey == "" {
-		return fmt.Errorf("Config Error: private key must be set")
+	if current.Sshd.ListenPort == 0 {
+		current.Sshd.ListenPort = 22
 	}
-	if Current.Sshd.MaxClient == 0 {
-		Current.Sshd.MaxClient = 256
+	if current.Sshd.MaxClient == 0 {
+		current.Sshd.MaxClient = 256
 	}
-	if Current.Sshd.ShellPath == "" {
-		Current.Sshd.ShellPath = "/bin/bash"
+	timeouts := &current.Sshd.Timeouts
+	if timeouts.Handshake == 0 {
+		timeouts.Handshake = 30
 	}
-	if Current.Log.Local == "" {
-		Current.Log.Local = "stderr"
+	if timeouts.Idle == 0 {
+		timeouts.Idle = 600
 	}
-	if Current.Log.Level == "" {
-		Current.Log.Level = "DEBUG"
+	if timeouts.Keepalive == 0 {
+		timeouts.Keepalive = 30
 	}
-	Current.Log.Level = strings.ToUpper(Current.Log.Level)
-	if Current.Log.Syslog.Level == "" {
-		Current.Log.Syslog.Level = "DEBUG"
+	if timeouts.KeepaliveMax == 0 {
+		timeouts.KeepaliveMax = 3
 	}
-	Current.Log.Syslog.Level = strings.ToUpper(Current.Log.Syslog.Level)
-
-	return nil
+	limits := &current.Sshd.Limits
+	for _, limit := range []*Limit{&limits.Connections, &limits.Auth, &limits.UserConnections, &limits.Pushes} {
+		if limit.Rate > 0 && limit.Burst == 0 {
+			limit.Burst = limit.Rate
+		}
+	}
+	if current.Sshd.Ban.Window == 0 {
+		current.Sshd.Ban.Window = 600
+	}
+	if current.Sshd.Ban.Duration == 0 {
+		current.Sshd.Ban.Duration = 3600
+	}
+	if current.Fuse.CacheSize == 0 {
+		current.Fuse.CacheSize = 1024
+	}
+	if current.Auth.UsersFile == "" {
+		current.Auth.UsersFile = current.Fuse.GitRepoDir + "/.users.yml"
+	}
+	if current.Log.Local == "" {
+		current.Log.Local = "stderr"
+	}
+	if current.Log.Level == "" {
+		current.Log.Level = "DEBUG"
+	}
+	current.Log.Level = strings.ToUpper(current.Log.Level)
+	if current.Log.Format == "" {
+		current.Log.Format = "text"
+	}
+	current.Log.Format = strings.ToLower(current.Log.Format)
+	if current.Log.Syslog.Level == "" {
+		current.Log.Syslog.Level = "DEBUG"
+	}
+	current.Log.Syslog.Level = strings.ToUpper(current.Log.Syslog.Level)
+	if current.Audit.Syslog.Facility == "" {
+		current.Audit.Syslog.Facility = "AUTH"
+	}
+	current.Audit.Syslog.Facility = strings.ToUpper(current.Audit.Syslog.Facility)
+	if current.Audit.Syslog.Tag == "" {
+		current.Audit.Syslog.Tag = "pages-audit"
+	}
+	if current.Hooks.MaxRepoSize == 0 {
+		current.Hooks.MaxRepoSize = 1 << 30
+	}
+	if current.Hooks.MaxBlobSize == 0 {
+		current.Hooks.MaxBlobSize = 100 << 20
+	}
+	if current.Hooks.ForbiddenPaths == nil {
+		current.Hooks.ForbiddenPaths = DefaultForbiddenPaths
+	}
+	if current.Storage.Type == "" {
+		current.Storage.Type = "local"
+	}
+	if current.Storage.Bucket == "" {
+		current.Storage.Bucket = "pages"
+	}
+	if current.Build.User == "" && os.Geteuid() == 0 {
+		current.Build.User = "nobody"
+	}
+	if current.Build.Timeout == 0 {
+		current.Build.Timeout = 600
+	}
+	if current.Build.Workers == 0 {
+		current.Build.Workers = 2
+	}
+	if current.Webhooks.MaxAttempts == 0 {
+		current.Webhooks.MaxAttempts = 5
+	}
+	if current.Webhooks.Timeout == 0 {
+		current.Webhooks.Timeout = 10
+	}
+	if current.Webhooks.Workers == 0 {
+		current.Webhooks.Workers = 4
+	}
+	if current.ShutdownTimeout == 0 {
+		current.ShutdownTimeout = 30
+	}
+	current.validate(v, env)
+	err := v.err()
+	if err != nil {
+		return nil, err
+	}
+	return current, nil
 }
 
 func loadConfigFile() ([]byte, error) {
@@ -113,6 +419,7 @@ func loadConfigFile() ([]byte, error) {
 		if err != nil {
 			continue
 		}
+		LoadedFile = candidate
 		return content, nil
 	}
 	return nil, fmt.Errorf("Failed to load config file")
@@ -1,8 +1,15 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
 	"io/ioutil"
 	"os"
+	"os/user"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,22 +22,33 @@ func TestLoadConfig(t *testing.T) {
 		err := os.RemoveAll(dir)
 		assert.Nil(t, err)
 	}()
+	keys := []string{testPrivateKey(t), testPrivateKey(t), testPrivateKey(t)}
 	config := `
 production:
     sshd:
         host: configdb
         port: 22
-        private_key: PRIVATEKEYPRIVATEKEYPRIVATEKEY1
+        shell: /bin/bash
+        private_key: |
+` + indent(keys[0], 12) + `
+    fuse:
+        repo_dir: /var/git
 development:
     sshd:
         host: localhost
         port: 2200
-        private_key: PRIVATEKEYPRIVATEKEYPRIVATEKEY2
+        private_key: |
+` + indent(keys[1], 12) + `
+    fuse:
+        repo_dir: /var/git
 test:
     sshd:
         host: localhost
         port: 2201
-        private_key: PRIVATEKEYPRIVATEKEYPRIVATEKEY3
+        private_key: |
+` + indent(keys[2], 12) + `
+    fuse:
+        repo_dir: /var/git
     `
 	configPath := dir + "/config.yml"
 	ioutil.WriteFile(configPath, []byte(config), 0600)
@@ -41,12 +59,209 @@ test:
 	assert.Nil(t, err)
 	assert.EqualValues(t, Current.Sshd.ListenHost, "configdb")
 	assert.EqualValues(t, Current.Sshd.ListenPort, 22)
-	assert.EqualValues(t, Current.Sshd.PrivateKey, "PRIVATEKEYPRIVATEKEYPRIVATEKEY1")
+	assert.EqualValues(t, Current.Sshd.PrivateKey, keys[0])
+	// Deprecated but still accepted
+	assert.EqualValues(t, Current.Sshd.ShellPath, "/bin/bash")
 
 	os.Setenv("PAGES_ENV", "development")
 	err = Load()
 	assert.Nil(t, err)
 	assert.EqualValues(t, Current.Sshd.ListenHost, "localhost")
 	assert.EqualValues(t, Current.Sshd.ListenPort, 2200)
-	assert.EqualValues(t, Current.Sshd.PrivateKey, "PRIVATEKEYPRIVATEKEYPRIVATEKEY2")
+	assert.EqualValues(t, Current.Sshd.PrivateKey, keys[1])
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configPath := dir + "/config.yml"
+	Candidates = []string{configPath}
+	os.Setenv("PAGES_ENV", "test")
+	defer os.Unsetenv("PAGES_ENV")
+
+	err = ioutil.WriteFile(dir+"/id_rsa", []byte(testPrivateKey(t)), 0600)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(dir+"/revoked_keys", nil, 0600)
+	assert.Nil(t, err)
+	base := "test:\n    fuse:\n        repo_dir: /var/git\n    sshd:\n        private_key_file: " + dir + "/id_rsa\n"
+	err = ioutil.WriteFile(configPath, []byte(base+"        port: 2201\n"), 0600)
+	assert.Nil(t, err)
+	err = Load()
+	assert.Nil(t, err)
+	var notified *Environmental
+	Subscribe(func(current *Environmental) {
+		notified = current
+	})
+
+	err = ioutil.WriteFile(configPath, []byte(base+"        port: 2202\n        max_client: 8\n"+
+		"        limits:\n            pushes:\n                rate: 10\n        ban:\n            max_failures: 5\n"+
+		"        allow:\n            - 10.0.0.0/8\n        deny:\n            - 10.0.0.1/32\n"+
+		"        cert_authority:\n            revocation_list: "+dir+"/revoked_keys\n"+
+		"    log:\n        level: warn\n"), 0600)
+	assert.Nil(t, err)
+	needRestart, err := Reload()
+	assert.Nil(t, err)
+	assert.EqualValues(t, needRestart, []string{"sshd.port"})
+	assert.True(t, notified == Current)
+	assert.EqualValues(t, Current.Sshd.MaxClient, 8)
+	assert.EqualValues(t, Current.Log.Level, "WARN")
+	assert.EqualValues(t, Current.Sshd.Limits.Pushes.Rate, 10)
+	assert.EqualValues(t, Current.Sshd.Ban.MaxFailures, 5)
+	assert.EqualValues(t, Current.Sshd.CertAuthority.RevocationList, dir+"/revoked_keys")
+
+	err = ioutil.WriteFile(configPath, []byte("test:\n    sshd:\n        port: 2202\n"), 0600)
+	assert.Nil(t, err)
+	_, err = Reload()
+	assert.NotNil(t, err)
+	assert.EqualValues(t, Current.Sshd.MaxClient, 8)
+}
+
+func TestOverrideConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configPath := dir + "/config.yml"
+	Candidates = []string{configPath}
+	os.Setenv("PAGES_ENV", "test")
+	defer os.Unsetenv("PAGES_ENV")
+	err = ioutil.WriteFile(configPath, []byte("test:\n    sshd:\n        port: 2201\n        private_key_file: "+
+		dir+"/id_rsa\n    fuse:\n        repo_dir: /var/git\n    log:\n        level: info\n"), 0600)
+	assert.Nil(t, err)
+	key := testPrivateKey(t)
+	err = ioutil.WriteFile(dir+"/id_rsa", []byte(key), 0600)
+	assert.Nil(t, err)
+
+	flags := flag.NewFlagSet("pages", flag.ContinueOnError)
+	RegisterFlags(flags)
+	err = flags.Parse([]string{"-sshd.port", "2203", "-fuse.debug"})
+	assert.Nil(t, err)
+	defer func() {
+		flagOverrides = map[string]string{}
+	}()
+	os.Setenv("PAGES_SSHD_PORT", "2202")
+	os.Setenv("PAGES_LOG_SYSLOG_HOST", "syslog:514")
+	defer os.Unsetenv("PAGES_SSHD_PORT")
+	defer os.Unsetenv("PAGES_LOG_SYSLOG_HOST")
+
+	err = Load()
+	assert.Nil(t, err)
+	assert.EqualValues(t, Current.Sshd.ListenPort, 2203)
+	assert.EqualValues(t, Current.Sshd.PrivateKey, key)
+	assert.True(t, Current.Fuse.Debug)
+	assert.EqualValues(t, Current.Log.Level, "INFO")
+	assert.EqualValues(t, Current.Log.Syslog.Host, "syslog:514")
+
+	os.Setenv("PAGES_SSHD_MAX_CLIENT", "many")
+	defer os.Unsetenv("PAGES_SSHD_MAX_CLIENT")
+	err = Load()
+	assert.EqualValues(t, err.Error(), "sshd.max_client: invalid $PAGES_SSHD_MAX_CLIENT `many`: expected an integer")
+	os.Unsetenv("PAGES_SSHD_MAX_CLIENT")
+
+	os.Setenv("PAGES_SSHD_PRIVATE_KEY", "INLINE")
+	defer os.Unsetenv("PAGES_SSHD_PRIVATE_KEY")
+	err = Load()
+	assert.NotNil(t, err)
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configPath := dir + "/config.yml"
+	Candidates = []string{configPath}
+	config := `
+production:
+    sshd:
+        port: 70000
+        private_key: NOTAKEY
+        max_client: -1
+    log:
+        level: verbose
+test:
+    sshd:
+        private_key: |
+` + indent(testPrivateKey(t), 12) + `
+    fuse:
+        repo_dir: /var/git
+    storage:
+        type: s3
+`
+	err = ioutil.WriteFile(configPath, []byte(config), 0600)
+	assert.Nil(t, err)
+
+	err = Check()
+	assert.NotNil(t, err)
+	errs, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.EqualValues(t, len(errs), 6)
+	assert.EqualValues(t, errs[0].Error(), "line 18: test.storage.type: invalid value `s3`, expected one of local")
+	assert.EqualValues(t, errs[1].Error(), "line 4: production.sshd.port: must be between 1 and 65535")
+	assert.EqualValues(t, errs[2].Line, 5)
+	assert.Contains(t, errs[2].Message, "invalid private key")
+	assert.EqualValues(t, errs[3].Error(), "line 6: production.sshd.max_client: must be positive")
+	assert.EqualValues(t, errs[4].Error(), "line 2: production.fuse.repo_dir: must be set")
+	assert.EqualValues(t, errs[5].Error(), "line 8: production.log.level: invalid value `VERBOSE`, "+
+		"expected one of PANIC, FATAL, ERROR, WARN, INFO, DEBUG")
+
+	err = ioutil.WriteFile(configPath, []byte("test:\n    sshd:\n        prot: 22\n"), 0600)
+	assert.Nil(t, err)
+	err = Check()
+	assert.EqualValues(t, err.Error(), "line 3: field prot not found in type config.Sshd")
+
+	current, err := user.Current()
+	assert.Nil(t, err)
+	config = `
+test:
+    sshd:
+        private_key: |
+` + indent(testPrivateKey(t), 12) + `
+        host_keys:
+            - file: /nonexistent/ssh_host_dsa_key
+              type: dsa
+        limits:
+            pushes:
+                rate: -1
+        deny:
+            - 10.0.0.0/8
+            - 10.0.0.1
+    fuse:
+        repo_dir: /var/git
+    storage:
+        url: pages.example.com
+    http:
+        cert_file: /etc/pages/cert.pem
+    build:
+        user: ` + current.Username + `
+`
+	err = ioutil.WriteFile(configPath, []byte(config), 0600)
+	assert.Nil(t, err)
+	err = Check()
+	errs, ok = err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.EqualValues(t, len(errs), 6)
+	assert.EqualValues(t, errs[0].Error(), "line 8: test.sshd.host_keys: invalid type `dsa` of host key "+
+		"/nonexistent/ssh_host_dsa_key, expected one of ed25519, ecdsa, rsa")
+	assert.EqualValues(t, errs[1].Error(), "line 13: test.sshd.limits.pushes.rate: must not be negative")
+	assert.EqualValues(t, errs[2].Error(), "line 14: test.sshd.deny: invalid CIDR `10.0.0.1`")
+	assert.EqualValues(t, errs[3].Error(), "line 22: test.http.cert_file: cert_file and key_file must be set together")
+	assert.EqualValues(t, errs[4].Error(), "line 20: test.storage.url: invalid URL `pages.example.com`, "+
+		"expected an http or https URL")
+	assert.EqualValues(t, errs[5].Error(), "line 24: test.build.user: must not be the user pages runs as")
+}
+
+func testPrivateKey(t *testing.T) string {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.Nil(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func indent(text string, spaces int) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Repeat(" ", spaces) + line
+	}
+	return strings.Join(lines, "\n")
 }
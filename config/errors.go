@@ -0,0 +1,123 @@
+package config
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type FieldError struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+func (err *FieldError) Error() string {
+	message := err.Message
+	if err.Path != "" {
+		message = err.Path + ": " + message
+	}
+	if err.Line > 0 {
+		message = "line " + strconv.Itoa(err.Line) + ": " + message
+	}
+	return message
+}
+
+type ValidationErrors []*FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// validator collects every problem of a YAML document instead of stopping at the first one,
+// it locates the line of each field so that the errors point back into the original text.
+type validator struct {
+	content []byte
+	errors  ValidationErrors
+}
+
+func (v *validator) add(message string, path ...string) {
+	v.errors = append(v.errors, &FieldError{
+		Path:    strings.Join(path, "."),
+		Line:    lineOf(v.content, path...),
+		Message: message,
+	})
+}
+
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return v.errors
+}
+
+var yamlLineError = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// unmarshalStrict decodes content into out, rejecting unknown fields, and converts
+// the errors of yaml.v2 into ValidationErrors.
+func unmarshalStrict(content []byte, out interface{}) error {
+	err := yaml.UnmarshalStrict(content, out)
+	if err == nil {
+		return nil
+	}
+	var messages []string
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		messages = typeError.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+	errs := make(ValidationErrors, 0, len(messages))
+	for _, message := range messages {
+		fieldError := &FieldError{Message: strings.TrimPrefix(message, "yaml: ")}
+		if matches := yamlLineError.FindStringSubmatch(message); matches != nil {
+			fieldError.Line, _ = strconv.Atoi(matches[1])
+			fieldError.Message = matches[2]
+		}
+		errs = append(errs, fieldError)
+	}
+	return errs
+}
+
+// lineOf returns the 1-based line of the deepest key of path found in a block-style YAML document,
+// or 0 if even the first key cannot be found.
+func lineOf(content []byte, path ...string) int {
+	if len(path) == 0 {
+		return 0
+	}
+	found, depth := 0, 0
+	parentIndent, childIndent := -1, -1
+	for i, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		if indent <= parentIndent {
+			// Left the subtree of the deepest matched key, the rest of path is not there
+			break
+		}
+		if childIndent < 0 {
+			childIndent = indent
+		}
+		colon := strings.Index(trimmed, ":")
+		if indent != childIndent || colon < 0 {
+			continue
+		}
+		key := strings.Trim(strings.TrimSpace(trimmed[:colon]), `"'`)
+		if strings.EqualFold(key, path[depth]) {
+			found = i + 1
+			depth++
+			if depth == len(path) {
+				break
+			}
+			parentIndent, childIndent = indent, -1
+		}
+	}
+	return found
+}
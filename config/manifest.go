@@ -0,0 +1,147 @@
+package config
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const ManifestFile = ".pages.yml"
+
+// Manifest is the per-repository `.pages.yml`, read from the root of the pushed tree.
+type Manifest struct {
+	// Branch is the branch to publish, the manifest of any other branch is validated but not published.
+	// Defaults to `master`.
+	Branch string `yaml:"branch"`
+	// Source is the subdirectory of the tree (or of the build output) to publish. Defaults to the root.
+	Source string `yaml:"source"`
+	// Build is a command run from the root of the checked out tree before publishing, optional.
+	Build string `yaml:"build"`
+	// Ignore lists glob patterns of files not to publish. A pattern without `/` matches the file name
+	// in any directory, otherwise it matches the path relative to Source.
+	Ignore []string `yaml:"ignore"`
+	// Headers maps a glob pattern of paths relative to Source to the HTTP headers served with them.
+	Headers map[string]map[string]string `yaml:"headers"`
+	// Fallback is the page served for paths matching no file, e.g. `index.html` for single-page apps.
+	Fallback string          `yaml:"fallback"`
+	Storage  ManifestStorage `yaml:"storage"`
+}
+
+// ManifestStorage selects where the published files are uploaded to.
+type ManifestStorage struct {
+	// Bucket is the storage bucket, defaults to the bucket configured on the server.
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to the key of every uploaded file.
+	Prefix string `yaml:"prefix"`
+}
+
+var (
+	headerNamePattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+	bucketPattern     = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{2,62}$`)
+	invalidRefPattern = regexp.MustCompile(`(^[-/.]|/[./]|\.\.|@\{|[\x00-\x20\x7f~^:?*\[\\]|\.lock$|[/.]$)`)
+)
+
+// ParseManifest parses and validates the content of `.pages.yml`, the returned error is a
+// ValidationErrors listing every problem with its line number.
+func ParseManifest(content []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+	err := unmarshalStrict(content, manifest)
+	if err != nil {
+		return nil, err
+	}
+	v := &validator{content: content}
+	manifest.validate(v)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if manifest.Branch == "" {
+		manifest.Branch = "master"
+	}
+	manifest.Source = strings.Trim(path.Clean("/"+manifest.Source), "/")
+	return manifest, nil
+}
+
+// PublishesRef tells if a push to ref should publish the site described by manifest.
+func (manifest *Manifest) PublishesRef(ref string) bool {
+	return ref == "refs/heads/"+manifest.Branch
+}
+
+// IsValidBranch tells if name is acceptable as a branch name by git
+func IsValidBranch(name string) bool {
+	return name != "" && !invalidRefPattern.MatchString(name)
+}
+
+func (manifest *Manifest) validate(v *validator) {
+	if manifest.Branch != "" && !IsValidBranch(manifest.Branch) {
+		v.add("invalid branch name `"+manifest.Branch+"`", "branch")
+	}
+	if !isRelativePath(manifest.Source) {
+		v.add("must be a relative path inside the repository", "source")
+	}
+	if strings.ContainsAny(manifest.Build, "\n\r") {
+		v.add("must be a single line", "build")
+	}
+	for _, pattern := range manifest.Ignore {
+		if !isValidGlob(pattern) {
+			v.add("invalid glob pattern `"+pattern+"`", "ignore")
+		}
+	}
+	patterns := make([]string, 0, len(manifest.Headers))
+	for pattern := range manifest.Headers {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if !isValidGlob(pattern) {
+			v.add("invalid glob pattern", "headers", pattern)
+		}
+		names := make([]string, 0, len(manifest.Headers[pattern]))
+		for name := range manifest.Headers[pattern] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !headerNamePattern.MatchString(name) {
+				v.add("invalid header name", "headers", pattern, name)
+			} else if strings.ContainsAny(manifest.Headers[pattern][name], "\n\r") {
+				v.add("header value must be a single line", "headers", pattern, name)
+			}
+		}
+	}
+	if manifest.Fallback != "" && !isRelativePath(manifest.Fallback) {
+		v.add("must be a relative path inside the published source", "fallback")
+	}
+	if manifest.Storage.Bucket != "" && !bucketPattern.MatchString(manifest.Storage.Bucket) {
+		v.add("invalid bucket name `"+manifest.Storage.Bucket+"`", "storage", "bucket")
+	}
+	if strings.HasPrefix(manifest.Storage.Prefix, "/") || strings.Contains(manifest.Storage.Prefix, "..") {
+		v.add("must not start with `/` nor contain `..`", "storage", "prefix")
+	}
+}
+
+// MatchGlob matches a path relative to the published source against an Ignore or Headers pattern,
+// patterns without `/` match the file name in any directory.
+func MatchGlob(pattern string, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	matched, _ := path.Match(strings.TrimPrefix(pattern, "/"), strings.TrimPrefix(name, "/"))
+	return matched
+}
+
+func isRelativePath(p string) bool {
+	if strings.HasPrefix(p, "/") {
+		return false
+	}
+	cleaned := path.Clean(p)
+	return cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
+
+func isValidGlob(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseManifest(t *testing.T) {
+	manifest, err := ParseManifest([]byte(`
+branch: gh-pages
+source: ./dist/
+build: npm run build
+ignore:
+    - "*.map"
+    - node_modules/*
+headers:
+    "*.html":
+        Cache-Control: no-cache
+fallback: index.html
+storage:
+    bucket: my-site
+    prefix: www/
+`))
+	assert.Nil(t, err)
+	assert.EqualValues(t, manifest.Branch, "gh-pages")
+	assert.EqualValues(t, manifest.Source, "dist")
+	assert.EqualValues(t, manifest.Build, "npm run build")
+	assert.EqualValues(t, manifest.Ignore, []string{"*.map", "node_modules/*"})
+	assert.EqualValues(t, manifest.Headers["*.html"]["Cache-Control"], "no-cache")
+	assert.EqualValues(t, manifest.Fallback, "index.html")
+	assert.EqualValues(t, manifest.Storage.Bucket, "my-site")
+	assert.True(t, manifest.PublishesRef("refs/heads/gh-pages"))
+	assert.False(t, manifest.PublishesRef("refs/heads/master"))
+
+	manifest, err = ParseManifest([]byte("# empty manifest\n"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, manifest.Branch, "master")
+	assert.EqualValues(t, manifest.Source, "")
+}
+
+func TestParseInvalidManifest(t *testing.T) {
+	_, err := ParseManifest([]byte(`
+branch: master
+sources: dist
+`))
+	errs, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.EqualValues(t, len(errs), 1)
+	assert.EqualValues(t, errs[0].Line, 3)
+
+	_, err = ParseManifest([]byte(`
+branch: "bad..branch"
+source: ../outside
+ignore:
+    - "[a-"
+headers:
+    "*.html":
+        "Bad Header": value
+storage:
+    bucket: My_Bucket
+`))
+	errs, ok = err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.EqualValues(t, len(errs), 5)
+	assert.EqualValues(t, errs[0].Line, 2)
+	assert.EqualValues(t, errs[0].Path, "branch")
+	assert.EqualValues(t, errs[1].Line, 3)
+	assert.EqualValues(t, errs[2].Line, 4)
+	assert.EqualValues(t, errs[3].Line, 8)
+	assert.EqualValues(t, errs[3].Path, "headers.*.html.Bad Header")
+	assert.EqualValues(t, errs[4].Line, 10)
+	assert.Contains(t, err.Error(), "line 10: storage.bucket: invalid bucket name `My_Bucket`")
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Overridable lists the sections whose settings may be overridden by environment variables and flags
+var Overridable = []string{"sshd", "fuse", "log"}
+
+var (
+	flagsMutex    sync.Mutex
+	flagOverrides = map[string]string{}
+)
+
+type setting struct {
+	path  string
+	value reflect.Value
+}
+
+// RegisterFlags defines a flag on flags for every overridable setting, named by its path in the
+// config file, such as `-sshd.port`. The precedence is, from the highest:
+//
+//	flags, e.g. `-sshd.port 2200`
+//	environment variables, e.g. `PAGES_SSHD_PORT=2200`
+//	the config file
+//	defaults
+func RegisterFlags(flags *flag.FlagSet) {
+	for _, setting := range overridableSettings(&Environmental{}) {
+		value := &flagValue{path: setting.path, isBool: setting.value.Kind() == reflect.Bool}
+		flags.Var(value, setting.path, fmt.Sprintf("overrides %s of the config file, same as $%s",
+			setting.path, EnvName(setting.path)))
+	}
+}
+
+// EnvName returns the name of the environment variable overriding the setting at path
+func EnvName(path string) string {
+	return "PAGES_" + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+type flagValue struct {
+	path   string
+	isBool bool
+}
+
+func (value *flagValue) String() string {
+	if value == nil {
+		return ""
+	}
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	return flagOverrides[value.path]
+}
+
+func (value *flagValue) Set(text string) error {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	flagOverrides[value.path] = text
+	return nil
+}
+
+func (value *flagValue) IsBoolFlag() bool {
+	return value.isBool
+}
+
+// applyOverrides sets the settings of current given by environment variables, then those given by flags.
+func applyOverrides(current *Environmental, v *validator) {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	for _, setting := range overridableSettings(current) {
+		if text, ok := os.LookupEnv(EnvName(setting.path)); ok {
+			err := setValue(setting.value, text)
+			if err != nil {
+				v.errors = append(v.errors, &FieldError{Path: setting.path,
+					Message: fmt.Sprintf("invalid $%s `%s`: %s", EnvName(setting.path), text, err)})
+			}
+		}
+		if text, ok := flagOverrides[setting.path]; ok {
+			err := setValue(setting.value, text)
+			if err != nil {
+				v.errors = append(v.errors, &FieldError{Path: setting.path,
+					Message: fmt.Sprintf("invalid -%s `%s`: %s", setting.path, text, err)})
+			}
+		}
+	}
+}
+
+func overridableSettings(current *Environmental) []setting {
+	var settings []setting
+	value := reflect.ValueOf(current).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := yamlName(value.Type().Field(i))
+		for _, overridable := range Overridable {
+			if name == overridable {
+				settings = append(settings, settingsOf(value.Field(i), name+".")...)
+			}
+		}
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].path < settings[j].path })
+	return settings
+}
+
+func settingsOf(value reflect.Value, prefix string) []setting {
+	var settings []setting
+	for i := 0; i < value.NumField(); i++ {
+		path := prefix + yamlName(value.Type().Field(i))
+		switch value.Field(i).Kind() {
+		case reflect.Struct:
+			settings = append(settings, settingsOf(value.Field(i), path+".")...)
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64:
+			settings = append(settings, setting{path: path, value: value.Field(i)})
+		}
+	}
+	return settings
+}
+
+func setValue(value reflect.Value, text string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(text)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("expected a boolean")
+		}
+		value.SetBool(parsed)
+	default:
+		parsed, err := strconv.ParseInt(text, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		value.SetInt(parsed)
+	}
+	return nil
+}
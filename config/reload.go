@@ -0,0 +1,87 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A Listener is notified of the new configuration each time it is reloaded
+type Listener func(current *Environmental)
+
+var (
+	listenersMutex sync.Mutex
+	listeners      []Listener
+)
+
+// Live lists the settings applied without restarting, any other change is only reported by Reload.
+var Live = []string{"log", "sshd.max_client", "sshd.limits", "sshd.ban", "sshd.allow", "sshd.deny",
+	"sshd.cert_authority", "fuse.cache_size", "storage"}
+
+// Subscribe makes listener notified of every reloaded configuration, subsystems subscribe rather than
+// holding pointers into Current, which is replaced on reload.
+func Subscribe(listener Listener) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	listeners = append(listeners, listener)
+}
+
+// Reload loads the config file again and notifies the listeners if it is valid, otherwise Current is
+// kept. It returns the changed settings which only take effect after restarting.
+func Reload() ([]string, error) {
+	current, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	previous := Current
+	Current = current
+
+	listenersMutex.Lock()
+	notified := append([]Listener{}, listeners...)
+	listenersMutex.Unlock()
+	for _, listener := range notified {
+		listener(current)
+	}
+
+	var needRestart []string
+	if previous != nil {
+		for _, setting := range diff(reflect.ValueOf(*previous), reflect.ValueOf(*current), "") {
+			if !isLive(setting) {
+				needRestart = append(needRestart, setting)
+			}
+		}
+	}
+	return needRestart, nil
+}
+
+func isLive(setting string) bool {
+	for _, live := range Live {
+		if setting == live || strings.HasPrefix(setting, live+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// diff returns the yaml paths of the settings different between two values of the same struct type
+func diff(previous reflect.Value, current reflect.Value, prefix string) []string {
+	var changed []string
+	for i := 0; i < previous.NumField(); i++ {
+		field := previous.Type().Field(i)
+		name := prefix + yamlName(field)
+		if field.Type.Kind() == reflect.Struct {
+			changed = append(changed, diff(previous.Field(i), current.Field(i), name+".")...)
+		} else if !reflect.DeepEqual(previous.Field(i).Interface(), current.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func yamlName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	LogLevels       = []string{"PANIC", "FATAL", "ERROR", "WARN", "INFO", "DEBUG"}
+	LogFormats      = []string{"text", "json"}
+	SyslogLevels    = []string{"DEBUG", "INFO", "NOTICE", "WARNING", "ERR", "CRIT", "ALERT", "EMERG"}
+	SyslogProtocols = []string{"tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixgram"}
+	StorageTypes    = []string{"local"}
+	// HostKeyTypes are the types of the host keys generated, and their types in SSH
+	HostKeyTypes = map[string]string{
+		"ed25519": ssh.KeyAlgoED25519,
+		"ecdsa":   ssh.KeyAlgoECDSA256,
+		"rsa":     ssh.KeyAlgoRSA,
+	}
+	AuditFacilities = []string{"AUTH", "AUTHPRIV", "DAEMON", "USER",
+		"LOCAL0", "LOCAL1", "LOCAL2", "LOCAL3", "LOCAL4", "LOCAL5", "LOCAL6", "LOCAL7"}
+)
+
+// validate adds every problem of current, the environment env of the config file, into v.
+func (current *Environmental) validate(v *validator, env string) {
+	sshd := current.Sshd
+	checkPort(v, sshd.ListenPort, false, env, "sshd", "port")
+	// Only one active host key of each type can be used in the handshakes
+	activeTypes := map[string]bool{}
+	if sshd.PrivateKey != "" {
+		if signer, err := ssh.ParsePrivateKey([]byte(sshd.PrivateKey)); err != nil {
+			field := "private_key"
+			if sshd.PrivateKeyFile != "" {
+				field = "private_key_file"
+			}
+			v.add("invalid private key: "+err.Error(), env, "sshd", field)
+		} else {
+			activeTypes[signer.PublicKey().Type()] = true
+		}
+	} else if len(sshd.HostKeys) == 0 {
+		v.add("host keys must be set by host_keys, private_key or private_key_file", env, "sshd")
+	}
+	for _, hostKey := range sshd.HostKeys {
+		keyType := HostKeyTypes[hostKey.Type]
+		if hostKey.File == "" {
+			v.add("file of host key must be set", env, "sshd", "host_keys")
+			continue
+		} else if keyType == "" {
+			v.add("invalid type `"+hostKey.Type+"` of host key "+hostKey.File+", expected one of ed25519, ecdsa, rsa",
+				env, "sshd", "host_keys")
+			continue
+		}
+		// The missing keys are generated on start, the existing ones must be valid
+		if content, err := ioutil.ReadFile(hostKey.File); err == nil {
+			signer, err := ssh.ParsePrivateKey(content)
+			if err != nil {
+				v.add("invalid host key "+hostKey.File+": "+err.Error(), env, "sshd", "host_keys")
+				continue
+			}
+			keyType = signer.PublicKey().Type()
+		} else if !os.IsNotExist(err) {
+			v.add("failed to read host key: "+err.Error(), env, "sshd", "host_keys")
+			continue
+		}
+		if hostKey.Pending {
+			continue
+		} else if activeTypes[keyType] {
+			v.add("more than one active host key of type "+keyType+", the others should be pending",
+				env, "sshd", "host_keys")
+		}
+		activeTypes[keyType] = true
+	}
+	if len(activeTypes) == 0 && len(sshd.HostKeys) > 0 {
+		v.add("at least one host key must not be pending", env, "sshd", "host_keys")
+	}
+	checkPositive(v, int64(sshd.MaxClient), env, "sshd", "max_client")
+	for _, line := range sshd.CertAuthority.Keys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+			v.add("invalid CA key: "+err.Error(), env, "sshd", "cert_authority", "keys")
+		}
+	}
+	if sshd.CertAuthority.RevocationList != "" {
+		if _, err := os.Stat(sshd.CertAuthority.RevocationList); err != nil {
+			v.add("failed to read revocation list: "+err.Error(), env, "sshd", "cert_authority", "revocation_list")
+		}
+	}
+	checkPositive(v, int64(sshd.Timeouts.Handshake), env, "sshd", "timeouts", "handshake")
+	checkPositive(v, int64(sshd.Timeouts.Idle), env, "sshd", "timeouts", "idle")
+	checkPositive(v, int64(sshd.Timeouts.Keepalive), env, "sshd", "timeouts", "keepalive")
+	checkPositive(v, int64(sshd.Timeouts.KeepaliveMax), env, "sshd", "timeouts", "keepalive_max")
+	checkNotNegative(v, int64(sshd.Timeouts.MaxSession), env, "sshd", "timeouts", "max_session")
+	checkLimit(v, sshd.Limits.Connections, env, "sshd", "limits", "connections")
+	checkLimit(v, sshd.Limits.Auth, env, "sshd", "limits", "auth")
+	checkLimit(v, sshd.Limits.UserConnections, env, "sshd", "limits", "user_connections")
+	checkLimit(v, sshd.Limits.Pushes, env, "sshd", "limits", "pushes")
+	checkNotNegative(v, int64(sshd.Limits.MaxPerIp), env, "sshd", "limits", "max_per_ip")
+	checkNotNegative(v, int64(sshd.Limits.MaxPerUser), env, "sshd", "limits", "max_per_user")
+	checkNotNegative(v, int64(sshd.Ban.MaxFailures), env, "sshd", "ban", "max_failures")
+	checkPositive(v, int64(sshd.Ban.Window), env, "sshd", "ban", "window")
+	checkPositive(v, int64(sshd.Ban.Duration), env, "sshd", "ban", "duration")
+	for _, cidr := range sshd.Allow {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			v.add("invalid CIDR `"+cidr+"`", env, "sshd", "allow")
+		}
+	}
+	for _, cidr := range sshd.Deny {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			v.add("invalid CIDR `"+cidr+"`", env, "sshd", "deny")
+		}
+	}
+
+	if current.Fuse.GitRepoDir == "" {
+		v.add("must be set", env, "fuse", "repo_dir")
+	}
+	checkPositive(v, int64(current.Fuse.CacheSize), env, "fuse", "cache_size")
+
+	checkPort(v, current.Http.ListenPort, true, env, "http", "port")
+	if (current.Http.CertFile == "") != (current.Http.KeyFile == "") {
+		v.add("cert_file and key_file must be set together", env, "http", "cert_file")
+	} else if current.Http.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(current.Http.CertFile, current.Http.KeyFile); err != nil {
+			v.add("failed to load certificate: "+err.Error(), env, "http", "cert_file")
+		}
+	}
+	checkPort(v, current.Admin.ListenPort, true, env, "admin", "port")
+
+	checkOneOf(v, current.Log.Level, LogLevels, env, "log", "level")
+	checkOneOf(v, current.Log.Format, LogFormats, env, "log", "format")
+	rotation := current.Log.Rotation
+	checkNotNegative(v, int64(rotation.MaxSize), env, "log", "rotation", "max_size")
+	checkNotNegative(v, int64(rotation.Interval), env, "log", "rotation", "interval")
+	checkNotNegative(v, int64(rotation.MaxBackups), env, "log", "rotation", "max_backups")
+	checkNotNegative(v, int64(rotation.MaxAge), env, "log", "rotation", "max_age")
+	if current.Log.Syslog.Protocol != "" {
+		checkOneOf(v, current.Log.Syslog.Protocol, SyslogProtocols, env, "log", "syslog", "protocol")
+		checkOneOf(v, current.Log.Syslog.Level, SyslogLevels, env, "log", "syslog", "level")
+	}
+
+	if current.Audit.Syslog.Protocol != "" {
+		if current.Audit.File != "" {
+			v.add("only one of file and syslog may be set", env, "audit", "syslog")
+		}
+		checkOneOf(v, current.Audit.Syslog.Protocol, SyslogProtocols, env, "audit", "syslog", "protocol")
+		checkOneOf(v, current.Audit.Syslog.Facility, AuditFacilities, env, "audit", "syslog", "facility")
+	}
+
+	checkPositive(v, current.Hooks.MaxRepoSize, env, "hooks", "max_repo_size")
+	checkPositive(v, current.Hooks.MaxBlobSize, env, "hooks", "max_blob_size")
+	for _, pattern := range current.Hooks.ForbiddenPaths {
+		if !isValidGlob(pattern) {
+			v.add("invalid glob pattern `"+pattern+"`", env, "hooks", "forbidden_paths")
+		}
+	}
+
+	checkOneOf(v, current.Storage.Type, StorageTypes, env, "storage", "type")
+	if !bucketPattern.MatchString(current.Storage.Bucket) {
+		v.add("invalid bucket name `"+current.Storage.Bucket+"`", env, "storage", "bucket")
+	}
+	if current.Storage.Url != "" {
+		parsed, err := url.Parse(current.Storage.Url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			v.add("invalid URL `"+current.Storage.Url+"`, expected an http or https URL", env, "storage", "url")
+		}
+	}
+
+	if current.Build.User != "" {
+		if found, err := user.Lookup(current.Build.User); err != nil {
+			v.add("unknown user `"+current.Build.User+"`", env, "build", "user")
+		} else if found.Uid == strconv.Itoa(os.Geteuid()) {
+			v.add("must not be the user pages runs as", env, "build", "user")
+		}
+	}
+	checkPositive(v, int64(current.Build.Timeout), env, "build", "timeout")
+	checkPositive(v, int64(current.Build.Workers), env, "build", "workers")
+
+	checkPositive(v, int64(current.Webhooks.MaxAttempts), env, "webhooks", "max_attempts")
+	checkPositive(v, int64(current.Webhooks.Timeout), env, "webhooks", "timeout")
+	checkPositive(v, int64(current.Webhooks.Workers), env, "webhooks", "workers")
+	checkPositive(v, int64(current.ShutdownTimeout), env, "shutdown_timeout")
+}
+
+func checkPort(v *validator, port int32, optional bool, path ...string) {
+	min := int32(1)
+	if optional {
+		min = 0
+	}
+	if port < min || port > 65535 {
+		v.add("must be between "+strconv.Itoa(int(min))+" and 65535", path...)
+	}
+}
+
+func checkPositive(v *validator, value int64, path ...string) {
+	if value <= 0 {
+		v.add("must be positive", path...)
+	}
+}
+
+func checkNotNegative(v *validator, value int64, path ...string) {
+	if value < 0 {
+		v.add("must not be negative", path...)
+	}
+}
+
+func checkLimit(v *validator, limit Limit, path ...string) {
+	checkNotNegative(v, int64(limit.Rate), append(path, "rate")...)
+	checkNotNegative(v, int64(limit.Burst), append(path, "burst")...)
+}
+
+func checkOneOf(v *validator, value string, candidates []string, path ...string) {
+	for _, candidate := range candidates {
+		if value == candidate {
+			return
+		}
+	}
+	v.add("invalid value `"+value+"`, expected one of "+strings.Join(candidates, ", "), path...)
+}
@@ -0,0 +1,94 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/bachue/pages/log_driver"
+)
+
+const (
+	Push             = "push"
+	PublishStarted   = "publish.started"
+	PublishSucceeded = "publish.succeeded"
+	PublishFailed    = "publish.failed"
+)
+
+var Types = []string{Push, PublishStarted, PublishSucceeded, PublishFailed}
+
+type Event struct {
+	Id     string    `json:"id"`
+	Type   string    `json:"type"`
+	Repo   string    `json:"repo"`
+	Ref    string    `json:"ref"`
+	OldSha string    `json:"old_sha"`
+	NewSha string    `json:"new_sha"`
+	Pusher string    `json:"pusher"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error,omitempty"`
+	// Parent is the id of the push event this one is derived from
+	Parent string `json:"parent,omitempty"`
+}
+
+// Derive returns a new event of type eventType about the same push as event
+func (event *Event) Derive(eventType string) *Event {
+	parent := event.Parent
+	if parent == "" {
+		parent = event.Id
+	}
+	return &Event{Type: eventType, Repo: event.Repo, Ref: event.Ref,
+		OldSha: event.OldSha, NewSha: event.NewSha, Pusher: event.Pusher, Parent: parent}
+}
+
+type Handler func(event *Event)
+
+// Bus delivers every emitted event to all the subscribed handlers, synchronously and in order,
+// so handlers doing slow work are expected to do it in their own goroutines.
+type Bus struct {
+	mutex    sync.RWMutex
+	handlers []Handler
+	logger   log_driver.Logger
+}
+
+func NewBus(logger log_driver.Logger) *Bus {
+	return &Bus{logger: logger}
+}
+
+func (bus *Bus) Subscribe(handler Handler) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.handlers = append(bus.handlers, handler)
+}
+
+func (bus *Bus) Emit(event *Event) {
+	if event.Id == "" {
+		event.Id = NewId()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.logger.Debugf("Emit event %s (%s) of %s %s %s..%s", event.Type, event.Id, event.Repo, event.Ref, event.OldSha, event.NewSha)
+	bus.mutex.RLock()
+	handlers := bus.handlers
+	bus.mutex.RUnlock()
+	for _, handler := range handlers {
+		bus.dispatch(handler, event)
+	}
+}
+
+func (bus *Bus) dispatch(handler Handler, event *Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			bus.logger.Errorf("Event handler panics on %s (%s): %s", event.Type, event.Id, r)
+		}
+	}()
+	handler(event)
+}
+
+func NewId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,103 @@
+package gitfuse
+
+import (
+	"io"
+	"os/exec"
+	"sync"
+)
+
+// blobWindow is how many bytes a blobReader keeps behind the latest read, since SFTP serves the reads of
+// a file concurrently and they come out of order a little
+const blobWindow = 1024 * 1024
+
+// blobReader streams a blob from `git cat-file`, a read before the window starts it over
+type blobReader struct {
+	mutex    sync.Mutex
+	repoPath string
+	id       string
+	cmd      *exec.Cmd
+	stdout   io.ReadCloser
+	// buffer holds the bytes read from start, until eof
+	buffer []byte
+	start  int64
+	eof    bool
+	chunk  []byte
+}
+
+func newBlobReader(repoPath string, id string) *blobReader {
+	return &blobReader{repoPath: repoPath, id: id, chunk: make([]byte, 32*1024)}
+}
+
+func (reader *blobReader) ReadAt(p []byte, off int64) (int, error) {
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+	if reader.cmd == nil || off < reader.start {
+		if err := reader.restart(); err != nil {
+			return 0, err
+		}
+	}
+	end := off + int64(len(p))
+	for !reader.eof && reader.start+int64(len(reader.buffer)) < end {
+		if err := reader.fill(); err != nil {
+			return 0, err
+		}
+		// Dropping the bytes out of the window, but not those to be read
+		if drop := int64(len(reader.buffer)) - blobWindow; drop > 0 {
+			if drop > off-reader.start {
+				drop = off - reader.start
+			}
+			reader.buffer = reader.buffer[drop:]
+			reader.start += drop
+		}
+	}
+	if off >= reader.start+int64(len(reader.buffer)) {
+		return 0, io.EOF
+	}
+	n := copy(p, reader.buffer[off-reader.start:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (reader *blobReader) fill() error {
+	n, err := reader.stdout.Read(reader.chunk)
+	reader.buffer = append(reader.buffer, reader.chunk[:n]...)
+	if err == io.EOF {
+		reader.eof = true
+		return reader.cmd.Wait()
+	}
+	return err
+}
+
+func (reader *blobReader) restart() error {
+	reader.stop()
+	cmd := exec.Command("git", "--git-dir", reader.repoPath, "cat-file", "blob", reader.id)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	reader.cmd, reader.stdout = cmd, stdout
+	reader.buffer, reader.start, reader.eof = nil, 0, false
+	return nil
+}
+
+// stop kills git unless it has exited
+func (reader *blobReader) stop() {
+	if reader.cmd != nil && !reader.eof {
+		reader.cmd.Process.Kill()
+		reader.cmd.Wait()
+	}
+	reader.cmd = nil
+}
+
+func (reader *blobReader) Close() error {
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+	reader.stop()
+	reader.buffer = nil
+	return nil
+}
@@ -2,15 +2,20 @@ package cache
 
 import (
 	"runtime"
+	"sync"
 
+	"github.com/bachue/pages/metrics"
 	lru "github.com/hashicorp/golang-lru/simplelru"
 	libgit2 "gopkg.in/libgit2/git2go.v23"
 )
 
 type Cleaner func()
 
+// Cache is safe for concurrent use. The entries are reference counted, an entry evicted is cleaned once
+// the last one using it releases it.
 type Cache struct {
-	list *lru.LRU
+	mutex sync.Mutex
+	list  *lru.LRU
 }
 
 type CacheEntry struct {
@@ -19,6 +24,8 @@ type CacheEntry struct {
 	Commit  *libgit2.Commit
 	Tree    *libgit2.Tree
 	OnClean Cleaner
+	refs    int
+	evicted bool
 }
 
 func New(size int) (*Cache, error) {
@@ -30,31 +37,69 @@ func New(size int) (*Cache, error) {
 	return &Cache{list: list}, nil
 }
 
+// Add adds value acquired by the caller, who must release it. The entry of key already added is
+// replaced.
 func (cache *Cache) Add(key string, value *CacheEntry) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	value.refs++
+	cache.list.Remove(key)
 	return cache.list.Add(key, value)
 }
 
+// Get acquires the entry of key, which must be released once it's not used
 func (cache *Cache) Get(key string) (*CacheEntry, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
 	valIface, found := cache.list.Get(key)
 	if found {
+		metrics.CacheHits.Inc()
 		entry, ok := valIface.(*CacheEntry)
+		if ok {
+			entry.refs++
+		}
 		return entry, ok
 	}
+	metrics.CacheMisses.Inc()
 	return nil, false
 }
 
+// Release releases entry acquired by Add or Get, it's cleaned if it's evicted and no longer used
+func (cache *Cache) Release(entry *CacheEntry) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry.refs--
+	if entry.refs == 0 && entry.evicted && entry.OnClean != nil {
+		entry.OnClean()
+	}
+}
+
 func (cache *Cache) Remove(key string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
 	return cache.list.Remove(key)
 }
 
+// Resize changes the capacity of cache, the least recently used entries are evicted if it shrinks
+func (cache *Cache) Resize(size int) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.list.Resize(size)
+}
+
 func (cache *Cache) Purge() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
 	cache.list.Purge()
 }
 
+// clean is called with the mutex of the cache held
 func clean(_ interface{}, value interface{}) {
+	metrics.CacheEvictions.Inc()
 	entry, ok := value.(*CacheEntry)
 	if ok {
-		if entry.OnClean != nil {
+		entry.evicted = true
+		if entry.refs == 0 && entry.OnClean != nil {
 			entry.OnClean()
 		}
 	}
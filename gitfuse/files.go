@@ -0,0 +1,129 @@
+package gitfuse
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	libgit2 "gopkg.in/libgit2/git2go.v23"
+)
+
+// Stat returns the info of name, which is `<user>/<repo>/<path>` the same as the paths under the
+// mount point. A symbolic link is not followed.
+func (gitfs *GitFs) Stat(name string) (os.FileInfo, error) {
+	name = cleanPath(name)
+	attr, status := gitfs.GetAttr(name, nil)
+	if !status.Ok() {
+		return nil, toPathError("stat", name, syscall.Errno(status))
+	}
+	return &fileInfo{name: path.Base("/" + name), attr: attr}, nil
+}
+
+// ReadDir returns the infos of the entries in the directory name, skipping the repositories which
+// can't be read such as the empty ones.
+func (gitfs *GitFs) ReadDir(name string) ([]os.FileInfo, error) {
+	name = cleanPath(name)
+	entries, status := gitfs.OpenDir(name, nil)
+	if !status.Ok() {
+		return nil, toPathError("readdir", name, syscall.Errno(status))
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := gitfs.Stat(path.Join(name, entry.Name))
+		if err != nil {
+			gitfs.logger.Debugf("Skip %s/%s due to %s", name, entry.Name, err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// OpenFile opens the file name to be read, its content is streamed from git rather than loaded at once.
+// It's an io.Closer as well.
+func (gitfs *GitFs) OpenFile(name string) (io.ReaderAt, error) {
+	name = cleanPath(name)
+	user, repo, filePath := splitPath(name)
+	logger := gitfs.opLogger("OpenFile", user, repo, filePath)
+	logger.Debugf("OpenFile")
+	if filePath == "" {
+		return nil, toPathError("open", name, syscall.EISDIR)
+	}
+
+	repoPath := gitfs.GitRepoDir + "/" + user + "/" + repo + ".git"
+	cached, err := gitfs.getMasterTreeFromRepo(repoPath, logger)
+	if err != nil {
+		return nil, toPathError("open", name, syscall.EPERM)
+	}
+	defer gitfs.cache.Release(cached)
+	tree := cached.Tree
+	entry, err := tree.EntryByPath(filePath)
+	if err != nil {
+		logger.Debugf("Cannot find path %s from tree %s of Git Repository %s due to %s", filePath, tree.Id().String(), repoPath, err)
+		return nil, toPathError("open", name, syscall.ENOENT)
+	} else if entry.Type == libgit2.ObjectTree {
+		return nil, toPathError("open", name, syscall.EISDIR)
+	} else if entry.Type != libgit2.ObjectBlob || entry.Filemode == libgit2.FilemodeLink {
+		return nil, toPathError("open", name, syscall.EINVAL)
+	}
+	return newBlobReader(repoPath, entry.Id.String()), nil
+}
+
+// LinkTarget returns the target of the symbolic link name
+func (gitfs *GitFs) LinkTarget(name string) (string, error) {
+	name = cleanPath(name)
+	target, status := gitfs.Readlink(name, nil)
+	if !status.Ok() {
+		return "", toPathError("readlink", name, syscall.Errno(status))
+	}
+	return target, nil
+}
+
+type fileInfo struct {
+	name string
+	attr *fuse.Attr
+}
+
+func (info *fileInfo) Name() string {
+	return info.name
+}
+
+func (info *fileInfo) Size() int64 {
+	return int64(info.attr.Size)
+}
+
+func (info *fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(info.attr.Mode & 0777)
+	switch info.attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	}
+	return mode
+}
+
+func (info *fileInfo) ModTime() time.Time {
+	return time.Unix(int64(info.attr.Mtime), int64(info.attr.Mtimensec))
+}
+
+func (info *fileInfo) IsDir() bool {
+	return info.Mode().IsDir()
+}
+
+func (info *fileInfo) Sys() interface{} {
+	return info.attr
+}
+
+// cleanPath turns name into the relative path FUSE passes, such as `user/repo/path`
+func cleanPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+func toPathError(op string, name string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: "/" + name, Err: errno}
+}
@@ -1,16 +1,19 @@
 package gitfuse
 
 import (
+	"fmt"
 	"hash/crc64"
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	conf "github.com/bachue/pages/config"
 	"github.com/bachue/pages/gitfuse/cache"
 	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/metrics"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
@@ -23,41 +26,102 @@ type GitFs struct {
 	GitFsDir   string
 	server     *fuse.Server
 	logger     log_driver.Logger
+	temporary  bool
 	cache      *cache.Cache
+	mutex      sync.Mutex
+	unmounted  bool
 }
 
 func New(config *conf.Fuse, logger log_driver.Logger) (*GitFs, error) {
-	gitfsDir, err := gitfsDir(logger)
+	gitfs, err := Open(config, logger)
 	if err != nil {
 		return nil, err
 	}
+	err = gitfs.Mount(config, 0)
+	if err != nil {
+		return nil, err
+	}
+	return gitfs, nil
+}
 
-	defaultfs := pathfs.NewDefaultFileSystem()
-	gitfs := &GitFs{FileSystem: pathfs.NewReadonlyFileSystem(defaultfs), GitRepoDir: config.GitRepoDir, GitFsDir: gitfsDir, logger: logger}
+// Mount mounts gitfs at the mount point of config, or a temporary directory if it's not set. If the mount
+// point is mounted already, such as by the process restarting into this one, it's mounted once that is
+// unmounted within wait, or on top of it after that.
+func (gitfs *GitFs) Mount(config *conf.Fuse, wait time.Duration) error {
+	gitfsDir, temporary := config.MountPoint, false
+	if gitfsDir == "" {
+		dir, err := tempGitfsDir(gitfs.logger)
+		if err != nil {
+			return err
+		}
+		gitfsDir, temporary = dir, true
+	} else {
+		gitfs.waitUnmounted(gitfsDir, wait)
+	}
+
+	gitfs.mutex.Lock()
+	defer gitfs.mutex.Unlock()
+	if gitfs.unmounted {
+		if temporary {
+			os.RemoveAll(gitfsDir)
+		}
+		return fmt.Errorf("GitFs is unmounted already")
+	}
 	fs := pathfs.NewPathNodeFs(gitfs, nil)
 	server, _, err := nodefs.MountRoot(gitfsDir, fs.Root(), nil)
 	if err != nil {
-		logger.Errorf("Failed to mount GitFS on %s due to %s", gitfsDir, err)
-		return nil, err
+		gitfs.logger.Errorf("Failed to mount GitFS on %s due to %s", gitfsDir, err)
+		return err
 	}
-	logger.Debugf("Mount GitFs on %s", gitfsDir)
-	gitfs.server = server
+	gitfs.logger.Debugf("Mount GitFs on %s", gitfsDir)
 	server.SetDebug(config.Debug)
+	gitfs.GitFsDir, gitfs.temporary, gitfs.server = gitfsDir, temporary, server
+	return nil
+}
+
+// waitUnmounted waits until dir is no longer a mount point, for wait at most
+func (gitfs *GitFs) waitUnmounted(dir string, wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	for isMountPoint(dir) {
+		if !time.Now().Before(deadline) {
+			gitfs.logger.Warnf("Mounting GitFS on %s which is mounted already", dir)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
 
-	gitfs.cache, err = cache.New(1024)
+// isMountPoint tells if dir is on another device than its parent
+func isMountPoint(dir string) bool {
+	var stat, parent syscall.Stat_t
+	if syscall.Stat(dir, &stat) != nil || syscall.Stat(dir+"/..", &parent) != nil {
+		return false
+	}
+	return stat.Dev != parent.Dev
+}
+
+// Open opens the Git repositories without mounting them, they are read by Stat, ReadDir, ReadFile
+// and LinkTarget then.
+func Open(config *conf.Fuse, logger log_driver.Logger) (*GitFs, error) {
+	objectCache, err := cache.New(config.CacheSize)
 	if err != nil {
 		logger.Errorf("Failed to initialize object cache due to %s\n", err)
 		return nil, err
 	}
-
-	return gitfs, nil
+	defaultfs := pathfs.NewDefaultFileSystem()
+	return &GitFs{FileSystem: pathfs.NewReadonlyFileSystem(defaultfs), GitRepoDir: config.GitRepoDir,
+		logger: logger, cache: objectCache}, nil
 }
 
 func (gitfs *GitFs) Start() {
 	defer gitfs.showPanicError()
 	defer func() {
-		gitfs.logger.Debugf("FUSE stoping ..., removing %s", gitfs.GitFsDir)
-		os.RemoveAll(gitfs.GitFsDir)
+		if gitfs.temporary {
+			gitfs.logger.Debugf("FUSE stoping ..., removing %s", gitfs.GitFsDir)
+			os.RemoveAll(gitfs.GitFsDir)
+		} else {
+			gitfs.logger.Debugf("FUSE stoping ...")
+		}
 	}()
 	gitfs.logger.Infof("Start to serve FUSE")
 	gitfs.server.Serve()
@@ -68,19 +132,50 @@ func (gitfs *GitFs) WaitStart() {
 	gitfs.server.WaitMount()
 }
 
+// Reconfigure applies the settings of config which don't need restarting, i.e. `cache_size`
+func (gitfs *GitFs) Reconfigure(config *conf.Fuse) {
+	evicted := gitfs.cache.Resize(config.CacheSize)
+	gitfs.logger.Infof("Resized object cache to %d, %d entries evicted", config.CacheSize, evicted)
+}
+
+// Ping stats the mount root, it blocks as long as the mount is unresponsive.
+func (gitfs *GitFs) Ping() error {
+	gitfs.mutex.Lock()
+	gitfsDir := gitfs.GitFsDir
+	gitfs.mutex.Unlock()
+	if gitfsDir == "" {
+		return fmt.Errorf("GitFs is not mounted yet")
+	}
+	_, err := os.Stat(gitfsDir)
+	return err
+}
+
+// Unmount unmounts gitfs unless it's unmounted already, it's never mounted again after that
 func (gitfs *GitFs) Unmount() error {
 	defer gitfs.showPanicError()
-	return gitfs.server.Unmount()
+	gitfs.mutex.Lock()
+	defer gitfs.mutex.Unlock()
+	if gitfs.unmounted || gitfs.server == nil {
+		gitfs.unmounted = true
+		return nil
+	}
+	err := gitfs.server.Unmount()
+	if err == nil {
+		gitfs.unmounted = true
+	}
+	return err
 }
 
-func (gitfs *GitFs) OpenDir(name string, _ *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+func (gitfs *GitFs) OpenDir(name string, _ *fuse.Context) (entries []fuse.DirEntry, status fuse.Status) {
 	defer gitfs.showPanicError()
+	defer observe("OpenDir", time.Now(), &status)
 	user, repo, path := splitPath(name)
-	gitfs.logger.Debugf("OpenDir: user = %s, repo = %s, path = %s", user, repo, path)
+	logger := gitfs.opLogger("OpenDir", user, repo, path)
+	logger.Debugf("OpenDir")
 	if user == "" {
 		entries, err := ioutil.ReadDir(gitfs.GitRepoDir)
 		if err != nil {
-			gitfs.logger.Errorf("Failed to open Git Repo Dir %s due to %s", gitfs.GitRepoDir, err)
+			logger.Errorf("Failed to open Git Repo Dir %s due to %s", gitfs.GitRepoDir, err)
 			return nil, fuse.ToStatus(err)
 		}
 		c := make([]fuse.DirEntry, 0, len(entries))
@@ -94,7 +189,7 @@ func (gitfs *GitFs) OpenDir(name string, _ *fuse.Context) ([]fuse.DirEntry, fuse
 		userDir := gitfs.GitRepoDir + "/" + user
 		entries, err := ioutil.ReadDir(userDir)
 		if err != nil {
-			gitfs.logger.Errorf("Failed to open Git User Dir %s due to %s", userDir, err)
+			logger.Errorf("Failed to open Git User Dir %s due to %s", userDir, err)
 			return nil, fuse.ToStatus(err)
 		}
 		c := make([]fuse.DirEntry, 0, len(entries))
@@ -108,30 +203,32 @@ func (gitfs *GitFs) OpenDir(name string, _ *fuse.Context) ([]fuse.DirEntry, fuse
 	}
 
 	repopath := gitfs.GitRepoDir + "/" + user + "/" + repo + ".git"
-	entries, status := gitfs.openGitDir(repopath, path)
+	entries, status = gitfs.openGitDir(repopath, path, logger)
 	return entries, status
 }
 
-func (gitfs *GitFs) openGitDir(repoPath string, path string) ([]fuse.DirEntry, fuse.Status) {
-	repo, _, _, tree, err := gitfs.getMasterTreeFromRepo(repoPath)
+func (gitfs *GitFs) openGitDir(repoPath string, path string, logger log_driver.Logger) ([]fuse.DirEntry, fuse.Status) {
+	cached, err := gitfs.getMasterTreeFromRepo(repoPath, logger)
 	if err != nil {
 		return nil, fuse.EPERM
 	}
+	defer gitfs.cache.Release(cached)
+	repo, tree := cached.Repo, cached.Tree
 
 	if path != "" {
 		entry, err := tree.EntryByPath(path)
 		if err != nil {
-			gitfs.logger.Debugf("Cannot find path %s from tree %s of Git Repository %s due to %s", path, tree.Id().String(), repoPath, err)
+			logger.Debugf("Cannot find path %s from tree %s of Git Repository %s due to %s", path, tree.Id().String(), repoPath, err)
 			return nil, fuse.ENOENT
 		} else if entry.Type == libgit2.ObjectTree {
 			tree, err = repo.LookupTree(entry.Id)
 			if err != nil {
-				gitfs.logger.Errorf("Failed to find tree %s (path = %s) from Git Repository %s", entry.Id, path, repoPath)
+				logger.Errorf("Failed to find tree %s (path = %s) from Git Repository %s", entry.Id, path, repoPath)
 				return nil, fuse.EPERM
 			}
 			defer tree.Free()
 		} else {
-			gitfs.logger.Debugf("Path %s from tree %s of Git Repository %s is expected to be tree but it's not", path, tree.Id().String(), repoPath)
+			logger.Debugf("Path %s from tree %s of Git Repository %s is expected to be tree but it's not", path, tree.Id().String(), repoPath)
 			return nil, fuse.EINVAL
 		}
 	}
@@ -140,7 +237,7 @@ func (gitfs *GitFs) openGitDir(repoPath string, path string) ([]fuse.DirEntry, f
 	for i := uint64(0); i < count; i++ {
 		entry := tree.EntryByIndex(i)
 		if entry == nil {
-			gitfs.logger.Errorf("Failed to get tree entry by index %d from tree %s of Git Repository %s", i, tree.Id().String(), repoPath)
+			logger.Errorf("Failed to get tree entry by index %d from tree %s of Git Repository %s", i, tree.Id().String(), repoPath)
 			return nil, fuse.EPERM
 		} else if entry.Type == libgit2.ObjectTree || entry.Type == libgit2.ObjectBlob {
 			c = append(c, fuse.DirEntry{Name: entry.Name, Mode: toFileMode(entry.Filemode)})
@@ -152,8 +249,10 @@ func (gitfs *GitFs) openGitDir(repoPath string, path string) ([]fuse.DirEntry, f
 
 func (gitfs *GitFs) GetAttr(name string, _ *fuse.Context) (attr *fuse.Attr, status fuse.Status) {
 	defer gitfs.showPanicError()
+	defer observe("GetAttr", time.Now(), &status)
 	user, repo, path := splitPath(name)
-	gitfs.logger.Debugf("GetAttr: user = %s, repo = %s, path = %s", user, repo, path)
+	logger := gitfs.opLogger("GetAttr", user, repo, path)
+	logger.Debugf("GetAttr")
 	if /* user == "" || */ repo == "" {
 		dirInfo, err := os.Stat(gitfs.GitRepoDir + "/" + user)
 		if err != nil {
@@ -165,35 +264,37 @@ func (gitfs *GitFs) GetAttr(name string, _ *fuse.Context) (attr *fuse.Attr, stat
 	}
 
 	repoPath := gitfs.GitRepoDir + "/" + user + "/" + repo + ".git"
-	attr, status = gitfs.getGitAttrByPath(repoPath, path)
+	attr, status = gitfs.getGitAttrByPath(repoPath, path, logger)
 	return
 }
 
-func (gitfs *GitFs) getGitAttrByPath(repoPath string, path string) (*fuse.Attr, fuse.Status) {
-	repo, _, _, tree, err := gitfs.getMasterTreeFromRepo(repoPath)
+func (gitfs *GitFs) getGitAttrByPath(repoPath string, path string, logger log_driver.Logger) (*fuse.Attr, fuse.Status) {
+	cached, err := gitfs.getMasterTreeFromRepo(repoPath, logger)
 	if err != nil {
 		return nil, fuse.EPERM
 	}
+	defer gitfs.cache.Release(cached)
+	repo, tree := cached.Repo, cached.Tree
 
 	repoInfo, err := os.Stat(repoPath)
 	if err != nil {
-		gitfs.logger.Debugf("Failed to Stat %s due to %s", repoPath, err)
+		logger.Debugf("Failed to Stat %s due to %s", repoPath, err)
 		return nil, fuse.ToStatus(err)
 	}
 
 	if path == "" {
 		attr := fuse.ToAttr(repoInfo)
 		attr.Mode &= ^uint32(0222)
-		attr.Nlink = 2 + gitfs.treeEntryCount(tree, repoPath)
+		attr.Nlink = 2 + gitfs.treeEntryCount(tree, repoPath, logger)
 		return attr, fuse.OK
 	}
 
 	entry, err := tree.EntryByPath(path)
 	if err != nil {
-		gitfs.logger.Debugf("Cannot find path %s from tree %s of Git Repository %s due to %s", path, tree.Id().String(), repoPath, err)
+		logger.Debugf("Cannot find path %s from tree %s of Git Repository %s due to %s", path, tree.Id().String(), repoPath, err)
 		return nil, fuse.ENOENT
 	}
-	gitfs.logger.Debugf("Found path %s from tree %s of Git Repository %s", path, tree.Id().String(), repoPath)
+	logger.Debugf("Found path %s from tree %s of Git Repository %s", path, tree.Id().String(), repoPath)
 
 	var attr fuse.Attr
 	attr.Mode = toFileMode(entry.Filemode)
@@ -211,70 +312,78 @@ func (gitfs *GitFs) getGitAttrByPath(repoPath string, path string) (*fuse.Attr,
 	case libgit2.ObjectTree:
 		tree, err := repo.LookupTree(entry.Id)
 		if err != nil {
-			gitfs.logger.Errorf("Failed to find tree %s from Git Repository %s", entry.Id, repoPath)
+			logger.Errorf("Failed to find tree %s from Git Repository %s", entry.Id, repoPath)
 			return nil, fuse.EPERM
 		}
 		defer tree.Free()
-		gitfs.logger.Debugf("Found tree %s of Git Repository %s", tree.Id().String(), repoPath)
+		logger.Debugf("Found tree %s of Git Repository %s", tree.Id().String(), repoPath)
 		attr.Size = 4096
-		attr.Nlink = 2 + gitfs.treeEntryCount(tree, repoPath)
+		attr.Nlink = 2 + gitfs.treeEntryCount(tree, repoPath, logger)
 	case libgit2.ObjectBlob:
 		blob, err := repo.LookupBlob(entry.Id)
 		if err != nil {
-			gitfs.logger.Errorf("Failed to find blob %s from Git Repository %s", entry.Id, repoPath)
+			logger.Errorf("Failed to find blob %s from Git Repository %s", entry.Id, repoPath)
 			return nil, fuse.EPERM
 		}
 		defer blob.Free()
-		gitfs.logger.Debugf("Found blob %s of Git Repository %s", blob.Id().String(), repoPath)
+		logger.Debugf("Found blob %s of Git Repository %s", blob.Id().String(), repoPath)
 		attr.Nlink = 1
 		attr.Size = uint64(blob.Size())
 	default:
-		gitfs.logger.Debugf("GetAttr: Unsupported object type %s of %s from Git Repository %s", entry.Type.String(), entry.Id, repoPath)
+		logger.Debugf("GetAttr: Unsupported object type %s of %s from Git Repository %s", entry.Type.String(), entry.Id, repoPath)
 		return nil, fuse.ENOENT
 	}
 	attr.Blocks = (attr.Size + 511) / 512
 	return &attr, fuse.OK
 }
 
-func (gitfs *GitFs) GetXAttr(name string, attr string, _ *fuse.Context) ([]byte, fuse.Status) {
+func (gitfs *GitFs) GetXAttr(name string, attr string, _ *fuse.Context) (data []byte, status fuse.Status) {
 	defer gitfs.showPanicError()
+	defer observe("GetXAttr", time.Now(), &status)
 	user, repo, path := splitPath(name)
-	gitfs.logger.Debugf("GetXAttr: user = %s, repo = %s, path = %s", user, repo, path)
+	logger := gitfs.opLogger("GetXAttr", user, repo, path)
+	logger.Debugf("GetXAttr")
 	return nil, fuse.ENODATA
 }
 
-func (gitfs *GitFs) ListXAttr(name string, _ *fuse.Context) ([]string, fuse.Status) {
+func (gitfs *GitFs) ListXAttr(name string, _ *fuse.Context) (attrs []string, status fuse.Status) {
 	defer gitfs.showPanicError()
+	defer observe("ListXAttr", time.Now(), &status)
 	user, repo, path := splitPath(name)
-	gitfs.logger.Debugf("ListXAttr: user = %s, repo = %s, path = %s", user, repo, path)
+	logger := gitfs.opLogger("ListXAttr", user, repo, path)
+	logger.Debugf("ListXAttr")
 	return []string{}, fuse.OK
 }
 
-func (gitfs *GitFs) Readlink(name string, _ *fuse.Context) (string, fuse.Status) {
+func (gitfs *GitFs) Readlink(name string, _ *fuse.Context) (target string, status fuse.Status) {
 	defer gitfs.showPanicError()
+	defer observe("Readlink", time.Now(), &status)
 	user, repo, path := splitPath(name)
-	gitfs.logger.Debugf("Readlink: user = %s, repo = %s, path = %s", user, repo, path)
+	logger := gitfs.opLogger("Readlink", user, repo, path)
+	logger.Debugf("Readlink")
 	if /* user == "" || */ repo == "" {
 		return "", fuse.EINVAL
 	}
 
 	repoPath := gitfs.GitRepoDir + "/" + user + "/" + repo + ".git"
-	gitRepo, _, _, tree, err := gitfs.getMasterTreeFromRepo(repoPath)
+	cached, err := gitfs.getMasterTreeFromRepo(repoPath, logger)
 	if err != nil {
 		return "", fuse.EPERM
 	}
+	defer gitfs.cache.Release(cached)
+	gitRepo, tree := cached.Repo, cached.Tree
 
 	entry, err := tree.EntryByPath(path)
 	if err != nil {
-		gitfs.logger.Debugf("Cannot find path %s from tree %s of Git Repository %s due to %s", path, tree.Id().String(), repoPath, err)
+		logger.Debugf("Cannot find path %s from tree %s of Git Repository %s due to %s", path, tree.Id().String(), repoPath, err)
 		return "", fuse.ENOENT
 	}
-	gitfs.logger.Debugf("Found path %s from tree %s of Git Repository %s", path, tree.Id().String(), repoPath)
+	logger.Debugf("Found path %s from tree %s of Git Repository %s", path, tree.Id().String(), repoPath)
 
 	if entry.Type == libgit2.ObjectBlob && entry.Filemode == libgit2.FilemodeLink {
 		blob, err := gitRepo.LookupBlob(entry.Id)
 		if err != nil {
-			gitfs.logger.Errorf("Failed to find blob %s (path = %s) from Git Repository %s", entry.Id, path, repoPath)
+			logger.Errorf("Failed to find blob %s (path = %s) from Git Repository %s", entry.Id, path, repoPath)
 			return "", fuse.EPERM
 		}
 		defer blob.Free()
@@ -284,54 +393,55 @@ func (gitfs *GitFs) Readlink(name string, _ *fuse.Context) (string, fuse.Status)
 	}
 }
 
-func (gitfs *GitFs) getMasterTreeFromRepo(repoPath string) (*libgit2.Repository, *libgit2.Branch, *libgit2.Commit, *libgit2.Tree, error) {
+// getMasterTreeFromRepo acquires the cache entry of repoPath, which must be released once it's not used
+func (gitfs *GitFs) getMasterTreeFromRepo(repoPath string, logger log_driver.Logger) (*cache.CacheEntry, error) {
 	entry, found := gitfs.cache.Get(repoPath)
 	if found {
-		gitfs.logger.Debugf("Cache hits on Git Repository %s", repoPath)
-		return entry.Repo, entry.Branch, entry.Commit, entry.Tree, nil
+		logger.Debugf("Cache hits on Git Repository %s", repoPath)
+		return entry, nil
 	}
-	gitfs.logger.Debugf("Cache miss on Git Repository %s", repoPath)
-	repo, branch, commit, tree, cleaner, err := gitfs.getMasterTreeFromRepoWithoutCache(repoPath)
+	logger.Debugf("Cache miss on Git Repository %s", repoPath)
+	repo, branch, commit, tree, cleaner, err := gitfs.getMasterTreeFromRepoWithoutCache(repoPath, logger)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, err
 	}
 	entry = &cache.CacheEntry{Repo: repo, Branch: branch, Commit: commit, Tree: tree, OnClean: cleaner}
 	gitfs.cache.Add(repoPath, entry)
-	gitfs.logger.Debugf("Cache added for Git Repository %s", repoPath)
-	return repo, branch, commit, tree, err
+	logger.Debugf("Cache added for Git Repository %s", repoPath)
+	return entry, nil
 }
 
-func (gitfs *GitFs) getMasterTreeFromRepoWithoutCache(repoPath string) (*libgit2.Repository, *libgit2.Branch, *libgit2.Commit, *libgit2.Tree, func(), error) {
+func (gitfs *GitFs) getMasterTreeFromRepoWithoutCache(repoPath string, logger log_driver.Logger) (*libgit2.Repository, *libgit2.Branch, *libgit2.Commit, *libgit2.Tree, func(), error) {
 	repo, err := libgit2.OpenRepository(repoPath)
 	if err != nil {
-		gitfs.logger.Debugf("Failed to open Git Repository %s due to %s", repoPath, err)
+		logger.Debugf("Failed to open Git Repository %s due to %s", repoPath, err)
 		return nil, nil, nil, nil, nil, err
 	}
-	gitfs.logger.Debugf("Open Git Repository %s", repoPath)
+	logger.Debugf("Open Git Repository %s", repoPath)
 	masterBranch, err := repo.LookupBranch("master", libgit2.BranchLocal)
 	if err != nil {
-		gitfs.logger.Errorf("Failed to get master branch of Git Repository %s due to %s", repoPath, err)
+		logger.Errorf("Failed to get master branch of Git Repository %s due to %s", repoPath, err)
 		repo.Free()
 		return nil, nil, nil, nil, nil, err
 	}
-	gitfs.logger.Debugf("Got master branch of Git Repository %s", repoPath)
+	logger.Debugf("Got master branch of Git Repository %s", repoPath)
 	targetCommit, err := repo.LookupCommit(masterBranch.Target())
 	if err != nil {
-		gitfs.logger.Errorf("Failed to get commit from master branch of Git Repository %s due to %s", repoPath, err)
+		logger.Errorf("Failed to get commit from master branch of Git Repository %s due to %s", repoPath, err)
 		masterBranch.Free()
 		repo.Free()
 		return nil, nil, nil, nil, nil, err
 	}
-	gitfs.logger.Debugf("Got commit %s from master branch of Git Repository %s", targetCommit.Id().String(), repoPath)
+	logger.Debugf("Got commit %s from master branch of Git Repository %s", targetCommit.Id().String(), repoPath)
 	targetTree, err := targetCommit.Tree()
 	if err != nil {
-		gitfs.logger.Errorf("Failed to get tree of commit %s from Git Repository %s due to %s", targetCommit.Id().String(), repoPath, err)
+		logger.Errorf("Failed to get tree of commit %s from Git Repository %s due to %s", targetCommit.Id().String(), repoPath, err)
 		targetCommit.Free()
 		masterBranch.Free()
 		repo.Free()
 		return nil, nil, nil, nil, nil, err
 	}
-	gitfs.logger.Debugf("Got tree %s from master branch of Git Repository %s", targetTree.Id().String(), repoPath)
+	logger.Debugf("Got tree %s from master branch of Git Repository %s", targetTree.Id().String(), repoPath)
 	cleaner := func() {
 		targetTree.Free()
 		targetCommit.Free()
@@ -344,17 +454,24 @@ func (gitfs *GitFs) getMasterTreeFromRepoWithoutCache(repoPath string) (*libgit2
 func (gitfs *GitFs) showPanicError() {
 	r := recover()
 	if r != nil {
-		defer gitfs.server.Unmount()
+		if gitfs.server != nil {
+			defer gitfs.server.Unmount()
+		}
 		gitfs.logger.Fatalf("GitFs receives Panic Error: %s", r)
 	}
 }
 
-func (gitfs *GitFs) treeEntryCount(tree *libgit2.Tree, repoPath string) (count uint32) {
+// opLogger returns the logger of a FUSE operation on path of the repository user/repo
+func (gitfs *GitFs) opLogger(operation string, user string, repo string, path string) log_driver.Logger {
+	return gitfs.logger.WithFields(log_driver.Fields{"op": operation, "user": user, "repo": repo, "path": path})
+}
+
+func (gitfs *GitFs) treeEntryCount(tree *libgit2.Tree, repoPath string, logger log_driver.Logger) (count uint32) {
 	count = 0
 	for i := uint64(0); i < tree.EntryCount(); i++ {
 		entry := tree.EntryByIndex(i)
 		if entry == nil {
-			gitfs.logger.Errorf("Failed to get tree entry by index %d from tree %s of Git Repository %s", i, tree.Id().String(), repoPath)
+			logger.Errorf("Failed to get tree entry by index %d from tree %s of Git Repository %s", i, tree.Id().String(), repoPath)
 			return
 		}
 		if entry.Type == libgit2.ObjectTree {
@@ -364,6 +481,12 @@ func (gitfs *GitFs) treeEntryCount(tree *libgit2.Tree, repoPath string) (count u
 	return
 }
 
+// observe records a FUSE operation started at start, with the status it returned
+func observe(operation string, start time.Time, status *fuse.Status) {
+	metrics.FuseOperations.WithLabelValues(operation, status.String()).Inc()
+	metrics.ObserveSince(metrics.FuseOperationDuration.WithLabelValues(operation), start)
+}
+
 func splitPath(fullpath string) (string, string, string) {
 	paths := strings.SplitN(fullpath, "/", 3)
 	switch len(paths) {
@@ -376,7 +499,7 @@ func splitPath(fullpath string) (string, string, string) {
 	}
 }
 
-func gitfsDir(logger log_driver.Logger) (string, error) {
+func tempGitfsDir(logger log_driver.Logger) (string, error) {
 	dir, err := ioutil.TempDir("", "gitfs")
 	if err != nil {
 		logger.Errorf("Failed to create a temporary dir due to %s", err)
@@ -1,6 +1,7 @@
 package gitfuse
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -263,15 +264,105 @@ func TestGitFsReadLink(t *testing.T) {
 	assert.EqualValues(t, realpath, "bin/pry")
 }
 
-func setupGitFsTest(t *testing.T) (*GitFs, func()) {
+func TestGitFsWithoutMount(t *testing.T) {
+	dir := setupGitRepoDir(t)
+	defer os.RemoveAll(dir)
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	gitfs, err := Open(&config.Fuse{GitRepoDir: dir, CacheSize: 1024}, logger)
+	assert.Nil(t, err)
+
+	files, err := gitfs.ReadDir("/")
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(files), 3)
+	assert.EqualValues(t, files[1].Name(), "pry")
+	assert.True(t, files[1].IsDir())
+
+	files, err = gitfs.ReadDir("/pry/ruby-pry/bin")
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(files), 1)
+	assert.EqualValues(t, files[0].Name(), "pry")
+	assert.EqualValues(t, files[0].Mode().Perm(), 0555)
+
+	reader, err := gitfs.OpenFile("pry/ruby-pry/bin/pry")
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(io.NewSectionReader(reader, 0, 1<<30))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, content)
+	file, err := gitfs.Stat("pry/ruby-pry/bin/pry")
+	assert.Nil(t, err)
+	assert.EqualValues(t, file.Size(), len(content))
+	// Read backwards, which starts git over
+	tail := make([]byte, 4)
+	n, err := reader.ReadAt(tail, int64(len(content)-4))
+	assert.Nil(t, err)
+	assert.EqualValues(t, tail[:n], content[len(content)-4:])
+	n, err = reader.ReadAt(tail, 0)
+	assert.Nil(t, err)
+	assert.EqualValues(t, tail[:n], content[:4])
+	assert.Nil(t, reader.(io.Closer).Close())
+
+	_, err = gitfs.OpenFile("pry/ruby-pry/bin")
+	assert.NotNil(t, err)
+	_, err = gitfs.Stat("pry/ruby-pry/bin/pry.unexisted")
+	assert.True(t, os.IsNotExist(err))
+	_, err = gitfs.LinkTarget("pry/ruby-pry/bin/pry")
+	assert.NotNil(t, err)
+}
+
+func TestGitFsMountPointOnRestart(t *testing.T) {
+	dir := setupGitRepoDir(t)
+	defer os.RemoveAll(dir)
+	mountPoint, err := ioutil.TempDir("", "gitfs-mount")
+	assert.Nil(t, err)
+	defer os.RemoveAll(mountPoint)
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	fuseConfig := &config.Fuse{GitRepoDir: dir, MountPoint: mountPoint, CacheSize: 1024}
+	previous, err := New(fuseConfig, logger)
+	assert.Nil(t, err)
+	go previous.Start()
+	previous.WaitStart()
+	assert.True(t, isMountPoint(mountPoint))
+
+	// The next process mounts once the previous one unmounts, rather than on top of it
+	next, err := Open(fuseConfig, logger)
+	assert.Nil(t, err)
+	mounted := make(chan error)
+	go func() { mounted <- next.Mount(fuseConfig, 10*time.Second) }()
+	select {
+	case <-mounted:
+		t.Fatal("Mounted on top of the previous mount")
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.NotNil(t, next.Ping())
+	assert.Nil(t, previous.Unmount())
+	assert.Nil(t, <-mounted)
+	go next.Start()
+	next.WaitStart()
+	files, err := ioutil.ReadDir(mountPoint)
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(files), 3)
+
+	assert.Nil(t, previous.Unmount())
+	assert.Nil(t, next.Unmount())
+	assert.False(t, isMountPoint(mountPoint))
+}
+
+func setupGitRepoDir(t *testing.T) string {
 	dir, err := ioutil.TempDir("", "gitfs-test")
 	assert.Nil(t, err)
 
 	cmd := exec.Command("tar", "xvf", "pages.tar.gz", "-C", dir)
 	err = cmd.Run()
 	assert.Nil(t, err)
+	return dir
+}
+
+func setupGitFsTest(t *testing.T) (*GitFs, func()) {
+	dir := setupGitRepoDir(t)
 
-	fsConfig := &config.Fuse{GitRepoDir: dir, Debug: false}
+	fsConfig := &config.Fuse{GitRepoDir: dir, Debug: false, CacheSize: 1024}
 	logConfig := &config.Log{Local: "STDERR", Level: "WARN"}
 	logger, err := log_driver.New(logConfig)
 	assert.Nil(t, err)
@@ -0,0 +1,180 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Check returns nil if the part of Pages it's about is working
+type Check func() error
+
+type check struct {
+	name     string
+	liveness bool
+	fn       Check
+	mutex    sync.Mutex
+	pending  bool
+}
+
+// Checker runs the checks within a timeout each, a check still running from a previous probe is
+// reported as timed out rather than run again, so a hung check never piles up goroutines.
+type Checker struct {
+	timeout  time.Duration
+	mutex    sync.Mutex
+	checks   map[string]*check
+	draining bool
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func New(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout, checks: map[string]*check{}}
+}
+
+// AddLiveness adds a check which fails both the liveness and the readiness, it's meant for failures
+// which only a restart can fix, such as a hung mount.
+func (checker *Checker) AddLiveness(name string, fn Check) {
+	checker.add(name, true, fn)
+}
+
+// AddReadiness adds a check which only fails the readiness, it's meant for failures which the instance
+// may recover from, such as an unreachable storage.
+func (checker *Checker) AddReadiness(name string, fn Check) {
+	checker.add(name, false, fn)
+}
+
+func (checker *Checker) add(name string, liveness bool, fn Check) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.checks[name] = &check{name: name, liveness: liveness, fn: fn}
+}
+
+// Drain makes the readiness fail from now on, so that the instance is taken out of service before
+// shutting down.
+func (checker *Checker) Drain() {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.draining = true
+}
+
+// Live runs the liveness checks
+func (checker *Checker) Live() *Report {
+	return checker.run(true)
+}
+
+// Ready runs every check, and fails if draining
+func (checker *Checker) Ready() *Report {
+	report := checker.run(false)
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if checker.draining {
+		report.Status = "failing"
+		report.Checks["draining"] = "Pages is shutting down"
+	}
+	return report
+}
+
+func (checker *Checker) run(livenessOnly bool) *Report {
+	checker.mutex.Lock()
+	var checks []*check
+	for _, check := range checker.checks {
+		if check.liveness || !livenessOnly {
+			checks = append(checks, check)
+		}
+	}
+	checker.mutex.Unlock()
+	sort.Slice(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+
+	report := &Report{Status: "ok", Checks: map[string]string{}}
+	results := make([]error, len(checks))
+	var wait sync.WaitGroup
+	for i := range checks {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			results[i] = checker.runCheck(checks[i])
+		}(i)
+	}
+	wait.Wait()
+	for i, check := range checks {
+		if results[i] != nil {
+			report.Status = "failing"
+			report.Checks[check.name] = results[i].Error()
+		} else {
+			report.Checks[check.name] = "ok"
+		}
+	}
+	return report
+}
+
+func (checker *Checker) runCheck(check *check) error {
+	check.mutex.Lock()
+	if check.pending {
+		check.mutex.Unlock()
+		return fmt.Errorf("Timed out after %s", checker.timeout)
+	}
+	check.pending = true
+	check.mutex.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := check.fn()
+		check.mutex.Lock()
+		check.pending = false
+		check.mutex.Unlock()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(checker.timeout):
+		return fmt.Errorf("Timed out after %s", checker.timeout)
+	}
+}
+
+// LivenessHandler serves the liveness report, with status 503 if failing
+func (checker *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, checker.Live())
+	})
+}
+
+// ReadinessHandler serves the readiness report, with status 503 if failing
+func (checker *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, checker.Ready())
+	})
+}
+
+func writeReport(w http.ResponseWriter, report *Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Readable returns a check of whether dir can be listed
+func Readable(dir string) Check {
+	return func() error {
+		file, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = file.Readdirnames(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+}
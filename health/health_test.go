@@ -0,0 +1,66 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hang := make(chan struct{})
+	defer close(hang)
+	storageErr := fmt.Errorf("Connection refused")
+	checker := New(50 * time.Millisecond)
+	checker.AddLiveness("gitfs", func() error {
+		<-hang
+		return nil
+	})
+	checker.AddReadiness("repo_dir", Readable(dir))
+	checker.AddReadiness("missing_dir", Readable(dir+"/missing"))
+	checker.AddReadiness("storage", func() error { return storageErr })
+
+	report := checker.Live()
+	assert.EqualValues(t, report.Status, "failing")
+	assert.EqualValues(t, report.Checks, map[string]string{"gitfs": "Timed out after 50ms"})
+
+	report = checker.Ready()
+	assert.EqualValues(t, report.Status, "failing")
+	assert.EqualValues(t, report.Checks["gitfs"], "Timed out after 50ms")
+	assert.EqualValues(t, report.Checks["repo_dir"], "ok")
+	assert.Contains(t, report.Checks["missing_dir"], "no such file or directory")
+	assert.EqualValues(t, report.Checks["storage"], "Connection refused")
+
+	checker = New(time.Second)
+	checker.AddLiveness("gitfs", func() error { return nil })
+	checker.AddReadiness("repo_dir", Readable(dir))
+	server := httptest.NewServer(checker.ReadinessHandler())
+	defer server.Close()
+	get := func() (int, *Report) {
+		response, err := http.Get(server.URL)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		report := &Report{}
+		assert.Nil(t, json.NewDecoder(response.Body).Decode(report))
+		return response.StatusCode, report
+	}
+	status, report := get()
+	assert.EqualValues(t, status, http.StatusOK)
+	assert.EqualValues(t, report, &Report{Status: "ok", Checks: map[string]string{"gitfs": "ok", "repo_dir": "ok"}})
+
+	checker.Drain()
+	status, report = get()
+	assert.EqualValues(t, status, http.StatusServiceUnavailable)
+	assert.EqualValues(t, report.Checks["draining"], "Pages is shutting down")
+	assert.EqualValues(t, checker.Live().Status, "ok")
+}
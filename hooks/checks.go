@@ -0,0 +1,100 @@
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bachue/pages/config"
+)
+
+// CheckPublishBranchDeletion rejects deleting the branch a repository is published from.
+func CheckPublishBranchDeletion(push *Push) []error {
+	var reasons []error
+	for _, update := range push.Updates {
+		if !update.IsDelete() || update.Branch() == "" {
+			continue
+		}
+		manifest, err := push.Manifest(update.OldSha)
+		if err != nil {
+			reasons = append(reasons, fmt.Errorf("Failed to read %s from %s: %s", config.ManifestFile, update.Ref, err))
+		} else if manifest.PublishesRef(update.Ref) {
+			reasons = append(reasons, fmt.Errorf("Deleting the publish branch %s is not allowed", update.Branch()))
+		}
+	}
+	return reasons
+}
+
+// RepoSizeCheck rejects pushes after which the repository, quarantined objects included, is larger than maxSize.
+func RepoSizeCheck(maxSize int64) Check {
+	return func(push *Push) []error {
+		var size int64
+		err := filepath.Walk(push.Path, func(_ string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return []error{fmt.Errorf("Failed to compute the size of the repository: %s", err)}
+		} else if size > maxSize {
+			return []error{fmt.Errorf("Repository size %s exceeds the quota of %s", formatSize(size), formatSize(maxSize))}
+		}
+		return nil
+	}
+}
+
+// ObjectsCheck rejects pushes bringing blobs larger than maxBlobSize, or files at a path matching
+// any of forbiddenPaths.
+func ObjectsCheck(maxBlobSize int64, forbiddenPaths []string) Check {
+	return func(push *Push) []error {
+		if maxBlobSize <= 0 && len(forbiddenPaths) == 0 {
+			return nil
+		}
+		objects, err := push.NewObjects()
+		if err != nil {
+			return []error{fmt.Errorf("Failed to list pushed objects: %s", err)}
+		}
+		var reasons []error
+		for _, object := range objects {
+			if object.Type == "blob" && maxBlobSize > 0 && object.Size > maxBlobSize {
+				reasons = append(reasons, fmt.Errorf("%s (%s) is larger than the limit of %s",
+					objectName(object), formatSize(object.Size), formatSize(maxBlobSize)))
+			}
+			if object.Path == "" {
+				continue
+			}
+			for _, pattern := range forbiddenPaths {
+				if config.MatchGlob(pattern, object.Path) {
+					reasons = append(reasons, fmt.Errorf("%s is a forbidden path (matches `%s`)", object.Path, pattern))
+					break
+				}
+			}
+		}
+		return reasons
+	}
+}
+
+func objectName(object Object) string {
+	if object.Path != "" {
+		return object.Path
+	}
+	return "blob " + object.Sha
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,316 @@
+package hooks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	conf "github.com/bachue/pages/config"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/repos"
+)
+
+const ZeroSha = repos.ZeroSha
+
+// The pre-receive hook installed for every `git receive-pack` started by pages, it hands the ref updates
+// and the quarantine object directory over to the pages process through FIFOs and exits with its verdict,
+// so the checks run in-process while the pushed objects are not yet visible to anyone. The messages
+// following the verdict are relayed to the git client through its sideband.
+const preReceiveScript = `#!/bin/sh
+test -n "$PAGES_HOOK_SESSION" || exit 0
+{
+	echo "$GIT_OBJECT_DIRECTORY"
+	echo "$GIT_ALTERNATE_OBJECT_DIRECTORIES"
+	cat
+	echo .
+} > "$PAGES_HOOK_SESSION/request"
+exec < "$PAGES_HOOK_SESSION/response"
+read status
+while read -r line && [ "$line" != . ]; do
+	echo "$line" >&2
+done
+exit ${status:-1}
+`
+
+type RefUpdate struct {
+	OldSha string
+	NewSha string
+	Ref    string
+}
+
+func (update *RefUpdate) IsCreate() bool {
+	return update.OldSha == ZeroSha
+}
+
+func (update *RefUpdate) IsDelete() bool {
+	return update.NewSha == ZeroSha
+}
+
+// Branch returns the branch name of a `refs/heads/` ref, or "" for any other ref
+func (update *RefUpdate) Branch() string {
+	if strings.HasPrefix(update.Ref, "refs/heads/") {
+		return strings.TrimPrefix(update.Ref, "refs/heads/")
+	}
+	return ""
+}
+
+// Push is a pending `git push` whose objects are still in the quarantine directory.
+type Push struct {
+	*repos.Repo
+	Updates    []RefUpdate
+	newObjects []Object
+}
+
+type Object struct {
+	Sha  string
+	Type string
+	Size int64
+	Path string
+}
+
+// NewObjects lists the objects brought by the push, that is, reachable from the pushed commits
+// but from no existing ref, with the path they are found at.
+func (push *Push) NewObjects() ([]Object, error) {
+	if push.newObjects != nil {
+		return push.newObjects, nil
+	}
+	args := []string{"rev-list", "--objects"}
+	for _, update := range push.Updates {
+		if !update.IsDelete() {
+			args = append(args, update.NewSha)
+		}
+	}
+	objects := []Object{}
+	if len(args) == 2 {
+		push.newObjects = objects
+		return objects, nil
+	}
+	revisions, err := push.Git(append(args, "--not", "--all")...)
+	if err != nil {
+		return nil, err
+	}
+	output, err := push.GitWithInput(revisions, "cat-file",
+		"--batch-check=%(objectname) %(objecttype) %(objectsize) %(rest)")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 3 {
+			continue
+		}
+		object := Object{Sha: fields[0], Type: fields[1]}
+		object.Size, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed object `%s`", line)
+		}
+		if len(fields) == 4 {
+			object.Path = fields[3]
+		}
+		objects = append(objects, object)
+	}
+	push.newObjects = objects
+	return objects, nil
+}
+
+// A Check inspects a pending push and returns the reasons to reject it, if any.
+type Check func(push *Push) []error
+
+type Receiver struct {
+	hooksDir string
+	logger   log_driver.Logger
+	checks   []Check
+}
+
+func NewReceiver(config *conf.Hooks, logger log_driver.Logger) (*Receiver, error) {
+	dir, err := ioutil.TempDir("", "pages-hooks")
+	if err != nil {
+		logger.Errorf("Failed to create hooks dir due to %s", err)
+		return nil, err
+	}
+	err = ioutil.WriteFile(dir+"/pre-receive", []byte(preReceiveScript), 0755)
+	if err != nil {
+		logger.Errorf("Failed to install pre-receive hook into %s due to %s", dir, err)
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	logger.Debugf("Installed pre-receive hook into %s", dir)
+	receiver := &Receiver{hooksDir: dir, logger: logger}
+	receiver.AddCheck(CheckManifest)
+	receiver.AddCheck(CheckPublishBranchDeletion)
+	if config.MaxRepoSize > 0 {
+		receiver.AddCheck(RepoSizeCheck(config.MaxRepoSize))
+	}
+	receiver.AddCheck(ObjectsCheck(config.MaxBlobSize, config.ForbiddenPaths))
+	return receiver, nil
+}
+
+func (receiver *Receiver) AddCheck(check Check) {
+	receiver.checks = append(receiver.checks, check)
+}
+
+func (receiver *Receiver) Close() error {
+	return os.RemoveAll(receiver.hooksDir)
+}
+
+// Command prepares `git receive-pack [args...]` for the repository at repoPath with the pre-receive hook
+// installed, the returned Session must be served while the command runs, and closed after it exits.
+func (receiver *Receiver) Command(repoPath string, args ...string) (*exec.Cmd, *Session, error) {
+	session, err := receiver.newSession(repoPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	args = append(append([]string{"-c", "core.hooksPath=" + receiver.hooksDir, "receive-pack"}, args...), repoPath)
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "PAGES_HOOK_SESSION="+session.dir)
+	return cmd, session, nil
+}
+
+type Session struct {
+	receiver *Receiver
+	repoPath string
+	dir      string
+	request  *os.File
+	response *os.File
+	// mutex guards push, which is set by Serve and read once `git receive-pack` exits
+	mutex sync.Mutex
+	push  *Push
+}
+
+func (receiver *Receiver) newSession(repoPath string) (*Session, error) {
+	dir, err := ioutil.TempDir("", "pages-hook-session")
+	if err != nil {
+		receiver.logger.Errorf("Failed to create hook session dir due to %s", err)
+		return nil, err
+	}
+	session := &Session{receiver: receiver, repoPath: repoPath, dir: dir}
+	// Both FIFOs are opened read-write so that opening them never blocks, and the response
+	// stays buffered until the hook reads it
+	for _, fifo := range []struct {
+		file **os.File
+		name string
+	}{{&session.request, "request"}, {&session.response, "response"}} {
+		err = syscall.Mkfifo(dir+"/"+fifo.name, 0600)
+		if err == nil {
+			*fifo.file, err = os.OpenFile(dir+"/"+fifo.name, os.O_RDWR, 0600)
+		}
+		if err != nil {
+			receiver.logger.Errorf("Failed to create FIFO %s/%s due to %s", dir, fifo.name, err)
+			session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// Serve waits for the pre-receive hook, runs every check against the push and writes the reasons
+// of rejection into stderr, or has the hook print them if stderr is nil. It returns once the verdict
+// is sent or the session is closed.
+func (session *Session) Serve(stderr io.Writer) {
+	logger := session.receiver.logger
+	push, err := session.readRequest()
+	if err != nil {
+		logger.Debugf("No pre-receive request served for %s: %s", session.repoPath, err)
+		return
+	}
+	var reasons []error
+	for _, check := range session.receiver.checks {
+		reasons = append(reasons, check(push)...)
+	}
+	response := "0\n"
+	if len(reasons) > 0 {
+		response = "1\n"
+		for _, reason := range reasons {
+			logger.Infof("Rejected push to %s: %s", session.repoPath, reason)
+			message := "error: " + strings.Replace(reason.Error(), "\n", " ", -1) + "\n"
+			if stderr != nil {
+				io.WriteString(stderr, message)
+			} else {
+				response += message
+			}
+		}
+	} else {
+		session.mutex.Lock()
+		session.push = push
+		session.mutex.Unlock()
+	}
+	_, err = session.response.Write([]byte(response + ".\n"))
+	if err != nil {
+		logger.Errorf("Failed to send pre-receive verdict for %s due to %s", session.repoPath, err)
+	}
+}
+
+// Push returns the push accepted by the checks, or nil if the hook did not run or rejected it.
+func (session *Session) Push() *Push {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.push
+}
+
+// Landed returns the ref updates of the accepted push which took effect, it's meant to be called
+// once `git receive-pack` exits.
+func (session *Session) Landed() []RefUpdate {
+	push := session.Push()
+	if push == nil {
+		return nil
+	}
+	repo := repos.Open(session.repoPath)
+	var landed []RefUpdate
+	for _, update := range push.Updates {
+		sha, err := repo.ResolveRef(update.Ref)
+		if err != nil {
+			session.receiver.logger.Errorf("Failed to resolve %s of %s due to %s", update.Ref, session.repoPath, err)
+			continue
+		}
+		if sha == update.NewSha || (update.IsDelete() && sha == "") {
+			landed = append(landed, update)
+		}
+	}
+	return landed
+}
+
+func (session *Session) readRequest() (*Push, error) {
+	reader := bufio.NewReader(session.request)
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		return strings.TrimSuffix(line, "\n"), err
+	}
+	push := &Push{Repo: repos.Open(session.repoPath)}
+	for _, name := range []string{"GIT_OBJECT_DIRECTORY", "GIT_ALTERNATE_OBJECT_DIRECTORIES"} {
+		value, err := readLine()
+		if err != nil {
+			return nil, err
+		} else if value != "" {
+			push.Env = append(push.Env, name+"="+value)
+		}
+	}
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		} else if line == "." {
+			return push, nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Malformed ref update `%s`", line)
+		}
+		push.Updates = append(push.Updates, RefUpdate{OldSha: fields[0], NewSha: fields[1], Ref: fields[2]})
+	}
+}
+
+func (session *Session) Close() error {
+	for _, file := range []*os.File{session.request, session.response} {
+		if file != nil {
+			file.Close()
+		}
+	}
+	return os.RemoveAll(session.dir)
+}
@@ -0,0 +1,168 @@
+package hooks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/log_driver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreReceiveRejectsBrokenManifest(t *testing.T) {
+	receiver, repoPath, commit, cleaner := setupHooksTest(t, map[string]string{
+		".pages.yml": "branch: master\nsource: ../outside\n",
+	})
+	defer cleaner()
+
+	status, stderr, push := runPreReceive(t, receiver, repoPath, ZeroSha+" "+commit+" refs/heads/master\n")
+	assert.EqualValues(t, status, 1)
+	assert.Contains(t, stderr, "error: .pages.yml on master: line 2: source: must be a relative path")
+	assert.Nil(t, push)
+}
+
+func TestPreReceiveAcceptsValidManifest(t *testing.T) {
+	receiver, repoPath, commit, cleaner := setupHooksTest(t, map[string]string{
+		".pages.yml": "branch: master\nsource: dist\n",
+		"index.html": "<html></html>",
+	})
+	defer cleaner()
+
+	status, stderr, push := runPreReceive(t, receiver, repoPath, ZeroSha+" "+commit+" refs/heads/master\n")
+	assert.EqualValues(t, status, 0)
+	assert.Empty(t, stderr)
+	assert.NotNil(t, push)
+	assert.EqualValues(t, push.Updates, []RefUpdate{{OldSha: ZeroSha, NewSha: commit, Ref: "refs/heads/master"}})
+	assert.True(t, push.Updates[0].IsCreate())
+	assert.EqualValues(t, push.Updates[0].Branch(), "master")
+}
+
+func TestPreReceiveRelaysReasonsThroughHook(t *testing.T) {
+	receiver, repoPath, commit, cleaner := setupHooksTest(t, map[string]string{
+		".pages.yml": "branch: master\nsource: ../outside\n",
+	})
+	defer cleaner()
+
+	status, stderr, _ := runPreReceiveWith(t, receiver, repoPath, ZeroSha+" "+commit+" refs/heads/master\n", false)
+	assert.EqualValues(t, status, 1)
+	assert.EqualValues(t, stderr, "error: .pages.yml on master: line 2: source: must be a relative path inside the repository\n")
+}
+
+func runPreReceive(t *testing.T, receiver *Receiver, repoPath string, updates string) (int, string, *Push) {
+	return runPreReceiveWith(t, receiver, repoPath, updates, true)
+}
+
+// runPreReceiveWith runs the hook as `git receive-pack` would, and returns its exit status, the reasons
+// of rejection written either by the session or by the hook, and the accepted push
+func runPreReceiveWith(t *testing.T, receiver *Receiver, repoPath string, updates string, sessionStderr bool) (int, string, *Push) {
+	_, session, err := receiver.Command(repoPath)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	served := make(chan struct{})
+	go func() {
+		if sessionStderr {
+			session.Serve(&stderr)
+		} else {
+			session.Serve(nil)
+		}
+		close(served)
+	}()
+
+	hook := exec.Command("sh", receiver.hooksDir+"/pre-receive")
+	hook.Env = append(os.Environ(), "PAGES_HOOK_SESSION="+session.dir, "GIT_OBJECT_DIRECTORY="+repoPath+"/objects")
+	hook.Stdin = strings.NewReader(updates)
+	if !sessionStderr {
+		hook.Stderr = &stderr
+	}
+	err = hook.Run()
+	<-served
+	status := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status = exitErr.Sys().(interface {
+			ExitStatus() int
+		}).ExitStatus()
+	} else {
+		assert.Nil(t, err)
+	}
+	return status, stderr.String(), session.Push()
+}
+
+func TestPreReceiveRejectsDeletingPublishBranch(t *testing.T) {
+	receiver, repoPath, commit, cleaner := setupHooksTest(t, map[string]string{
+		".pages.yml": "branch: gh-pages\n",
+	})
+	defer cleaner()
+
+	status, stderr, _ := runPreReceive(t, receiver, repoPath, commit+" "+ZeroSha+" refs/heads/master\n")
+	assert.EqualValues(t, status, 0)
+	assert.Empty(t, stderr)
+
+	status, stderr, _ = runPreReceive(t, receiver, repoPath, commit+" "+ZeroSha+" refs/heads/gh-pages\n")
+	assert.EqualValues(t, status, 1)
+	assert.Contains(t, stderr, "error: Deleting the publish branch gh-pages is not allowed")
+}
+
+func TestPreReceiveRejectsForbiddenObjects(t *testing.T) {
+	receiver, repoPath, commit, cleaner := setupHooksTest(t, map[string]string{
+		"index.html":      "<html></html>",
+		"large.bin":       strings.Repeat("x", 2048),
+		".env":            "SECRET=1",
+		"keys/id_rsa":     "PRIVATE KEY",
+		"keys/id_rsa.pub": "PUBLIC KEY",
+	})
+	defer cleaner()
+	receiver.AddCheck(ObjectsCheck(1024, config.DefaultForbiddenPaths))
+	receiver.AddCheck(RepoSizeCheck(1024))
+
+	// The commit is already referenced by master, so pretend it's pushed to a new branch
+	git(t, repoPath, "update-ref", "-d", "refs/heads/master")
+	status, stderr, _ := runPreReceive(t, receiver, repoPath, ZeroSha+" "+commit+" refs/heads/master\n")
+	assert.EqualValues(t, status, 1)
+	assert.Contains(t, stderr, "error: large.bin (2.0 KiB) is larger than the limit of 1.0 KiB\n")
+	assert.Contains(t, stderr, "error: .env is a forbidden path (matches `.env`)\n")
+	assert.Contains(t, stderr, "error: keys/id_rsa is a forbidden path (matches `id_rsa`)\n")
+	assert.NotContains(t, stderr, "id_rsa.pub")
+	assert.NotContains(t, stderr, "index.html")
+	assert.Contains(t, stderr, "exceeds the quota of 1.0 KiB")
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=testuser", "-c", "user.email=test@qiniu.com"}, args...)...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	assert.Nil(t, err)
+	return strings.TrimSpace(string(output))
+}
+
+func setupHooksTest(t *testing.T, files map[string]string) (*Receiver, string, string, func()) {
+	dir, err := ioutil.TempDir("", "hooks-test")
+	assert.Nil(t, err)
+	git(t, dir, "init", "-q")
+	for name, content := range files {
+		err = os.MkdirAll(filepath.Dir(dir+"/"+name), 0755)
+		assert.Nil(t, err)
+		err = ioutil.WriteFile(dir+"/"+name, []byte(content), 0644)
+		assert.Nil(t, err)
+	}
+	git(t, dir, "add", ".")
+	git(t, dir, "commit", "-q", "-m", "Initial commit")
+	commit := git(t, dir, "rev-parse", "HEAD")
+
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	receiver, err := NewReceiver(&config.Hooks{}, logger)
+	assert.Nil(t, err)
+	return receiver, dir + "/.git", commit, func() {
+		err := receiver.Close()
+		assert.Nil(t, err)
+		err = os.RemoveAll(dir)
+		assert.Nil(t, err)
+	}
+}
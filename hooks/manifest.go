@@ -0,0 +1,33 @@
+package hooks
+
+import (
+	"fmt"
+
+	"github.com/bachue/pages/config"
+)
+
+// CheckManifest rejects pushes of branches carrying a `.pages.yml` which fails to parse or validate.
+func CheckManifest(push *Push) []error {
+	var reasons []error
+	for _, update := range push.Updates {
+		if update.IsDelete() || update.Branch() == "" {
+			continue
+		}
+		content, found, err := push.ReadFile(update.NewSha, config.ManifestFile)
+		if err != nil {
+			reasons = append(reasons, fmt.Errorf("Failed to read %s from %s: %s", config.ManifestFile, update.Ref, err))
+			continue
+		} else if !found {
+			continue
+		}
+		_, err = config.ParseManifest(content)
+		if errs, ok := err.(config.ValidationErrors); ok {
+			for _, fieldError := range errs {
+				reasons = append(reasons, fmt.Errorf("%s on %s: %s", config.ManifestFile, update.Branch(), fieldError))
+			}
+		} else if err != nil {
+			reasons = append(reasons, fmt.Errorf("%s on %s: %s", config.ManifestFile, update.Branch(), err))
+		}
+	}
+	return reasons
+}
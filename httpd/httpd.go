@@ -0,0 +1,241 @@
+package httpd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bachue/pages/audit"
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/hooks"
+	"github.com/bachue/pages/listeners"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/repos"
+)
+
+var gitRoute = regexp.MustCompile(`^/([^/]+)/([^/]+)/(info/refs|git-upload-pack|git-receive-pack)$`)
+
+// Server serves the git smart HTTP protocol over the same repositories and identities as sshd,
+// clients authenticate with HTTP basic auth, using their user name and one of their tokens.
+type Server struct {
+	Config     *config.Http
+	GitRepoDir string
+	Users      *auth.Store
+	Receiver   *hooks.Receiver
+	Events     *events.Bus
+	Auditor    *audit.Auditor
+	Logger     log_driver.Logger
+	httpServer *http.Server
+}
+
+func NewServer(httpConfig *config.Http, gitRepoDir string, users *auth.Store, receiver *hooks.Receiver,
+	bus *events.Bus, auditor *audit.Auditor, logger log_driver.Logger) *Server {
+	server := &Server{Config: httpConfig, GitRepoDir: gitRepoDir, Users: users, Receiver: receiver,
+		Events: bus, Auditor: auditor, Logger: logger}
+	server.httpServer = &http.Server{Addr: server.getHostPort(), Handler: server,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}}
+	return server
+}
+
+// Start serves until Shutdown is called
+func (server *Server) Start() error {
+	listener, err := listeners.Listen("http", server.httpServer.Addr)
+	if err != nil {
+		server.Logger.Errorf("Failed to listen on %s due to %s", server.httpServer.Addr, err)
+		return err
+	}
+	if server.Config.CertFile != "" {
+		server.Logger.Infof("Listening on %s for HTTPS", server.httpServer.Addr)
+		err = server.httpServer.ServeTLS(listener, server.Config.CertFile, server.Config.KeyFile)
+	} else {
+		server.Logger.Warnf("Listening on %s for HTTP without TLS, tokens are sent in the clear", server.httpServer.Addr)
+		err = server.httpServer.Serve(listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	server.Logger.Errorf("Failed to serve HTTP on %s due to %s", server.httpServer.Addr, err)
+	return err
+}
+
+// Shutdown stops accepting requests, then waits for the running ones to finish until ctx is done.
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.httpServer.Shutdown(ctx)
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.Logger.Debugf("%s %s from %s", r.Method, r.URL.String(), r.RemoteAddr)
+	matches := gitRoute.FindStringSubmatch(r.URL.Path)
+	if matches == nil {
+		http.NotFound(w, r)
+		return
+	}
+	action := matches[3]
+	service := action
+	if action == "info/refs" {
+		service = r.URL.Query().Get("service")
+	}
+	if service != "git-upload-pack" && service != "git-receive-pack" {
+		http.Error(w, "Only smart HTTP git protocol is supported", http.StatusForbidden)
+		return
+	}
+	if (action == "info/refs" && r.Method != "GET") || (action != "info/refs" && r.Method != "POST") {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity := server.authenticate(r)
+	if identity == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pages"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	repoName := matches[1] + "/" + matches[2]
+	user, repo, err := repos.Split(repoName)
+	if err == nil {
+		repoName = user + "/" + repo
+	}
+	allowed := err == nil && identity.CanRead(user, repo)
+	if allowed && service == "git-receive-pack" {
+		allowed = identity.CanWrite(user, repo)
+	}
+	repoPath := repos.Path(server.GitRepoDir, user, repo)
+	if allowed {
+		_, err = os.Stat(repoPath)
+		allowed = err == nil
+	}
+	if !allowed {
+		server.Logger.Errorf("Rejected %s to %s/%s from %s (user = %s)", service, matches[1], matches[2],
+			r.RemoteAddr, identity.User)
+		server.Auditor.Record(&audit.Entry{Action: audit.HttpGit, Outcome: audit.Denied, User: identity.User,
+			Source: r.RemoteAddr, Repo: repoName, Details: map[string]interface{}{"service": service}})
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	if action == "info/refs" {
+		server.advertiseRefs(w, service, repoPath)
+	} else {
+		server.serviceRPC(w, r, service, repoName, repoPath, identity)
+	}
+}
+
+func (server *Server) authenticate(r *http.Request) *auth.Identity {
+	name, token, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+	identity, err := server.Users.AuthenticateToken(name, token)
+	if err != nil {
+		server.Logger.Infof("Failed to authenticate %s from %s: %s", name, r.RemoteAddr, err)
+		server.Auditor.Record(&audit.Entry{Action: audit.HttpAuth, Outcome: audit.Failure, User: name,
+			Source: r.RemoteAddr, Error: err.Error()})
+		return nil
+	}
+	return identity
+}
+
+func (server *Server) advertiseRefs(w http.ResponseWriter, service string, repoPath string) {
+	w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, pktLine("# service="+service+"\n"))
+	io.WriteString(w, "0000")
+	cmd := exec.Command("git", strings.TrimPrefix(service, "git-"), "--stateless-rpc", "--advertise-refs", repoPath)
+	server.runCommand(cmd, nil, w)
+}
+
+func (server *Server) serviceRPC(w http.ResponseWriter, r *http.Request, service string, repoName string,
+	repoPath string, identity *auth.Identity) {
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip request body", http.StatusBadRequest)
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+	w.Header().Set("Content-Type", "application/x-"+service+"-result")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	details := map[string]interface{}{"service": service}
+	record := func(outcome string, err error) {
+		entry := &audit.Entry{Action: audit.HttpGit, Outcome: outcome, User: identity.User, Source: r.RemoteAddr,
+			Repo: repoName, Details: details}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		server.Auditor.Record(entry)
+	}
+	if service == "git-upload-pack" {
+		err := server.runCommand(exec.Command("git", "upload-pack", "--stateless-rpc", repoPath), body, w)
+		record(outcomeOf(err), err)
+		return
+	}
+	cmd, session, err := server.Receiver.Command(repoPath, "--stateless-rpc")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		record(audit.Failure, err)
+		return
+	}
+	defer session.Close()
+	// Reasons of rejection are relayed by the hook through the sideband of the response
+	go session.Serve(nil)
+	if err := server.runCommand(cmd, body, w); err != nil {
+		record(audit.Failure, err)
+		return
+	}
+	var updates []map[string]string
+	for _, update := range session.Landed() {
+		event := &events.Event{Id: events.NewId(), Type: events.Push, Repo: repoName, Ref: update.Ref,
+			OldSha: update.OldSha, NewSha: update.NewSha, Pusher: identity.User}
+		updates = append(updates, map[string]string{"ref": update.Ref, "old": update.OldSha, "new": update.NewSha,
+			"event": event.Id})
+		server.Events.Emit(event)
+	}
+	details["updates"] = updates
+	record(audit.Success, nil)
+}
+
+func outcomeOf(err error) string {
+	if err != nil {
+		return audit.Failure
+	}
+	return audit.Success
+}
+
+func (server *Server) runCommand(cmd *exec.Cmd, stdin io.Reader, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		server.Logger.Errorf("Failed to run `%s` due to %s: %s", strings.Join(cmd.Args, " "), err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+func (server *Server) getHostPort() string {
+	host_port := server.Config.ListenHost
+	host_port += ":"
+	host_port += strconv.Itoa(int(server.Config.ListenPort))
+	return host_port
+}
+
+func pktLine(line string) string {
+	return fmt.Sprintf("%04x%s", len(line)+4, line)
+}
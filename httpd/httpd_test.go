@@ -0,0 +1,151 @@
+package httpd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bachue/pages/audit"
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/hooks"
+	"github.com/bachue/pages/log_driver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpd-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, repo := range []string{"pry/ruby-pry.git", "rails/rails.git"} {
+		output, err := exec.Command("git", "init", "-q", "--bare", dir+"/"+repo).CombinedOutput()
+		assert.Nil(t, err, string(output))
+	}
+	err = ioutil.WriteFile(dir+"/.users.yml", []byte("users:\n  pry:\n    tokens:\n      - "+auth.HashToken("s3cr3t")+"\n"), 0644)
+	assert.Nil(t, err)
+
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	users, err := auth.NewStore(dir + "/.users.yml")
+	assert.Nil(t, err)
+	receiver, err := hooks.NewReceiver(&config.Hooks{}, logger)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	auditor, err := audit.New(&config.Audit{File: dir + "/audit.log"}, logger)
+	assert.Nil(t, err)
+	server := httptest.NewServer(NewServer(&config.Http{}, dir, users, receiver, events.NewBus(logger), auditor, logger))
+	defer server.Close()
+
+	get := func(path string, token string) (int, string) {
+		request, err := http.NewRequest("GET", server.URL+path, nil)
+		assert.Nil(t, err)
+		if token != "" {
+			request.SetBasicAuth("pry", token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		assert.Nil(t, err)
+		return response.StatusCode, string(body)
+	}
+
+	status, _ := get("/pry/ruby-pry.git/info/refs?service=git-upload-pack", "")
+	assert.EqualValues(t, status, http.StatusUnauthorized)
+	status, _ = get("/pry/ruby-pry.git/info/refs?service=git-upload-pack", "wrong")
+	assert.EqualValues(t, status, http.StatusUnauthorized)
+	status, _ = get("/rails/rails.git/info/refs?service=git-upload-pack", "s3cr3t")
+	assert.EqualValues(t, status, http.StatusNotFound)
+	status, _ = get("/pry/missing.git/info/refs?service=git-upload-pack", "s3cr3t")
+	assert.EqualValues(t, status, http.StatusNotFound)
+	status, _ = get("/pry/ruby-pry.git/info/refs", "s3cr3t")
+	assert.EqualValues(t, status, http.StatusForbidden)
+	status, body := get("/pry/ruby-pry.git/info/refs?service=git-receive-pack", "s3cr3t")
+	assert.EqualValues(t, status, http.StatusOK)
+	assert.True(t, strings.HasPrefix(body, "001f# service=git-receive-pack\n0000"))
+
+	assert.Nil(t, auditor.Close())
+	content, err := ioutil.ReadFile(dir + "/audit.log")
+	assert.Nil(t, err)
+	var entries []*audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		entry := &audit.Entry{}
+		assert.Nil(t, json.Unmarshal([]byte(line), entry))
+		entries = append(entries, entry)
+	}
+	assert.Len(t, entries, 3)
+	assert.EqualValues(t, entries[0].Action, audit.HttpAuth)
+	assert.EqualValues(t, entries[0].Outcome, audit.Failure)
+	assert.EqualValues(t, entries[0].User, "pry")
+	assert.EqualValues(t, entries[1].Action, audit.HttpGit)
+	assert.EqualValues(t, entries[1].Outcome, audit.Denied)
+	assert.EqualValues(t, entries[1].Repo, "rails/rails")
+	assert.EqualValues(t, entries[2].Repo, "pry/missing")
+}
+
+func TestServeHTTPS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpd-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(dir+"/cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(dir+"/key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	assert.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	httpConfig := &config.Http{ListenHost: "127.0.0.1", ListenPort: int32(port), CertFile: dir + "/cert.pem",
+		KeyFile: dir + "/key.pem"}
+	server := NewServer(httpConfig, dir, nil, nil, events.NewBus(logger), nil, logger)
+	go server.Start()
+	defer server.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	roots.AddCert(certificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	var response *http.Response
+	for i := 0; i < 50; i++ {
+		response, err = client.Get(fmt.Sprintf("https://127.0.0.1:%d/pry/ruby-pry.git/info/refs?service=git-upload-pack", port))
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.NotNil(t, response.TLS)
+	assert.EqualValues(t, response.StatusCode, http.StatusUnauthorized)
+}
@@ -0,0 +1,189 @@
+package lifecycle
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bachue/pages/log_driver"
+)
+
+// Exit statuses of Run
+const (
+	ExitOk = iota
+	// ExitFailure means a service failed or stopped by itself
+	ExitFailure
+	// ExitTimeout means the services did not stop before the shutdown deadline
+	ExitTimeout
+)
+
+type service struct {
+	name  string
+	start func() error
+	stop  func(ctx context.Context) error
+}
+
+type result struct {
+	service *service
+	err     error
+}
+
+// Manager runs the services until SIGINT or SIGTERM is received or one of them stops, then stops
+// them all in the reverse order they were added, within a shared deadline.
+// On SIGUSR2, the services are stopped the same way once the restart callback succeeds.
+// On SIGHUP, the reload callback is called and the services keep running, so are the reopen callbacks
+// on SIGUSR1.
+type Manager struct {
+	Timeout   time.Duration
+	logger    log_driver.Logger
+	services  []*service
+	cleaners  []func()
+	restart   func() error
+	reload    func()
+	reopeners []func()
+	signals   chan os.Signal
+}
+
+func New(timeout time.Duration, logger log_driver.Logger) *Manager {
+	return &Manager{Timeout: timeout, logger: logger, signals: make(chan os.Signal, 1)}
+}
+
+// Add registers a service, start blocks while it is serving and may be nil for services which
+// have nothing to serve but something to stop.
+func (manager *Manager) Add(name string, start func() error, stop func(ctx context.Context) error) {
+	manager.services = append(manager.services, &service{name: name, start: start, stop: stop})
+}
+
+// OnShutdown registers cleaner to be called after all the services are stopped, in the reverse order
+// they were registered.
+func (manager *Manager) OnShutdown(cleaner func()) {
+	manager.cleaners = append(manager.cleaners, cleaner)
+}
+
+// OnRestart registers restart to be called on SIGUSR2, it should start a new process taking over
+// the listeners, so this one only has to drain its connections.
+func (manager *Manager) OnRestart(restart func() error) {
+	manager.restart = restart
+}
+
+// OnReload registers reload to be called on SIGHUP
+func (manager *Manager) OnReload(reload func()) {
+	manager.reload = reload
+}
+
+// OnReopen registers reopen to be called on SIGUSR1 along with the others registered, it should reopen
+// the log files rotated externally
+func (manager *Manager) OnReopen(reopen func()) {
+	manager.reopeners = append(manager.reopeners, reopen)
+}
+
+// Run starts the services, blocks until they should stop, stops them and returns the exit status.
+func (manager *Manager) Run() int {
+	signal.Notify(manager.signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(manager.signals)
+
+	results := make(chan result, len(manager.services))
+	running := 0
+	for _, each := range manager.services {
+		if each.start == nil {
+			continue
+		}
+		running++
+		go func(each *service) {
+			results <- result{service: each, err: each.start()}
+		}(each)
+	}
+
+	status := ExitOk
+	if manager.awaitStop(results) {
+		running--
+		status = ExitFailure
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), manager.Timeout)
+	defer cancel()
+	if manager.stop(ctx) != nil && status == ExitOk {
+		status = ExitTimeout
+	}
+wait:
+	for ; running > 0; running-- {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				manager.logger.Errorf("%s stopped with error %s", result.service.name, result.err)
+				status = ExitFailure
+			}
+		case <-ctx.Done():
+			manager.logger.Errorf("Gave up waiting for %d services to stop", running)
+			if status == ExitOk {
+				status = ExitTimeout
+			}
+			break wait
+		}
+	}
+	for i := len(manager.cleaners) - 1; i >= 0; i-- {
+		manager.cleaners[i]()
+	}
+	return status
+}
+
+// awaitStop blocks until the services should stop, it returns true if that's because one of them stopped.
+func (manager *Manager) awaitStop(results chan result) bool {
+	for {
+		select {
+		case sig := <-manager.signals:
+			if sig == syscall.SIGHUP {
+				if manager.reload != nil {
+					manager.logger.Infof("Received %s, reloading", sig)
+					manager.reload()
+				}
+				continue
+			} else if sig == syscall.SIGUSR1 {
+				for _, reopen := range manager.reopeners {
+					reopen()
+				}
+				manager.logger.Infof("Received %s, reopened", sig)
+				continue
+			} else if sig != syscall.SIGUSR2 {
+				manager.logger.Infof("Received %s, shutting down", sig)
+				return false
+			} else if manager.restart == nil {
+				manager.logger.Infof("Ignored %s since restarting is not supported", sig)
+				continue
+			}
+			err := manager.restart()
+			if err != nil {
+				manager.logger.Errorf("Failed to restart due to %s, keep running", err)
+				continue
+			}
+			manager.logger.Infof("Restarted on %s, draining connections", sig)
+			return false
+		case result := <-results:
+			if result.err != nil {
+				manager.logger.Errorf("Shutting down since %s failed due to %s", result.service.name, result.err)
+			} else {
+				manager.logger.Errorf("Shutting down since %s stopped unexpectedly", result.service.name)
+			}
+			return true
+		}
+	}
+}
+
+func (manager *Manager) stop(ctx context.Context) error {
+	var lastErr error
+	for i := len(manager.services) - 1; i >= 0; i-- {
+		service := manager.services[i]
+		if service.stop == nil {
+			continue
+		}
+		manager.logger.Debugf("Stopping %s", service.name)
+		err := service.stop(ctx)
+		if err != nil {
+			manager.logger.Errorf("Failed to stop %s gracefully due to %s", service.name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,108 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/log_driver"
+	"github.com/stretchr/testify/assert"
+)
+
+func blockingService(stopped chan bool) (func() error, func(ctx context.Context) error) {
+	done := make(chan struct{})
+	return func() error {
+			<-done
+			return nil
+		}, func(ctx context.Context) error {
+			close(done)
+			stopped <- true
+			return nil
+		}
+}
+
+func TestRunStopsOnSignal(t *testing.T) {
+	manager := newTestManager(t, time.Second)
+	var order []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		stopped := make(chan bool, 1)
+		start, stop := blockingService(stopped)
+		manager.Add(name, start, func(ctx context.Context) error {
+			order = append(order, name)
+			return stop(ctx)
+		})
+	}
+	manager.OnShutdown(func() { order = append(order, "cleaner") })
+
+	manager.signals <- syscall.SIGTERM
+	assert.EqualValues(t, manager.Run(), ExitOk)
+	assert.EqualValues(t, order, []string{"second", "first", "cleaner"})
+}
+
+func TestRunRestarts(t *testing.T) {
+	manager := newTestManager(t, time.Second)
+	stopped := make(chan bool, 1)
+	start, stop := blockingService(stopped)
+	manager.Add("sshd", start, stop)
+	restarts := 0
+	manager.OnRestart(func() error {
+		restarts++
+		if restarts == 1 {
+			return fmt.Errorf("No such file or directory")
+		}
+		return nil
+	})
+
+	reloads := 0
+	manager.OnReload(func() { reloads++ })
+	reopens := 0
+	manager.OnReopen(func() { reopens++ })
+
+	// Reloading and reopening keep the services running, so does the first restart which fails
+	manager.signals <- syscall.SIGHUP
+	go func() {
+		manager.signals <- syscall.SIGUSR1
+		manager.signals <- syscall.SIGUSR2
+		time.Sleep(10 * time.Millisecond)
+		manager.signals <- syscall.SIGUSR2
+	}()
+	assert.EqualValues(t, manager.Run(), ExitOk)
+	assert.EqualValues(t, restarts, 2)
+	assert.EqualValues(t, reloads, 1)
+	assert.EqualValues(t, reopens, 1)
+	assert.True(t, <-stopped)
+}
+
+func TestRunStopsOnFailure(t *testing.T) {
+	manager := newTestManager(t, time.Second)
+	stopped := make(chan bool, 1)
+	start, stop := blockingService(stopped)
+	manager.Add("healthy", start, stop)
+	manager.Add("broken", func() error { return fmt.Errorf("Address already in use") }, nil)
+
+	assert.EqualValues(t, manager.Run(), ExitFailure)
+	assert.True(t, <-stopped)
+}
+
+func TestRunTimesOut(t *testing.T) {
+	manager := newTestManager(t, 10*time.Millisecond)
+	manager.Add("stuck", func() error {
+		select {}
+	}, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	manager.signals <- syscall.SIGINT
+	assert.EqualValues(t, manager.Run(), ExitTimeout)
+}
+
+func newTestManager(t *testing.T, timeout time.Duration) *Manager {
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	return New(timeout, logger)
+}
@@ -0,0 +1,187 @@
+package listeners
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvVar passes the inherited listeners to a new process, as `name:fd` pairs separated by commas,
+// e.g. `sshd:3,http:4`.
+const EnvVar = "PAGES_LISTEN_FDS"
+
+// ReadyEnvVar is the fd of the pipe the new process writes to once it has taken over all the listeners
+const ReadyEnvVar = "PAGES_READY_FD"
+
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+var (
+	mutex      sync.Mutex
+	registered = map[string]fileListener{}
+	// taken are the inherited listeners taken over by Listen
+	taken = map[string]bool{}
+)
+
+// Listen returns the listener name inherited from the parent process if there is one,
+// otherwise it listens on addr. Either way, the listener is handed off by Handoff.
+func Listen(name string, addr string) (net.Listener, error) {
+	var listener net.Listener
+	fd, ok, err := inherited(name)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		file := os.NewFile(fd, name)
+		listener, err = net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to inherit listener %s from fd %d: %s", name, fd, err)
+		}
+		mutex.Lock()
+		taken[name] = true
+		mutex.Unlock()
+		defer signalReady()
+	} else {
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if withFile, ok := listener.(fileListener); ok {
+		mutex.Lock()
+		registered[name] = withFile
+		mutex.Unlock()
+	}
+	return listener, nil
+}
+
+// Inherited tells if this process is started by Handoff, taking over from another one
+func Inherited() bool {
+	_, ok := os.LookupEnv(EnvVar)
+	return ok
+}
+
+// Handoff starts a new process running the same executable with the same arguments, passing it all
+// the listeners created by Listen, then waits until the new process has taken over all of them. The
+// new process is killed if it's not ready within timeout. Once it returns successfully, the caller is
+// expected to stop accepting connections.
+func Handoff(timeout time.Duration) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	names := make([]string, 0, len(registered))
+	for name := range registered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*os.File, 0, len(names))
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		file, err := registered[name].File()
+		if err != nil {
+			mutex.Unlock()
+			closeAll(files)
+			return nil, fmt.Errorf("Failed to get the file of listener %s: %s", name, err)
+		}
+		files = append(files, file)
+		// ExtraFiles start from fd 3, after stdin, stdout and stderr
+		pairs = append(pairs, name+":"+strconv.Itoa(3+i))
+	}
+	mutex.Unlock()
+	defer closeAll(files)
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(withoutEnvVars(os.Environ()), EnvVar+"="+strings.Join(pairs, ","),
+		ReadyEnvVar+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	// Closed in this process, so that reading it ends once the new process has exited
+	readyWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return cmd.Process, nil
+	}
+
+	readyReader.SetReadDeadline(time.Now().Add(timeout))
+	n, err := readyReader.Read(make([]byte, 1))
+	if n == 1 {
+		return cmd.Process, nil
+	} else if err == io.EOF {
+		cmd.Wait()
+		return nil, fmt.Errorf("New process %d exited before taking over the listeners", cmd.Process.Pid)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return nil, fmt.Errorf("New process %d did not take over the listeners within %s", cmd.Process.Pid, timeout)
+}
+
+// signalReady tells the parent process once all the listeners it handed off are taken over
+func signalReady() {
+	fd, err := strconv.Atoi(os.Getenv(ReadyEnvVar))
+	if err != nil {
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, pair := range strings.Split(os.Getenv(EnvVar), ",") {
+		if name := strings.SplitN(pair, ":", 2)[0]; name != "" && !taken[name] {
+			return
+		}
+	}
+	os.Unsetenv(ReadyEnvVar)
+	file := os.NewFile(uintptr(fd), "ready")
+	file.Write([]byte{1})
+	file.Close()
+}
+
+func inherited(name string) (uintptr, bool, error) {
+	for _, pair := range strings.Split(os.Getenv(EnvVar), ",") {
+		nameFd := strings.SplitN(pair, ":", 2)
+		if len(nameFd) != 2 || nameFd[0] != name {
+			continue
+		}
+		fd, err := strconv.ParseUint(nameFd[1], 10, 32)
+		if err != nil {
+			return 0, false, fmt.Errorf("Invalid fd `%s` of listener %s in %s", nameFd[1], name, EnvVar)
+		}
+		return uintptr(fd), true, nil
+	}
+	return 0, false, nil
+}
+
+func withoutEnvVars(environ []string) []string {
+	result := make([]string, 0, len(environ))
+	for _, entry := range environ {
+		if !strings.HasPrefix(entry, EnvVar+"=") && !strings.HasPrefix(entry, ReadyEnvVar+"=") {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func closeAll(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,90 @@
+package listeners
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// handoffChild tells the process started by Handoff in the tests how to behave
+const handoffChild = "LISTENERS_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(handoffChild) {
+	case "ready":
+		listener, err := Listen("sshd", "127.0.0.1:0")
+		if err != nil {
+			os.Exit(1)
+		}
+		// Serves until it is killed by the test
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				os.Exit(1)
+			}
+			conn.Close()
+		}
+	case "fail":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestHandoff(t *testing.T) {
+	listener, err := Listen("sshd", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	defer os.Unsetenv(handoffChild)
+
+	os.Setenv(handoffChild, "ready")
+	process, err := Handoff(10 * time.Second)
+	assert.Nil(t, err)
+	process.Kill()
+	process.Wait()
+
+	os.Setenv(handoffChild, "fail")
+	_, err = Handoff(10 * time.Second)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "exited before taking over the listeners")
+
+	os.Setenv(handoffChild, "hang")
+	startedAt := time.Now()
+	_, err = Handoff(500 * time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "did not take over the listeners within 500ms")
+	assert.True(t, time.Since(startedAt) < 5*time.Second)
+}
+
+func TestListenInherited(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer parent.Close()
+	file, err := parent.(*net.TCPListener).File()
+	assert.Nil(t, err)
+	defer file.Close()
+
+	os.Setenv(EnvVar, "http:1000,sshd:"+strconv.Itoa(int(file.Fd())))
+	defer os.Unsetenv(EnvVar)
+	listener, err := Listen("sshd", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	assert.EqualValues(t, listener.Addr().String(), parent.Addr().String())
+	_, ok := registered["sshd"]
+	assert.True(t, ok)
+
+	os.Setenv(EnvVar, "sshd:bad")
+	_, err = Listen("sshd", "127.0.0.1:0")
+	assert.NotNil(t, err)
+	os.Unsetenv(EnvVar)
+	listener, err = Listen("sshd", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	assert.NotEqual(t, listener.Addr().String(), parent.Addr().String())
+}
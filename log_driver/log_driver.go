@@ -1,9 +1,11 @@
 package log_driver
 
 import (
+	"io"
 	"log/syslog"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
@@ -13,8 +15,50 @@ import (
 type Logger interface {
 	Debugf(format string, args ...interface{})
 	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
 	Errorf(format string, args ...interface{})
 	Fatalf(format string, args ...interface{})
+	// WithFields returns a child logger adding fields to every line it logs
+	WithFields(fields Fields) Logger
+	// With returns a child logger adding the field key to every line it logs
+	With(key string, value interface{}) Logger
+}
+
+type Fields map[string]interface{}
+
+// entryLogger is the Logger created by New, its children share its underlying logrus.Logger so that
+// reconfiguring the root logger applies to them as well.
+type entryLogger struct {
+	*logrus.Entry
+}
+
+func (logger *entryLogger) WithFields(fields Fields) Logger {
+	return &entryLogger{logger.Entry.WithFields(logrus.Fields(fields))}
+}
+
+func (logger *entryLogger) With(key string, value interface{}) Logger {
+	return &entryLogger{logger.Entry.WithField(key, value)}
+}
+
+func rootOf(logger Logger) (*logrus.Logger, bool) {
+	entryLogger, ok := logger.(*entryLogger)
+	if !ok {
+		return nil, false
+	}
+	return entryLogger.Entry.Logger, true
+}
+
+var (
+	filesMutex sync.Mutex
+	// files are the log files the root loggers write into
+	files = map[*logrus.Logger]*logFile{}
+	// syslogs are the syslog hooks of the root loggers, guarded by filesMutex as well
+	syslogs = map[*logrus.Logger]*syslogHook{}
+)
+
+type syslogHook struct {
+	config conf.Syslog
+	*logrus_syslog.SyslogHook
 }
 
 var levels = map[string]logrus.Level{
@@ -38,27 +82,118 @@ var syslogLevels = map[string]syslog.Priority{
 }
 
 func New(config *conf.Log) (Logger, error) {
-	logger := logrus.New()
+	logger := &entryLogger{logrus.NewEntry(logrus.New())}
+	err := Reconfigure(logger, config)
+	if err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+// Reconfigure applies config to logger created by New and all its children, the log file is opened
+// again and the syslog hook replaced unless its config is unchanged. logger is kept unchanged if it fails.
+func Reconfigure(logger Logger, config *conf.Log) error {
+	logrusLogger, ok := rootOf(logger)
+	if !ok {
+		return nil
+	}
+	var out io.Writer
 	if strings.ToLower(config.Local) == "stderr" {
-		logger.Out = os.Stderr
+		out = os.Stderr
 	} else if strings.ToLower(config.Local) == "stdout" {
-		logger.Out = os.Stdout
+		out = os.Stdout
 	} else {
-		file, err := os.OpenFile(config.Local, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		file, err := openLogFile(config.Local, config.Rotation)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		logger.Out = file
+		out = file
 	}
-	logger.Level = levels[config.Level]
 
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	hooks := logrus.LevelHooks{}
+	previousHook := syslogs[logrusLogger]
+	var hook *syslogHook
 	if config.Syslog.Protocol != "" {
-		level := syslogLevels[config.Syslog.Level]
-		hook, err := logrus_syslog.NewSyslogHook(config.Syslog.Protocol, config.Syslog.Host, level, config.Syslog.Tag)
-		if err != nil {
-			return nil, err
+		if previousHook != nil && previousHook.config == config.Syslog {
+			// Kept as is, so the connection to syslog isn't opened again on every reload
+			hook = previousHook
+		} else {
+			level := syslogLevels[config.Syslog.Level]
+			newHook, err := logrus_syslog.NewSyslogHook(config.Syslog.Protocol, config.Syslog.Host, level,
+				config.Syslog.Tag)
+			if err != nil {
+				if file, ok := out.(*logFile); ok {
+					file.Close()
+				}
+				return err
+			}
+			hook = &syslogHook{config: config.Syslog, SyslogHook: newHook}
 		}
-		logger.Hooks.Add(hook)
+		hooks.Add(hook.SyslogHook)
 	}
-	return logger, nil
+
+	previous := files[logrusLogger]
+	if file, ok := out.(*logFile); ok && previous != nil && previous.path == file.path {
+		// The same file, which keeps its age so that reloading doesn't put off the rotation
+		file.startedAt = previous.startedTime()
+	}
+	// Swapped under the lock of logrus, so no line is being written into the previous file afterwards
+	logrusLogger.SetOutput(out)
+	logrusLogger.ReplaceHooks(hooks)
+	logrusLogger.SetLevel(levels[config.Level])
+	if config.Format == "json" {
+		logrusLogger.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrusLogger.SetFormatter(&logrus.TextFormatter{})
+	}
+	if file, ok := out.(*logFile); ok {
+		files[logrusLogger] = file
+	} else {
+		delete(files, logrusLogger)
+	}
+	if previous != nil {
+		previous.Close()
+	}
+	if hook != nil {
+		syslogs[logrusLogger] = hook
+	} else {
+		delete(syslogs, logrusLogger)
+	}
+	if previousHook != nil && previousHook != hook {
+		previousHook.Writer.Close()
+	}
+	return nil
+}
+
+// Reopen opens the log file of logger again, after it's moved by an external rotation. The syslog
+// hook is kept as is.
+func Reopen(logger Logger) error {
+	if logrusLogger, ok := rootOf(logger); ok {
+		filesMutex.Lock()
+		defer filesMutex.Unlock()
+		if file, ok := files[logrusLogger]; ok {
+			return file.Reopen()
+		}
+	}
+	return nil
+}
+
+// Flush syncs and closes the log file of logger, if it logs into a file.
+func Flush(logger Logger) error {
+	if logrusLogger, ok := rootOf(logger); ok {
+		filesMutex.Lock()
+		defer filesMutex.Unlock()
+		if file, ok := files[logrusLogger]; ok {
+			logrusLogger.SetOutput(os.Stderr)
+			delete(files, logrusLogger)
+			err := file.Sync()
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}
+	}
+	return nil
 }
@@ -1,8 +1,17 @@
 package log_driver
 
 import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/bachue/pages/config"
@@ -13,9 +22,220 @@ func TestNewLoggerWithoutSyslog(t *testing.T) {
 	logConfig := &config.Log{Local: "STDOUT", Level: "WARN"}
 	loggerInterface, err := New(logConfig)
 	assert.Nil(t, err)
-	logger, ok := loggerInterface.(*logrus.Logger)
+	logger, ok := rootOf(loggerInterface)
 	assert.True(t, ok)
 	assert.Equal(t, logger.Out, os.Stdout)
 	assert.Equal(t, logger.Level, logrus.WarnLevel)
 	assert.Empty(t, logger.Hooks)
 }
+
+func TestReconfigure(t *testing.T) {
+	loggerInterface, err := New(&config.Log{Local: "STDOUT", Level: "WARN"})
+	assert.Nil(t, err)
+	file, err := ioutil.TempFile("", "log")
+	assert.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	err = Reconfigure(loggerInterface, &config.Log{Local: file.Name(), Level: "DEBUG"})
+	assert.Nil(t, err)
+	logger, _ := rootOf(loggerInterface)
+	assert.Equal(t, logger.Level, logrus.DebugLevel)
+	loggerInterface.Debugf("Reconfigured")
+	content, err := ioutil.ReadFile(file.Name())
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "Reconfigured")
+
+	err = Reconfigure(loggerInterface, &config.Log{Local: "/nonexistent/dir/log", Level: "INFO"})
+	assert.NotNil(t, err)
+	assert.Equal(t, logger.Level, logrus.DebugLevel)
+}
+
+func TestWithFields(t *testing.T) {
+	file, err := ioutil.TempFile("", "log")
+	assert.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+	logger, err := New(&config.Log{Local: file.Name(), Level: "INFO", Format: "json"})
+	assert.Nil(t, err)
+
+	child := logger.WithFields(Fields{"remote": "127.0.0.1:2222", "user": "pry"}).With("repo", "pry/ruby-pry")
+	child.Warnf("Rejected %s", "git-receive-pack")
+	child.Debugf("Filtered")
+	err = Reconfigure(logger, &config.Log{Local: file.Name(), Level: "DEBUG", Format: "json"})
+	assert.Nil(t, err)
+	child.Debugf("Not filtered")
+	assert.Nil(t, Flush(logger))
+
+	content, err := ioutil.ReadFile(file.Name())
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 2)
+	var line map[string]string
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &line))
+	assert.EqualValues(t, line["msg"], "Rejected git-receive-pack")
+	assert.EqualValues(t, line["level"], "warning")
+	assert.EqualValues(t, line["remote"], "127.0.0.1:2222")
+	assert.EqualValues(t, line["user"], "pry")
+	assert.EqualValues(t, line["repo"], "pry/ruby-pry")
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &line))
+	assert.EqualValues(t, line["msg"], "Not filtered")
+}
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/pages.log"
+
+	file, err := openLogFile(path, config.Rotation{MaxSize: 1, Compress: true, MaxBackups: 2})
+	assert.Nil(t, err)
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	for i := 0; i < 4*1024+1; i++ {
+		_, err = file.Write(line)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, file.Close())
+
+	backups, err := filepath.Glob(path + ".*")
+	assert.Nil(t, err)
+	assert.Len(t, backups, 2)
+	for _, backup := range backups {
+		assert.True(t, strings.HasSuffix(backup, ".gz"))
+		reader, err := os.Open(backup)
+		assert.Nil(t, err)
+		unzipped, err := gzip.NewReader(reader)
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(unzipped)
+		assert.Nil(t, err)
+		reader.Close()
+		assert.Len(t, content, 1024*1024)
+	}
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.EqualValues(t, info.Size(), 1024)
+}
+
+func TestReconfigureSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	syslogConfig := config.Syslog{Protocol: "udp", Host: conn.LocalAddr().String(), Level: "INFO", Tag: "pages"}
+	loggerInterface, err := New(&config.Log{Local: "STDOUT", Level: "INFO", Syslog: syslogConfig})
+	assert.Nil(t, err)
+	logger, _ := rootOf(loggerInterface)
+	hook := syslogs[logger]
+	assert.NotNil(t, hook)
+	assert.Len(t, logger.Hooks[logrus.InfoLevel], 1)
+
+	err = Reconfigure(loggerInterface, &config.Log{Local: "STDOUT", Level: "DEBUG", Syslog: syslogConfig})
+	assert.Nil(t, err)
+	assert.True(t, syslogs[logger] == hook)
+	assert.True(t, logger.Hooks[logrus.InfoLevel][0] == hook.SyslogHook)
+
+	syslogConfig.Tag = "pages-reloaded"
+	err = Reconfigure(loggerInterface, &config.Log{Local: "STDOUT", Level: "DEBUG", Syslog: syslogConfig})
+	assert.Nil(t, err)
+	assert.False(t, syslogs[logger] == hook)
+	assert.Len(t, logger.Hooks[logrus.InfoLevel], 1)
+
+	err = Reconfigure(loggerInterface, &config.Log{Local: "STDOUT", Level: "DEBUG"})
+	assert.Nil(t, err)
+	assert.Nil(t, syslogs[logger])
+	assert.Empty(t, logger.Hooks)
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/pages.log"
+	logger, err := New(&config.Log{Local: path, Level: "INFO"})
+	assert.Nil(t, err)
+
+	logger.Infof("Before rotation")
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.Nil(t, Reopen(logger))
+	logger.Infof("After rotation")
+	assert.Nil(t, Flush(logger))
+
+	content, err := ioutil.ReadFile(path + ".1")
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "Before rotation")
+	assert.NotContains(t, string(content), "After rotation")
+	content, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "After rotation")
+}
+
+func TestReconfigureWhileLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logger, err := New(&config.Log{Local: dir + "/0.log", Level: "INFO"})
+	assert.Nil(t, err)
+
+	var writers sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					logger.Infof("Logging")
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 20; i++ {
+		format := "text"
+		if i%2 == 1 {
+			format = "json"
+		}
+		err := Reconfigure(logger, &config.Log{Local: fmt.Sprintf("%s/%d.log", dir, i), Level: "INFO", Format: format})
+		assert.Nil(t, err)
+	}
+	close(stop)
+	writers.Wait()
+	assert.Nil(t, Flush(logger))
+
+	// Every line is written whole into one of the files, none is lost into a closed file
+	for i := 0; i <= 20; i++ {
+		content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d.log", dir, i))
+		assert.Nil(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			if line != "" {
+				assert.True(t, strings.Contains(line, `"msg":"Logging"`) || strings.Contains(line, "msg=Logging"), line)
+			}
+		}
+	}
+}
+
+func TestRotateByInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/pages.log"
+	assert.Nil(t, ioutil.WriteFile(path, []byte("Before rotation\n"), 0644))
+	rotatedAt := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, ioutil.WriteFile(path+"."+rotatedAt.Format(backupTimeFormat), nil, 0644))
+
+	// Reloading keeps the age of the file, which is counted from the last rotation
+	logger, err := New(&config.Log{Local: path, Level: "INFO", Rotation: config.Rotation{Interval: 3}})
+	assert.Nil(t, err)
+	root, _ := rootOf(logger)
+	assert.EqualValues(t, files[root].startedAt.Format(backupTimeFormat), rotatedAt.Format(backupTimeFormat))
+	files[root].startedAt = rotatedAt.Add(-2 * time.Hour)
+	assert.Nil(t, Reconfigure(logger, &config.Log{Local: path, Level: "INFO", Rotation: config.Rotation{Interval: 3}}))
+	logger.Infof("After rotation")
+	assert.Nil(t, Flush(logger))
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(content), "Before rotation")
+	assert.Contains(t, string(content), "After rotation")
+}
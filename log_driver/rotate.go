@@ -0,0 +1,231 @@
+package log_driver
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/bachue/pages/config"
+)
+
+const backupTimeFormat = "20060102T150405.000"
+
+// logFile is a log file rotated by its size and age, which can also be reopened after it's rotated
+// by another program, such as logrotate.
+type logFile struct {
+	path     string
+	rotation conf.Rotation
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	// startedAt is when the current file was started, by the last rotation if any
+	startedAt time.Time
+	cleaning  sync.WaitGroup
+	// cleanMutex serializes the cleanings, so that one doesn't remove the file another is compressing
+	cleanMutex sync.Mutex
+}
+
+func openLogFile(path string, rotation conf.Rotation) (*logFile, error) {
+	logFile := &logFile{path: path, rotation: rotation}
+	err := logFile.open()
+	if err != nil {
+		return nil, err
+	}
+	// Aged from the last rotation rather than from now, so that restarting doesn't put off the rotation
+	if rotatedAt, ok := lastRotation(path); ok {
+		logFile.startedAt = rotatedAt
+	}
+	return logFile, nil
+}
+
+// lastRotation returns the time path was rotated the last time, told by the suffix of the newest
+// rotated file
+func lastRotation(path string) (time.Time, bool) {
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return time.Time{}, false
+	}
+	var last time.Time
+	for _, backup := range backups {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(backup, path+"."), ".gz")
+		rotatedAt, err := time.ParseInLocation(backupTimeFormat, suffix, time.Local)
+		if err == nil && rotatedAt.After(last) {
+			last = rotatedAt
+		}
+	}
+	return last, !last.IsZero()
+}
+
+func (logFile *logFile) open() error {
+	file, err := os.OpenFile(logFile.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	logFile.file = file
+	logFile.size = info.Size()
+	logFile.startedAt = time.Now()
+	return nil
+}
+
+func (logFile *logFile) Write(content []byte) (int, error) {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+	if logFile.shouldRotate(len(content)) {
+		err := logFile.rotate()
+		if err != nil {
+			// Not able to log about the logger, keep writing into the current file
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s due to %s\n", logFile.path, err)
+		}
+	}
+	written, err := logFile.file.Write(content)
+	logFile.size += int64(written)
+	return written, err
+}
+
+func (logFile *logFile) shouldRotate(length int) bool {
+	if logFile.size == 0 {
+		return false
+	}
+	rotation := logFile.rotation
+	if rotation.MaxSize > 0 && logFile.size+int64(length) > int64(rotation.MaxSize)*1024*1024 {
+		return true
+	}
+	return rotation.Interval > 0 && time.Since(logFile.startedAt) >= time.Duration(rotation.Interval)*time.Hour
+}
+
+// rotate renames the current file with the time as suffix, then cleans the rotated files in background
+func (logFile *logFile) rotate() error {
+	backup := logFile.path + "." + time.Now().Format(backupTimeFormat)
+	err := os.Rename(logFile.path, backup)
+	if err != nil {
+		return err
+	}
+	previous := logFile.file
+	err = logFile.open()
+	if err != nil {
+		// Keep writing into the renamed file rather than losing the logs
+		return err
+	}
+	previous.Close()
+	logFile.cleaning.Add(1)
+	go func() {
+		defer logFile.cleaning.Done()
+		err := logFile.clean(backup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to clean rotated log files of %s due to %s\n", logFile.path, err)
+		}
+	}()
+	return nil
+}
+
+// clean compresses backup if needed, then removes the rotated files beyond the retention
+func (logFile *logFile) clean(backup string) error {
+	logFile.cleanMutex.Lock()
+	defer logFile.cleanMutex.Unlock()
+	if logFile.rotation.Compress {
+		err := compress(backup)
+		if os.IsNotExist(err) {
+			// Removed already by a previous cleaning, beyond the retention
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	backups, err := filepath.Glob(logFile.path + ".*")
+	if err != nil {
+		return err
+	}
+	prefix := logFile.path + "."
+	var rotated []string
+	for _, backup := range backups {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(backup, prefix), ".gz")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+	// Newest first, since the suffix sorts by time
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	for i, backup := range rotated {
+		expired := false
+		if logFile.rotation.MaxAge > 0 {
+			info, err := os.Stat(backup)
+			expired = err == nil && time.Since(info.ModTime()) > time.Duration(logFile.rotation.MaxAge)*24*time.Hour
+		}
+		if expired || (logFile.rotation.MaxBackups > 0 && i >= logFile.rotation.MaxBackups) {
+			err := os.Remove(backup)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func compress(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(target)
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// startedTime returns when the current file was started
+func (logFile *logFile) startedTime() time.Time {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+	return logFile.startedAt
+}
+
+// Reopen closes the file and opens its path again, it's kept open if that fails
+func (logFile *logFile) Reopen() error {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+	previous := logFile.file
+	err := logFile.open()
+	if err != nil {
+		return err
+	}
+	return previous.Close()
+}
+
+func (logFile *logFile) Sync() error {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+	return logFile.file.Sync()
+}
+
+// Close closes the file once the rotated files are cleaned
+func (logFile *logFile) Close() error {
+	logFile.cleaning.Wait()
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+	return logFile.file.Close()
+}
@@ -1,17 +1,86 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
-	"sync"
+	"os"
+	"strings"
 
 	"github.com/bachue/pages/config"
-	"github.com/bachue/pages/gitfuse"
 	"github.com/bachue/pages/log_driver"
-	"github.com/bachue/pages/sshd"
 )
 
+// version is set at build time by `-ldflags "-X main.version=..."`
+var version = "dev"
+
+type command struct {
+	name        string
+	args        string
+	description string
+	run         func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"serve", "[-components sshd,fuse,http]", "Serve git over SSH and HTTP, and mount GitFs (the default command)", serve},
+		{"mount", "<path>", "Mount GitFs at path only", mount},
+		{"config check", "", "Validate every environment of the config file", checkConfig},
+		{"config dump", "", "Print the current environment of the config, with secrets redacted", dumpConfig},
+		{"repo create", "<user>/<repo>", "Create a repository", createRepo},
+		{"repo list", "[<user>]", "List the repositories, of user only if given", listRepos},
+		{"repo delete", "<user>/<repo>", "Delete a repository", deleteRepo},
+		{"user add-key", "<user> <public key file or - for stdin>", "Authorize an SSH public key for user", addKey},
+		{"deploy-key add", "[-write] <user>/<repo> <public key file or - for stdin>",
+			"Authorize an SSH public key for a repository only, to push as well with -write", addDeployKey},
+		{"deploy-key list", "<user>/<repo>", "List the deploy keys of a repository", listDeployKeys},
+		{"deploy-key revoke", "<user>/<repo> <fingerprint>", "Revoke a deploy key of a repository", revokeDeployKey},
+		{"publish", "<user>/<repo>", "Publish the head of the publish branch of a repository", publishRepo},
+		{"version", "", "Print the version", printVersion},
+	}
+}
+
 func main() {
-	// TODO: Usage
+	config.RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	command, rest := findCommand(args)
+	if command == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command `%s`\n\n", strings.Join(args, " "))
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(command.run(rest))
+}
+
+// findCommand returns the command named by the leading words of args, and the rest of args
+func findCommand(args []string) (*command, []string) {
+	for _, command := range commands {
+		words := strings.Fields(command.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == command.name {
+			return command, args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [args]\n\nCommands:\n", os.Args[0])
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-52s %s\n", strings.TrimSpace(command.name+" "+command.args), command.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags override the config file, see PAGES_ENV and PAGES_CONFIG to select it:\n")
+	flag.PrintDefaults()
+}
+
+// loadConfig loads the config and creates the logger, or exits on failure
+func loadConfig() log_driver.Logger {
 	err := config.Load()
 	if err != nil {
 		log.Fatalf("Failed to load config: %s", err)
@@ -20,30 +89,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create logger: %s", err)
 	}
+	return logger
+}
 
-	var waitgroup sync.WaitGroup
-	waitgroup.Add(2)
-
-	go func() {
-		sshdServer, err := sshd.NewServer(&config.Current.Sshd, logger)
-		if err != nil {
-			logger.Fatalf("Failed to create SSHD server: %s", err)
-		}
-		err = sshdServer.Start()
-		if err != nil {
-			logger.Fatalf("Failed to start SSHD server: %s", err)
-		}
-		waitgroup.Done()
-	}()
-
-	go func() {
-		gitfs, err := gitfuse.New(&config.Current.Fuse, logger)
-		if err != nil {
-			logger.Fatalf("Failed to start GitFS: %s", err)
-		}
-		gitfs.Start()
-		waitgroup.Done()
-	}()
-
-	waitgroup.Wait()
+func printVersion(args []string) int {
+	fmt.Printf("pages %s\n", version)
+	return 0
 }
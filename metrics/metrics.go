@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pages"
+
+// Registry holds every metric of Pages, besides those of the Go runtime and the process
+var Registry = prometheus.NewRegistry()
+
+var (
+	SshConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "sshd", Name: "connections",
+		Help: "Number of active SSH connections.",
+	})
+	SshRejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "sshd", Name: "rejected_connections_total",
+		Help: "Number of SSH connections rejected, by reason.",
+	}, []string{"reason"})
+	SshAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "sshd", Name: "auth_failures_total",
+		Help: "Number of failed SSH authentication attempts, by method.",
+	}, []string{"method"})
+	SshBans = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "sshd", Name: "bans_total",
+		Help: "Number of source IPs banned due to repeated authentication failures.",
+	})
+	SshCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "sshd", Name: "command_duration_seconds",
+		Help:    "Duration of the commands executed over SSH, by command.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	}, []string{"command"})
+
+	FuseOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "fuse", Name: "operations_total",
+		Help: "Number of FUSE operations, by operation and status.",
+	}, []string{"operation", "status"})
+	FuseOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "fuse", Name: "operation_duration_seconds",
+		Help:    "Latency of FUSE operations, by operation.",
+		Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+	}, []string{"operation"})
+
+	CacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "hits_total",
+		Help: "Number of lookups of Git repositories found in the object cache.",
+	})
+	CacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "misses_total",
+		Help: "Number of lookups of Git repositories not found in the object cache.",
+	})
+	CacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "evictions_total",
+		Help: "Number of entries removed from the object cache.",
+	})
+
+	PublishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "publish", Name: "duration_seconds",
+		Help:    "Duration of successful publishes.",
+		Buckets: []float64{0.5, 1, 5, 10, 30, 60, 300, 600},
+	})
+	PublishBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "publish", Name: "bytes_total",
+		Help: "Number of bytes uploaded by publishes.",
+	})
+	PublishFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "publish", Name: "failures_total",
+		Help: "Number of failed publishes.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		SshConnections, SshRejectedConnections, SshAuthFailures, SshBans, SshCommandDuration,
+		FuseOperations, FuseOperationDuration,
+		CacheHits, CacheMisses, CacheEvictions,
+		PublishDuration, PublishBytes, PublishFailures,
+	)
+}
+
+// ObserveSince observes the seconds elapsed since start, it's meant to be deferred
+func ObserveSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the metrics of Registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,61 @@
+package publish
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/repos"
+)
+
+const historyFile = "history.log"
+
+// recordHistory appends the outcome of every publish to `pages/history.log` of its repository.
+func (publisher *Publisher) recordHistory(event *events.Event) {
+	if event.Type != events.PublishSucceeded && event.Type != events.PublishFailed {
+		return
+	}
+	repo, err := publisher.openRepo(event.Repo)
+	if err != nil {
+		publisher.logger.Errorf("Failed to record history of %s: %s", event.Repo, err)
+		return
+	}
+	line, err := json.Marshal(event)
+	if err == nil {
+		err = repo.AppendLog(historyFile, line)
+	}
+	if err != nil {
+		publisher.logger.Errorf("Failed to record history of %s due to %s", event.Repo, err)
+	}
+}
+
+// History returns the latest limit outcomes of publishing repo, the newest first.
+func History(repo *repos.Repo, limit int) ([]*events.Event, error) {
+	history := []*events.Event{}
+	file, err := os.Open(repo.StateDir() + "/" + historyFile)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := &events.Event{}
+		if json.Unmarshal(scanner.Bytes(), event) != nil {
+			continue
+		}
+		history = append(history, event)
+		if limit > 0 && len(history) > limit {
+			history = history[1:]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
+}
@@ -0,0 +1,590 @@
+package publish
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	conf "github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/metrics"
+	"github.com/bachue/pages/repos"
+	"github.com/bachue/pages/storage"
+)
+
+type Result struct {
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Publisher uploads the tree of the publish branch to the storage each time the branch is pushed.
+type Publisher struct {
+	GitRepoDir string
+	Bucket     string
+	Url        string
+	build      conf.Build
+	builds     chan struct{}
+	storage    storage.Storage
+	bus        *events.Bus
+	logger     log_driver.Logger
+	mutex      sync.Mutex
+	repoLocks  map[string]*sync.Mutex
+	running    sync.WaitGroup
+}
+
+func New(config *conf.Storage, buildConfig *conf.Build, gitRepoDir string, bus *events.Bus,
+	logger log_driver.Logger) (*Publisher, error) {
+	store, err := storage.New(config)
+	if err != nil {
+		logger.Errorf("Failed to initialize storage due to %s", err)
+		return nil, err
+	}
+	return &Publisher{GitRepoDir: gitRepoDir, Bucket: config.Bucket, Url: config.Url, build: *buildConfig,
+		builds: make(chan struct{}, buildConfig.Workers), storage: store, bus: bus, logger: logger, repoLocks: map[string]*sync.Mutex{}}, nil
+}
+
+// Subscribe makes publisher publish every push to a publish branch, and record the history of publishing
+func (publisher *Publisher) Subscribe() {
+	publisher.bus.Subscribe(publisher.onPush)
+	publisher.bus.Subscribe(publisher.recordHistory)
+}
+
+func (publisher *Publisher) onPush(event *events.Event) {
+	if event.Type != events.Push || event.NewSha == repos.ZeroSha || !strings.HasPrefix(event.Ref, "refs/heads/") {
+		return
+	}
+	repo, err := publisher.openRepo(event.Repo)
+	if err != nil {
+		publisher.logger.Errorf("Failed to publish %s: %s", event.Repo, err)
+		return
+	}
+	manifest, err := repo.Manifest(event.NewSha)
+	if err != nil {
+		publisher.logger.Errorf("Failed to read manifest of %s at %s due to %s", event.Repo, event.NewSha, err)
+		return
+	} else if !manifest.PublishesRef(event.Ref) {
+		return
+	}
+	publisher.publishInBackground(event)
+}
+
+// Publish uploads the tree of event.NewSha of event.Repo, emitting the `publish.*` events on the way.
+func (publisher *Publisher) Publish(event *events.Event) (*Result, error) {
+	lock := publisher.repoLock(event.Repo)
+	lock.Lock()
+	defer lock.Unlock()
+
+	publisher.bus.Emit(event.Derive(events.PublishStarted))
+	result, err := publisher.publish(event.Repo, event.NewSha)
+	if err != nil {
+		publisher.logger.Errorf("Failed to publish %s at %s due to %s", event.Repo, event.NewSha, err)
+		failed := event.Derive(events.PublishFailed)
+		failed.Error = err.Error()
+		publisher.bus.Emit(failed)
+		metrics.PublishFailures.Inc()
+		return nil, err
+	}
+	metrics.PublishDuration.Observe(result.Duration.Seconds())
+	metrics.PublishBytes.Add(float64(result.Bytes))
+	publisher.logger.Infof("Published %s at %s: %d files, %d bytes in %s",
+		event.Repo, event.NewSha, result.Files, result.Bytes, result.Duration)
+	publisher.bus.Emit(event.Derive(events.PublishSucceeded))
+	return result, nil
+}
+
+// Republish publishes the current head of the publish branch of repoName again in the background,
+// it returns the push event the publish is about.
+func (publisher *Publisher) Republish(repoName string, pusher string) (*events.Event, error) {
+	event, err := publisher.HeadEvent(repoName, pusher)
+	if err != nil {
+		return nil, err
+	}
+	publisher.publishInBackground(event)
+	return event, nil
+}
+
+// HeadEvent returns a push event of the current head of the publish branch of repoName, as if
+// pusher just pushed it, so it can be published again.
+func (publisher *Publisher) HeadEvent(repoName string, pusher string) (*events.Event, error) {
+	repo, err := publisher.openRepo(repoName)
+	if err != nil {
+		return nil, err
+	}
+	ref, sha, err := findPublishRef(repo)
+	if err != nil {
+		return nil, err
+	} else if ref == "" {
+		return nil, fmt.Errorf("Repository %s has no publish branch", repoName)
+	}
+	return &events.Event{Id: events.NewId(), Type: events.Push, Repo: repoName, Ref: ref,
+		OldSha: sha, NewSha: sha, Pusher: pusher, Time: time.Now()}, nil
+}
+
+// Rollback publishes the commit sha of repoName again in the background, which must have been published
+// successfully before. sha may be abbreviated to 7 characters at least. It returns the push event the
+// publish is about.
+func (publisher *Publisher) Rollback(repoName string, sha string, pusher string) (*events.Event, error) {
+	repo, err := publisher.openRepo(repoName)
+	if err != nil {
+		return nil, err
+	}
+	history, err := History(repo, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, published := range history {
+		if published.Type == events.PublishSucceeded && len(sha) >= 7 && strings.HasPrefix(published.NewSha, sha) {
+			event := &events.Event{Id: events.NewId(), Type: events.Push, Repo: repoName, Ref: published.Ref,
+				OldSha: published.NewSha, NewSha: published.NewSha, Pusher: pusher, Time: time.Now()}
+			publisher.publishInBackground(event)
+			return event, nil
+		}
+	}
+	return nil, fmt.Errorf("Commit %s of %s was never published", sha, repoName)
+}
+
+func (publisher *Publisher) publishInBackground(event *events.Event) {
+	publisher.running.Add(1)
+	go func() {
+		defer publisher.running.Done()
+		publisher.Publish(event)
+	}()
+}
+
+// Shutdown waits for the publishes in background to finish until ctx is done.
+func (publisher *Publisher) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		publisher.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reconfigure switches to the storage of config, the publishes in progress finish with the previous one.
+func (publisher *Publisher) Reconfigure(config *conf.Storage) error {
+	store, err := storage.New(config)
+	if err != nil {
+		publisher.logger.Errorf("Failed to initialize storage due to %s", err)
+		return err
+	}
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	publisher.storage = store
+	publisher.Bucket = config.Bucket
+	publisher.Url = config.Url
+	return nil
+}
+
+// SiteUrl returns the URL of the site published from repoName, which is its custom domain if set.
+// It's "" if unknown since `storage.url` is not set or the site is published to a bucket of its own.
+func (publisher *Publisher) SiteUrl(repoName string) string {
+	repo, err := publisher.openRepo(repoName)
+	if err != nil {
+		return ""
+	}
+	if domain, err := repo.Domain(); err == nil && domain != "" {
+		return "https://" + domain + "/"
+	}
+	publisher.mutex.Lock()
+	baseUrl, bucket := publisher.Url, publisher.Bucket
+	publisher.mutex.Unlock()
+	if baseUrl == "" {
+		return ""
+	}
+	manifest := &conf.Manifest{}
+	if _, sha, err := findPublishRef(repo); err == nil && sha != "" {
+		if found, err := repo.Manifest(sha); err == nil {
+			manifest = found
+		}
+	}
+	if manifest.Storage.Bucket != "" && manifest.Storage.Bucket != bucket {
+		return ""
+	}
+	return strings.TrimSuffix(baseUrl, "/") + "/" + keyPrefix(repoName, manifest)
+}
+
+// Ping tells if the storage published to is reachable
+func (publisher *Publisher) Ping() error {
+	store, _ := publisher.currentStorage()
+	return store.Ping()
+}
+
+func (publisher *Publisher) currentStorage() (storage.Storage, string) {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	return publisher.storage, publisher.Bucket
+}
+
+func (publisher *Publisher) publish(repoName string, sha string) (*Result, error) {
+	startedAt := time.Now()
+	repo, err := publisher.openRepo(repoName)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := repo.Manifest(sha)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "pages-publish")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	err = export(repo, sha, dir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Build != "" {
+		publisher.builds <- struct{}{}
+		err = build(manifest.Build, dir, &publisher.build)
+		<-publisher.builds
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The build may have replaced any directory on the way to the source by a symbolic link
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	sourceDir, err := resolveWithin(root, filepath.Join(root, filepath.FromSlash(manifest.Source)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Source `%s` is not found", manifest.Source)
+	} else if err != nil {
+		return nil, fmt.Errorf("Source `%s` is outside of the repository", manifest.Source)
+	}
+
+	store, bucket := publisher.currentStorage()
+	if manifest.Storage.Bucket != "" {
+		bucket = manifest.Storage.Bucket
+	}
+	result, err := upload(store, manifest, root, sourceDir, bucket, keyPrefix(repoName, manifest))
+	if err != nil {
+		return nil, err
+	}
+	result.Duration = time.Since(startedAt)
+	return result, nil
+}
+
+// keyPrefix is prepended to the keys of the files published from repoName. Keys are always namespaced
+// by the repository, so no site could overwrite another one.
+func keyPrefix(repoName string, manifest *conf.Manifest) string {
+	prefix := repoName + "/"
+	if manifest.Storage.Prefix != "" {
+		prefix += strings.TrimSuffix(manifest.Storage.Prefix, "/") + "/"
+	}
+	return prefix
+}
+
+// upload uploads the files in sourceDir, skipping those resolved out of root
+func upload(store storage.Storage, manifest *conf.Manifest, root string, sourceDir string, bucket string,
+	prefix string) (*Result, error) {
+	info, err := os.Stat(sourceDir)
+	if err != nil {
+		return nil, fmt.Errorf("Source `%s` is not found", manifest.Source)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("Source `%s` is not a directory", manifest.Source)
+	}
+	result := &Result{}
+	uploaded := map[string]bool{}
+	err = filepath.Walk(sourceDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(file, sourceDir+string(filepath.Separator)))
+		if name == conf.ManifestFile || isIgnored(manifest, name) {
+			return nil
+		}
+		resolved, err := resolveWithin(root, file)
+		if err != nil {
+			return nil
+		}
+		content, err := os.Open(resolved)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		err = store.Put(bucket, prefix+name, content, headersOf(manifest, name))
+		if err != nil {
+			return fmt.Errorf("Failed to upload %s: %s", name, err)
+		}
+		uploaded[prefix+name] = true
+		result.Files++
+		result.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := store.List(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if !uploaded[key] {
+			err = store.Delete(bucket, key)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to delete stale %s: %s", key, err)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (publisher *Publisher) openRepo(repoName string) (*repos.Repo, error) {
+	user, repo, err := repos.Split(repoName)
+	if err != nil {
+		return nil, err
+	}
+	return repos.Open(repos.Path(publisher.GitRepoDir, user, repo)), nil
+}
+
+func (publisher *Publisher) repoLock(repoName string) *sync.Mutex {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	lock, ok := publisher.repoLocks[repoName]
+	if !ok {
+		lock = &sync.Mutex{}
+		publisher.repoLocks[repoName] = lock
+	}
+	return lock
+}
+
+// findPublishRef returns the branch whose manifest publishes itself with its head, `master` is preferred
+// if several do. ref is "" if there is no such branch.
+func findPublishRef(repo *repos.Repo) (ref string, sha string, err error) {
+	branches, err := repo.Branches()
+	if err != nil {
+		return "", "", err
+	}
+	sort.SliceStable(branches, func(i, j int) bool {
+		return branches[i] == "refs/heads/master" && branches[j] != "refs/heads/master"
+	})
+	for _, branch := range branches {
+		sha, err := repo.ResolveRef(branch)
+		if err != nil {
+			return "", "", err
+		} else if sha == "" {
+			continue
+		}
+		manifest, err := repo.Manifest(sha)
+		if err != nil {
+			continue
+		}
+		if manifest.PublishesRef(branch) {
+			return branch, sha, nil
+		}
+	}
+	return "", "", nil
+}
+
+// export writes the tree of commit sha into dir, symbolic links are left out since they could point
+// anywhere on the server.
+func export(repo *repos.Repo, sha string, dir string) error {
+	cmd := repo.Command("archive", "--format=tar", sha)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	extractErr := extract(tar.NewReader(stdout), dir)
+	io.Copy(ioutil.Discard, stdout)
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("git archive: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return extractErr
+}
+
+func extract(reader *tar.Reader, dir string) error {
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean("/" + header.Name)
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFile(target, reader, os.FileMode(header.Mode)&0755|0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeFile(target string, content io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// buildEnv is the whole environment of the builds, so that none of the settings or secrets given to
+// pages by the environment leaks to them
+var buildEnv = []string{"PATH=/usr/local/bin:/usr/bin:/bin", "LANG=C.UTF-8"}
+
+// build runs command in dir as configured, the files in dir are handed to the build user first. It's
+// refused unless the build user is another one than pages runs as, which could read and write the
+// repositories, the users and the host keys otherwise.
+func build(command string, dir string, config *conf.Build) error {
+	if config.User == "" {
+		return fmt.Errorf("Builds are disabled since `build.user` is not set")
+	}
+	credential, err := lookupCredential(config.User)
+	if err != nil {
+		return err
+	} else if int(credential.Uid) == os.Geteuid() {
+		return fmt.Errorf("Builds are disabled since `build.user` is the user pages runs as")
+	}
+	err = chownTree(dir, int(credential.Uid), int(credential.Gid))
+	if err != nil {
+		return err
+	}
+	var output bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = append([]string{"HOME=" + dir}, buildEnv...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// In its own process group, so that its children are killed along with it on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: credential}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	timer.Stop()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("Build `%s` timed out after %s: %s", command, timeout, lastLines(output.String(), 20))
+	} else if err != nil {
+		return fmt.Errorf("Build `%s` failed (%s): %s", command, err, lastLines(output.String(), 20))
+	}
+	return nil
+}
+
+// resolveWithin resolves the symbolic links of path, which must stay within root
+func resolveWithin(root string, path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path %s is resolved to %s out of %s", path, resolved, root)
+	}
+	return resolved, nil
+}
+
+func lookupCredential(name string) (*syscall.Credential, error) {
+	found, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(found.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(found.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+func chownTree(root string, uid int, gid int) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+func isIgnored(manifest *conf.Manifest, name string) bool {
+	for _, pattern := range manifest.Ignore {
+		if conf.MatchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersOf merges the headers of every pattern matching name, later patterns in lexical order win.
+func headersOf(manifest *conf.Manifest, name string) map[string]string {
+	patterns := make([]string, 0, len(manifest.Headers))
+	for pattern := range manifest.Headers {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	headers := map[string]string{}
+	for _, pattern := range patterns {
+		if conf.MatchGlob(pattern, name) {
+			for key, value := range manifest.Headers[pattern] {
+				headers[key] = value
+			}
+		}
+	}
+	return headers
+}
+
+func lastLines(text string, count int) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return strings.Join(lines, "\n")
+}
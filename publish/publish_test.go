@@ -0,0 +1,232 @@
+package publish
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Switching to the build user needs root")
+	}
+	publisher, dir, cleaner := setupPublishTest(t)
+	defer cleaner()
+	sha := commit(t, dir+"/work", map[string]string{
+		".pages.yml":       "source: dist\nbuild: echo built > dist/built.txt\nignore: ['*.map']\n",
+		"README.md":        "Not published",
+		"dist/index.html":  "<html></html>",
+		"dist/app.js":      "app()",
+		"dist/app.js.map":  "{}",
+		"dist/css/app.css": "body {}",
+	})
+	err := os.MkdirAll(dir+"/sites/pages/pry/ruby-pry", 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(dir+"/sites/pages/pry/ruby-pry/stale.html", []byte("stale"), 0644)
+	assert.Nil(t, err)
+
+	var emitted []string
+	publisher.bus.Subscribe(func(event *events.Event) {
+		emitted = append(emitted, event.Type)
+	})
+	result, err := publisher.Publish(&events.Event{Type: events.Push, Repo: "pry/ruby-pry",
+		Ref: "refs/heads/master", NewSha: sha})
+	assert.Nil(t, err)
+	assert.EqualValues(t, result.Files, 4)
+	assert.EqualValues(t, emitted, []string{events.PublishStarted, events.PublishSucceeded})
+	assert.EqualValues(t, listFiles(t, dir+"/sites/pages"), []string{
+		"pry/ruby-pry/app.js", "pry/ruby-pry/built.txt", "pry/ruby-pry/css/app.css", "pry/ruby-pry/index.html",
+	})
+	content, err := ioutil.ReadFile(dir + "/sites/pages/pry/ruby-pry/built.txt")
+	assert.Nil(t, err)
+	assert.EqualValues(t, string(content), "built\n")
+
+	sha = commit(t, dir+"/work", map[string]string{".pages.yml": "source: missing\n"})
+	_, err = publisher.Publish(&events.Event{Type: events.Push, Repo: "pry/ruby-pry",
+		Ref: "refs/heads/master", NewSha: sha})
+	assert.NotNil(t, err)
+	assert.EqualValues(t, emitted[2:], []string{events.PublishStarted, events.PublishFailed})
+
+	// The build replaces a directory on the way to the source by a link out of the repository
+	assert.Nil(t, os.MkdirAll(dir+"/outside/secrets", 0755))
+	assert.Nil(t, ioutil.WriteFile(dir+"/outside/secrets/key", []byte("secret"), 0600))
+	sha = commit(t, dir+"/work", map[string]string{".pages.yml": "source: x/secrets\nbuild: ln -s " + dir + "/outside x\n"})
+	_, err = publisher.Publish(&events.Event{Type: events.Push, Repo: "pry/ruby-pry",
+		Ref: "refs/heads/master", NewSha: sha})
+	assert.EqualValues(t, err.Error(), "Source `x/secrets` is outside of the repository")
+	assert.NotContains(t, listFiles(t, dir+"/sites/pages"), "pry/ruby-pry/key")
+}
+
+func TestPublishHistory(t *testing.T) {
+	publisher, dir, cleaner := setupPublishTest(t)
+	defer cleaner()
+	publisher.bus.Subscribe(publisher.recordHistory)
+	repo, err := publisher.openRepo("pry/ruby-pry")
+	assert.Nil(t, err)
+
+	sha := commit(t, dir+"/work", map[string]string{"index.html": "<html></html>"})
+	ref, found, err := findPublishRef(repo)
+	assert.Nil(t, err)
+	assert.EqualValues(t, ref, "refs/heads/master")
+	assert.EqualValues(t, found, sha)
+	_, err = publisher.Publish(&events.Event{Type: events.Push, Repo: "pry/ruby-pry", Ref: ref, NewSha: sha})
+	assert.Nil(t, err)
+
+	err = repo.SetPublishBranch("gh-pages")
+	assert.Nil(t, err)
+	ref, _, err = findPublishRef(repo)
+	assert.Nil(t, err)
+	assert.Empty(t, ref)
+	sha = commit(t, dir+"/work", map[string]string{".pages.yml": "source: missing\n"})
+	_, err = publisher.Publish(&events.Event{Type: events.Push, Repo: "pry/ruby-pry", Ref: ref, NewSha: sha})
+	assert.NotNil(t, err)
+
+	history, err := History(repo, 10)
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(history), 2)
+	assert.EqualValues(t, history[0].Type, events.PublishFailed)
+	assert.EqualValues(t, history[0].NewSha, sha)
+	assert.EqualValues(t, history[1].Type, events.PublishSucceeded)
+	published := history[1].NewSha
+	history, err = History(repo, 1)
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(history), 1)
+	assert.EqualValues(t, history[0].Type, events.PublishFailed)
+
+	_, err = publisher.Rollback("pry/ruby-pry", sha[:7], "pry")
+	assert.NotNil(t, err)
+	_, err = publisher.Rollback("pry/ruby-pry", published[:6], "pry")
+	assert.NotNil(t, err)
+	event, err := publisher.Rollback("pry/ruby-pry", published[:7], "pry")
+	assert.Nil(t, err)
+	assert.EqualValues(t, event.NewSha, published)
+	assert.EqualValues(t, event.Ref, "refs/heads/master")
+	publisher.running.Wait()
+	history, err = History(repo, 1)
+	assert.Nil(t, err)
+	assert.EqualValues(t, history[0].Type, events.PublishSucceeded)
+	assert.EqualValues(t, history[0].NewSha, published)
+}
+
+func TestSiteUrl(t *testing.T) {
+	publisher, dir, cleaner := setupPublishTest(t)
+	defer cleaner()
+	assert.Empty(t, publisher.SiteUrl("pry/ruby-pry"))
+
+	publisher.Url = "https://pages.example.com/"
+	assert.EqualValues(t, publisher.SiteUrl("pry/ruby-pry"), "https://pages.example.com/pry/ruby-pry/")
+	commit(t, dir+"/work", map[string]string{".pages.yml": "storage:\n  prefix: docs/\n"})
+	assert.EqualValues(t, publisher.SiteUrl("pry/ruby-pry"), "https://pages.example.com/pry/ruby-pry/docs/")
+	commit(t, dir+"/work", map[string]string{".pages.yml": "storage:\n  bucket: pry-docs\n"})
+	assert.Empty(t, publisher.SiteUrl("pry/ruby-pry"))
+
+	repo, err := publisher.openRepo("pry/ruby-pry")
+	assert.Nil(t, err)
+	assert.Nil(t, repo.SetDomain("pry.example.com"))
+	assert.EqualValues(t, publisher.SiteUrl("pry/ruby-pry"), "https://pry.example.com/")
+}
+
+func TestBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("PAGES_SSHD_PRIVATE_KEY", "secret")
+	defer os.Unsetenv("PAGES_SSHD_PRIVATE_KEY")
+
+	err = build("true", dir, &config.Build{Timeout: 10})
+	assert.EqualValues(t, err.Error(), "Builds are disabled since `build.user` is not set")
+	current, err := user.Current()
+	assert.Nil(t, err)
+	err = build("true", dir, &config.Build{User: current.Username, Timeout: 10})
+	assert.EqualValues(t, err.Error(), "Builds are disabled since `build.user` is the user pages runs as")
+	if os.Geteuid() != 0 {
+		t.Skip("Switching to the build user needs root")
+	}
+
+	err = build("env > env.txt", dir, &config.Build{User: "nobody", Timeout: 10})
+	assert.Nil(t, err)
+	content, err := ioutil.ReadFile(dir + "/env.txt")
+	assert.Nil(t, err)
+	assert.NotContains(t, string(content), "PAGES_")
+	assert.Contains(t, string(content), "HOME="+dir+"\n")
+
+	startedAt := time.Now()
+	err = build("sleep 10 & sleep 10", dir, &config.Build{User: "nobody", Timeout: 1})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "timed out after 1s")
+	assert.True(t, time.Since(startedAt) < 5*time.Second)
+
+	err = build("id -un > user.txt", dir, &config.Build{User: "nobody", Timeout: 10})
+	assert.Nil(t, err)
+	content, err = ioutil.ReadFile(dir + "/user.txt")
+	assert.Nil(t, err)
+	assert.EqualValues(t, string(content), "nobody\n")
+}
+
+func commit(t *testing.T, dir string, files map[string]string) string {
+	for name, content := range files {
+		err := os.MkdirAll(filepath.Dir(dir+"/"+name), 0755)
+		assert.Nil(t, err)
+		err = ioutil.WriteFile(dir+"/"+name, []byte(content), 0644)
+		assert.Nil(t, err)
+	}
+	git(t, dir, "add", ".")
+	git(t, dir, "commit", "-q", "-m", "Commit")
+	return git(t, dir, "rev-parse", "HEAD")
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=testuser", "-c", "user.email=test@qiniu.com"}, args...)...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	assert.Nil(t, err)
+	return strings.TrimSpace(string(output))
+}
+
+func listFiles(t *testing.T, root string) []string {
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, strings.TrimPrefix(path, root+"/"))
+		}
+		return err
+	})
+	assert.Nil(t, err)
+	sort.Strings(files)
+	return files
+}
+
+func setupPublishTest(t *testing.T) (*Publisher, string, func()) {
+	dir, err := ioutil.TempDir("", "publish-test")
+	assert.Nil(t, err)
+	err = os.MkdirAll(dir+"/work", 0755)
+	assert.Nil(t, err)
+	git(t, dir+"/work", "init", "-q")
+	err = os.MkdirAll(dir+"/repos/pry", 0755)
+	assert.Nil(t, err)
+	// The work tree's git dir serves as the repository
+	err = os.Symlink(dir+"/work/.git", dir+"/repos/pry/ruby-pry.git")
+	assert.Nil(t, err)
+
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	storageConfig := &config.Storage{Type: "local", Root: dir + "/sites", Bucket: "pages"}
+	publisher, err := New(storageConfig, &config.Build{User: "nobody", Timeout: 60, Workers: 2}, dir+"/repos",
+		events.NewBus(logger), logger)
+	assert.Nil(t, err)
+	return publisher, dir, func() {
+		err := os.RemoveAll(dir)
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bachue/pages/config"
+)
+
+// pruneThreshold is how many keys a Limiter or a Jail holds before it drops those it doesn't need
+const pruneThreshold = 4096
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// Limiter holds a token bucket for each key, such as a source IP or a user
+type Limiter struct {
+	mutex   sync.Mutex
+	limit   config.Limit
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func NewLimiter(limit config.Limit) *Limiter {
+	return &Limiter{limit: limit, buckets: map[string]*bucket{}, now: time.Now}
+}
+
+// Reconfigure applies limit, the tokens left of each key are kept
+func (limiter *Limiter) Reconfigure(limit config.Limit) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.limit = limit
+}
+
+// Allow takes a token of key, it returns false if there is none left
+func (limiter *Limiter) Allow(key string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if limiter.limit.Rate <= 0 {
+		return true
+	}
+	now := limiter.now()
+	if len(limiter.buckets) >= pruneThreshold {
+		for key, bucket := range limiter.buckets {
+			if limiter.refill(bucket, now) >= float64(limiter.limit.Burst) {
+				delete(limiter.buckets, key)
+			}
+		}
+	}
+	current, ok := limiter.buckets[key]
+	if !ok {
+		current = &bucket{tokens: float64(limiter.limit.Burst), updatedAt: now}
+		limiter.buckets[key] = current
+	}
+	if limiter.refill(current, now) < 1 {
+		return false
+	}
+	current.tokens--
+	return true
+}
+
+func (limiter *Limiter) refill(bucket *bucket, now time.Time) float64 {
+	bucket.tokens += now.Sub(bucket.updatedAt).Minutes() * float64(limiter.limit.Rate)
+	if bucket.tokens > float64(limiter.limit.Burst) {
+		bucket.tokens = float64(limiter.limit.Burst)
+	}
+	bucket.updatedAt = now
+	return bucket.tokens
+}
+
+// Jail bans a key for a while once it fails too many times within a window, like fail2ban does
+type Jail struct {
+	mutex    sync.Mutex
+	ban      config.Ban
+	failures map[string][]time.Time
+	bans     map[string]time.Time
+	now      func() time.Time
+}
+
+func NewJail(ban config.Ban) *Jail {
+	return &Jail{ban: ban, failures: map[string][]time.Time{}, bans: map[string]time.Time{}, now: time.Now}
+}
+
+// Reconfigure applies ban, the current bans are kept until they expire
+func (jail *Jail) Reconfigure(ban config.Ban) {
+	jail.mutex.Lock()
+	defer jail.mutex.Unlock()
+	jail.ban = ban
+}
+
+// Fail records a failure of key, it returns true if key is banned due to it
+func (jail *Jail) Fail(key string) bool {
+	jail.mutex.Lock()
+	defer jail.mutex.Unlock()
+	if jail.ban.MaxFailures <= 0 {
+		return false
+	}
+	now := jail.now()
+	window := time.Duration(jail.ban.Window) * time.Second
+	if len(jail.failures) >= pruneThreshold {
+		for key, failures := range jail.failures {
+			if now.Sub(failures[len(failures)-1]) > window {
+				delete(jail.failures, key)
+			}
+		}
+		for key, until := range jail.bans {
+			if !now.Before(until) {
+				delete(jail.bans, key)
+			}
+		}
+	}
+	// Only the latest max_failures within the window matter
+	failures := append(jail.failures[key], now)
+	for len(failures) > 0 && (len(failures) > jail.ban.MaxFailures || now.Sub(failures[0]) > window) {
+		failures = failures[1:]
+	}
+	if len(failures) < jail.ban.MaxFailures {
+		jail.failures[key] = failures
+		return false
+	}
+	delete(jail.failures, key)
+	jail.bans[key] = now.Add(time.Duration(jail.ban.Duration) * time.Second)
+	return true
+}
+
+func (jail *Jail) IsBanned(key string) bool {
+	jail.mutex.Lock()
+	defer jail.mutex.Unlock()
+	until, ok := jail.bans[key]
+	if !ok {
+		return false
+	}
+	if !jail.now().Before(until) {
+		delete(jail.bans, key)
+		return false
+	}
+	return true
+}
+
+// Counter counts the concurrent usages of each key, such as the connections of a source IP
+type Counter struct {
+	mutex  sync.Mutex
+	counts map[string]int32
+}
+
+func NewCounter() *Counter {
+	return &Counter{counts: map[string]int32{}}
+}
+
+// Acquire counts a usage of key, unless it has max usages already. 0 means no limit.
+func (counter *Counter) Acquire(key string, max int32) bool {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	if max > 0 && counter.counts[key] >= max {
+		return false
+	}
+	counter.counts[key]++
+	return true
+}
+
+func (counter *Counter) Release(key string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.counts[key]--
+	if counter.counts[key] <= 0 {
+		delete(counter.counts, key)
+	}
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bachue/pages/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (clock *clock) Now() time.Time {
+	return clock.now
+}
+
+func TestLimiter(t *testing.T) {
+	clock := &clock{now: time.Now()}
+	limiter := NewLimiter(config.Limit{Rate: 6, Burst: 2})
+	limiter.now = clock.Now
+
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.False(t, limiter.Allow("10.0.0.1"))
+	assert.True(t, limiter.Allow("10.0.0.2"))
+
+	// Refilled by a token every 10 seconds
+	clock.now = clock.now.Add(5 * time.Second)
+	assert.False(t, limiter.Allow("10.0.0.1"))
+	clock.now = clock.now.Add(5 * time.Second)
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.False(t, limiter.Allow("10.0.0.1"))
+
+	// Never refilled over the burst
+	clock.now = clock.now.Add(time.Hour)
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.False(t, limiter.Allow("10.0.0.1"))
+
+	limiter.Reconfigure(config.Limit{})
+	assert.True(t, limiter.Allow("10.0.0.1"))
+}
+
+func TestJail(t *testing.T) {
+	clock := &clock{now: time.Now()}
+	jail := NewJail(config.Ban{MaxFailures: 3, Window: 60, Duration: 600})
+	jail.now = clock.Now
+
+	assert.False(t, jail.Fail("10.0.0.1"))
+	assert.False(t, jail.Fail("10.0.0.1"))
+	// The first failure is out of the window
+	clock.now = clock.now.Add(61 * time.Second)
+	assert.False(t, jail.Fail("10.0.0.1"))
+	assert.False(t, jail.Fail("10.0.0.1"))
+	assert.False(t, jail.IsBanned("10.0.0.1"))
+	assert.True(t, jail.Fail("10.0.0.1"))
+	assert.True(t, jail.IsBanned("10.0.0.1"))
+	assert.False(t, jail.IsBanned("10.0.0.2"))
+
+	clock.now = clock.now.Add(600 * time.Second)
+	assert.False(t, jail.IsBanned("10.0.0.1"))
+	assert.False(t, jail.Fail("10.0.0.1"))
+
+	jail.Reconfigure(config.Ban{})
+	for i := 0; i < 5; i++ {
+		assert.False(t, jail.Fail("10.0.0.2"))
+	}
+	assert.False(t, jail.IsBanned("10.0.0.2"))
+}
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter()
+	assert.True(t, counter.Acquire("pry", 2))
+	assert.True(t, counter.Acquire("pry", 2))
+	assert.False(t, counter.Acquire("pry", 2))
+	assert.True(t, counter.Acquire("pry", 0))
+	counter.Release("pry")
+	counter.Release("pry")
+	assert.True(t, counter.Acquire("pry", 2))
+	counter.Release("pry")
+	counter.Release("pry")
+	assert.Len(t, counter.counts, 0)
+}
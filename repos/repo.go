@@ -0,0 +1,216 @@
+package repos
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/bachue/pages/config"
+)
+
+const (
+	ZeroSha = "0000000000000000000000000000000000000000"
+	// PublishBranchKey is the git config key overriding the `branch` of `.pages.yml`
+	PublishBranchKey = "pages.branch"
+	// DomainKey is the git config key of the custom domain the site is served at
+	DomainKey = "pages.domain"
+)
+
+// Repo runs git commands against a bare repository
+type Repo struct {
+	Path string
+	// Env is appended to the environment of every git command, e.g. to see quarantined objects
+	Env []string
+}
+
+func Open(path string) *Repo {
+	return &Repo{Path: path}
+}
+
+func (repo *Repo) Git(args ...string) ([]byte, error) {
+	return repo.GitWithInput(nil, args...)
+}
+
+func (repo *Repo) GitWithInput(input []byte, args ...string) ([]byte, error) {
+	cmd := repo.Command(args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return output, err
+}
+
+// Command prepares a git command against the repository, for callers which need to stream its output.
+func (repo *Repo) Command(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(append(os.Environ(), "GIT_DIR="+repo.Path), repo.Env...)
+	return cmd
+}
+
+// ReadFile returns the content of the file at path in the tree of commit sha, found is false
+// if there is no such file.
+func (repo *Repo) ReadFile(sha string, path string) (content []byte, found bool, err error) {
+	entry, err := repo.Git("ls-tree", sha, "--", path)
+	if err != nil {
+		return nil, false, err
+	} else if len(entry) == 0 {
+		return nil, false, nil
+	}
+	content, err = repo.Git("cat-file", "blob", sha+":"+path)
+	if err != nil {
+		return nil, false, err
+	}
+	return content, true, nil
+}
+
+// Manifest returns the manifest of the tree of commit sha, or the default one if there is no `.pages.yml`.
+// The publish branch configured on the repository wins over the one of the manifest.
+func (repo *Repo) Manifest(sha string) (*config.Manifest, error) {
+	content, _, err := repo.ReadFile(sha, config.ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := config.ParseManifest(content)
+	if err != nil {
+		return nil, err
+	}
+	branch, err := repo.PublishBranch()
+	if err != nil {
+		return nil, err
+	} else if branch != "" {
+		manifest.Branch = branch
+	}
+	return manifest, nil
+}
+
+// PublishBranch returns the publish branch configured on the repository, or "" if there is none.
+func (repo *Repo) PublishBranch() (string, error) {
+	output, err := repo.Git("config", "--local", "--get", PublishBranchKey)
+	if _, ok := err.(*exec.ExitError); ok {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// SetPublishBranch configures the publish branch of the repository, "" restores the one of `.pages.yml`.
+func (repo *Repo) SetPublishBranch(branch string) error {
+	if branch == "" {
+		_, err := repo.Git("config", "--local", "--unset-all", PublishBranchKey)
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 5 {
+			// Not set at all
+			return nil
+		}
+		return err
+	} else if !config.IsValidBranch(branch) {
+		return fmt.Errorf("Invalid branch name `%s`", branch)
+	}
+	_, err := repo.Git("config", "--local", PublishBranchKey, branch)
+	return err
+}
+
+// Domain returns the custom domain the site of the repository is served at, or "" if there is none.
+func (repo *Repo) Domain() (string, error) {
+	output, err := repo.Git("config", "--local", "--get", DomainKey)
+	if _, ok := err.(*exec.ExitError); ok {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// SetDomain configures the custom domain the site of the repository is served at, "" removes it.
+func (repo *Repo) SetDomain(domain string) error {
+	domain = strings.ToLower(domain)
+	if domain == "" {
+		_, err := repo.Git("config", "--local", "--unset-all", DomainKey)
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 5 {
+			// Not set at all
+			return nil
+		}
+		return err
+	} else if !IsValidDomain(domain) {
+		return fmt.Errorf("Invalid domain `%s`", domain)
+	}
+	_, err := repo.Git("config", "--local", DomainKey, domain)
+	return err
+}
+
+// Branches returns the full names of all the branches of the repository, e.g. `refs/heads/master`.
+func (repo *Repo) Branches() ([]string, error) {
+	output, err := repo.Git("for-each-ref", "--format=%(refname)", "refs/heads/")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// ResolveRef returns the sha ref points to, or "" if there is no such ref.
+func (repo *Repo) ResolveRef(ref string) (string, error) {
+	output, err := repo.Git("rev-parse", "-q", "--verify", ref)
+	if _, ok := err.(*exec.ExitError); ok {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// ConfigSection returns the git config entries of the repository under section, keyed by their
+// subsection then by their name, e.g. `webhook.ci.url` becomes `["ci"]["url"]`.
+func (repo *Repo) ConfigSection(section string) (map[string]map[string]string, error) {
+	entries := map[string]map[string]string{}
+	output, err := repo.Git("config", "--local", "--null", "--get-regexp", "^"+section+`\.`)
+	if _, ok := err.(*exec.ExitError); ok {
+		// No entries at all
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range strings.Split(string(output), "\x00") {
+		keyValue := strings.SplitN(entry, "\n", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		key := strings.TrimPrefix(keyValue[0], section+".")
+		dot := strings.LastIndex(key, ".")
+		if dot < 0 {
+			continue
+		}
+		subsection, name := key[:dot], key[dot+1:]
+		if entries[subsection] == nil {
+			entries[subsection] = map[string]string{}
+		}
+		entries[subsection][name] = keyValue[1]
+	}
+	return entries, nil
+}
+
+// StateDir is where pages keeps its own files about the repository, such as logs.
+func (repo *Repo) StateDir() string {
+	return repo.Path + "/pages"
+}
+
+// AppendLog appends line to the log file name in the state dir of the repository.
+func (repo *Repo) AppendLog(name string, line []byte) error {
+	err := os.MkdirAll(repo.StateDir(), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(repo.StateDir()+"/"+name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package repos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	namePattern   = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+	domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// Split parses a repository name as given by git clients, such as `user/repo`,
+// `/user/repo.git` or `'user/repo.git'`, into its user and repo parts
+func Split(name string) (string, string, error) {
+	trimmed := strings.Trim(name, `'"`)
+	trimmed = strings.TrimPrefix(trimmed, "/")
+	trimmed = strings.TrimSuffix(trimmed, "/")
+	trimmed = strings.TrimSuffix(trimmed, ".git")
+	parts := strings.Split(trimmed, "/")
+	if len(parts) != 2 || !IsValidName(parts[0]) || !IsValidName(parts[1]) {
+		return "", "", fmt.Errorf("Invalid repository name `%s`, expected `<user>/<repo>`", name)
+	}
+	return parts[0], parts[1], nil
+}
+
+func IsValidName(name string) bool {
+	return namePattern.MatchString(name) && !strings.HasSuffix(name, ".git")
+}
+
+// IsValidDomain tells if name is a fully qualified domain name in lower case, such as `www.example.com`
+func IsValidDomain(name string) bool {
+	return len(name) <= 253 && domainPattern.MatchString(name)
+}
+
+func Path(gitRepoDir string, user string, repo string) string {
+	return gitRepoDir + "/" + user + "/" + repo + ".git"
+}
+
+// Create initializes the bare repository user/repo under gitRepoDir, failing if it already exists.
+func Create(gitRepoDir string, user string, repo string) (*Repo, error) {
+	path := Path(gitRepoDir, user, repo)
+	_, err := os.Stat(path)
+	if err == nil {
+		return nil, fmt.Errorf("Repository %s/%s already exists", user, repo)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	output, err := exec.Command("git", "init", "-q", "--bare", path).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("git init: %s %s", err, strings.TrimSpace(string(output)))
+	}
+	return Open(path), nil
+}
+
+// Remove deletes the repository user/repo under gitRepoDir with everything in it.
+func Remove(gitRepoDir string, user string, repo string) error {
+	path := Path(gitRepoDir, user, repo)
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Repository %s/%s is not found", user, repo)
+	} else if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// List returns the names of all the repositories under gitRepoDir as `user/repo`, only those
+// of user if it's not empty.
+func List(gitRepoDir string, user string) ([]string, error) {
+	users := []string{user}
+	if user == "" {
+		entries, err := ioutil.ReadDir(gitRepoDir)
+		if err != nil {
+			return nil, err
+		}
+		users = users[:0]
+		for _, entry := range entries {
+			if entry.IsDir() && IsValidName(entry.Name()) {
+				users = append(users, entry.Name())
+			}
+		}
+	}
+	names := []string{}
+	for _, user := range users {
+		paths, err := filepath.Glob(filepath.Join(gitRepoDir, user, "*.git"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			repo := strings.TrimSuffix(filepath.Base(path), ".git")
+			if IsValidName(repo) {
+				names = append(names, user+"/"+repo)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// FindByDomain returns the name `user/repo` of the repository under gitRepoDir whose site is served at
+// domain, or "" if there is none.
+func FindByDomain(gitRepoDir string, domain string) (string, error) {
+	names, err := List(gitRepoDir, "")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		user, repo, _ := Split(name)
+		found, err := Open(Path(gitRepoDir, user, repo)).Domain()
+		if err != nil {
+			return "", err
+		} else if found == domain {
+			return name, nil
+		}
+	}
+	return "", nil
+}
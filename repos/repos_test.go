@@ -0,0 +1,58 @@
+package repos
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	for _, name := range []string{"pry/ruby-pry", "/pry/ruby-pry.git", "'pry/ruby-pry.git'", "pry/ruby-pry/"} {
+		user, repo, err := Split(name)
+		assert.Nil(t, err)
+		assert.EqualValues(t, user, "pry")
+		assert.EqualValues(t, repo, "ruby-pry")
+	}
+	for _, name := range []string{"", "pry", "pry/ruby-pry/bin", "../pry/ruby-pry", "pry/..", "pry/.git", "-u/repo"} {
+		_, _, err := Split(name)
+		assert.NotNil(t, err)
+	}
+	assert.EqualValues(t, Path("/var/git", "pry", "ruby-pry"), "/var/git/pry/ruby-pry.git")
+}
+
+func TestDomain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repos")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pry, err := Create(dir, "pry", "ruby-pry")
+	assert.Nil(t, err)
+	rails, err := Create(dir, "rails", "rails")
+	assert.Nil(t, err)
+
+	domain, err := pry.Domain()
+	assert.Nil(t, err)
+	assert.Empty(t, domain)
+	assert.Nil(t, pry.SetDomain("Pry.Example.com"))
+	domain, err = pry.Domain()
+	assert.Nil(t, err)
+	assert.EqualValues(t, domain, "pry.example.com")
+	assert.Nil(t, rails.SetDomain("rubyonrails.org"))
+	for _, invalid := range []string{"localhost", "-pry.example.com", "pry..example.com", "pry.example.com/docs", "*.example.com"} {
+		assert.NotNil(t, rails.SetDomain(invalid))
+	}
+
+	name, err := FindByDomain(dir, "rubyonrails.org")
+	assert.Nil(t, err)
+	assert.EqualValues(t, name, "rails/rails")
+	name, err = FindByDomain(dir, "example.com")
+	assert.Nil(t, err)
+	assert.Empty(t, name)
+
+	assert.Nil(t, pry.SetDomain(""))
+	assert.Nil(t, pry.SetDomain(""))
+	domain, err = pry.Domain()
+	assert.Nil(t, err)
+	assert.Empty(t, domain)
+}
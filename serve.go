@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bachue/pages/admin"
+	"github.com/bachue/pages/api"
+	"github.com/bachue/pages/audit"
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/gitfuse"
+	"github.com/bachue/pages/health"
+	"github.com/bachue/pages/hooks"
+	"github.com/bachue/pages/httpd"
+	"github.com/bachue/pages/lifecycle"
+	"github.com/bachue/pages/listeners"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/publish"
+	"github.com/bachue/pages/sshd"
+	"github.com/bachue/pages/webhook"
+)
+
+var components = []string{"sshd", "fuse", "http"}
+
+const healthCheckTimeout = 5 * time.Second
+
+// handoffTimeout is how long a new process is given to take over the listeners on restart
+const handoffTimeout = 30 * time.Second
+
+func serve(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	selected := flags.String("components", strings.Join(components, ","),
+		"comma separated components to serve, http is only served if http.port is configured")
+	flags.Parse(args)
+	enabled := map[string]bool{}
+	for _, component := range strings.Split(*selected, ",") {
+		component = strings.TrimSpace(component)
+		if !isComponent(component) {
+			fmt.Fprintf(os.Stderr, "Unknown component `%s`, expected some of %s\n", component, strings.Join(components, ", "))
+			return 2
+		}
+		enabled[component] = true
+	}
+
+	logger := loadConfig()
+	restarted := listeners.Inherited()
+	manager := newManager(logger)
+	var gitfs *gitfuse.GitFs
+	manager.OnRestart(func() error {
+		process, err := listeners.Handoff(handoffTimeout)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Handed off listeners to new process %d", process.Pid)
+		// Unmounted at once rather than after draining, the new process mounts GitFS at the same mount
+		// point once it's unmounted here
+		if enabled["fuse"] {
+			err = gitfs.Unmount()
+			if err != nil {
+				logger.Errorf("Failed to unmount GitFS due to %s", err)
+			}
+		}
+		return nil
+	})
+
+	// The admin server is added at first so it's stopped at last, the probes can tell the instance is draining
+	checker := health.New(healthCheckTimeout)
+	var adminServer *admin.Server
+	if config.Current.Admin.ListenPort != 0 {
+		adminServer = admin.NewServer(&config.Current.Admin, logger)
+		adminServer.Handle("/healthz", checker.LivenessHandler())
+		adminServer.Handle("/readyz", checker.ReadinessHandler())
+		manager.Add("admin server", adminServer.Start, adminServer.Shutdown)
+	}
+	checker.AddReadiness("repo_dir", health.Readable(config.Current.Fuse.GitRepoDir))
+
+	users, err := auth.NewStore(config.Current.Auth.UsersFile)
+	if err != nil {
+		logger.Fatalf("Failed to load users: %s", err)
+	}
+
+	receiver, err := hooks.NewReceiver(&config.Current.Hooks, logger)
+	if err != nil {
+		logger.Fatalf("Failed to install Git hooks: %s", err)
+	}
+	manager.OnShutdown(func() { receiver.Close() })
+
+	auditor := openAuditor(manager, logger)
+
+	bus := events.NewBus(logger)
+	dispatcher := webhook.NewDispatcher(&config.Current.Webhooks, config.Current.Fuse.GitRepoDir, logger)
+	bus.Subscribe(dispatcher.Handle)
+	manager.OnShutdown(dispatcher.Close)
+	if auditor != nil {
+		bus.Subscribe(auditor.Handle)
+	}
+
+	if enabled["fuse"] {
+		gitfs = addGitFs(manager, restarted, logger)
+		checker.AddLiveness("gitfs", gitfs.Ping)
+	}
+
+	var publisher *publish.Publisher
+	if config.Current.Storage.Root != "" {
+		publisher, err = publish.New(&config.Current.Storage, &config.Current.Build, config.Current.Fuse.GitRepoDir,
+			bus, logger)
+		if err != nil {
+			logger.Fatalf("Failed to create publisher: %s", err)
+		}
+		publisher.Subscribe()
+		manager.Add("publisher", nil, publisher.Shutdown)
+		checker.AddReadiness("storage", publisher.Ping)
+	} else {
+		logger.Infof("Publishing is disabled since no storage root is configured")
+	}
+
+	if adminServer != nil {
+		adminServer.Handle("/api/", http.StripPrefix("/api",
+			api.NewServer(config.Current.Fuse.GitRepoDir, users, publisher, auditor, logger)))
+	} else {
+		logger.Infof("Admin API is disabled since no admin port is configured")
+	}
+
+	var sshdServer *sshd.Server
+	if enabled["sshd"] {
+		if gitfs == nil {
+			// SFTP reads the repositories the same as GitFs, which doesn't need to be mounted though
+			gitfs, err = gitfuse.Open(&config.Current.Fuse, logger)
+			if err != nil {
+				logger.Fatalf("Failed to open Git repositories: %s", err)
+			}
+		}
+		sshdServer, err = sshd.NewServer(&config.Current.Sshd, config.Current.Fuse.GitRepoDir, gitfs, users, receiver,
+			bus, publisher, auditor, logger)
+		if err != nil {
+			logger.Fatalf("Failed to create SSHD server: %s", err)
+		}
+		manager.Add("SSHD server", sshdServer.Start, sshdServer.Shutdown)
+		checker.AddReadiness("sshd", sshdServer.Ping)
+	}
+
+	if enabled["http"] && config.Current.Http.ListenPort != 0 {
+		httpServer := httpd.NewServer(&config.Current.Http, config.Current.Fuse.GitRepoDir, users, receiver, bus,
+			auditor, logger)
+		manager.Add("HTTP server", httpServer.Start, httpServer.Shutdown)
+	}
+
+	// Added at last so it's stopped at first, taking the instance out of service before anything stops
+	manager.Add("health checker", nil, func(ctx context.Context) error {
+		checker.Drain()
+		return nil
+	})
+
+	config.Subscribe(func(current *config.Environmental) {
+		err := log_driver.Reconfigure(logger, &current.Log)
+		if err != nil {
+			logger.Errorf("Failed to reconfigure logger due to %s", err)
+		}
+		if sshdServer != nil {
+			sshdServer.Reconfigure(&current.Sshd)
+		}
+		if gitfs != nil {
+			gitfs.Reconfigure(&current.Fuse)
+		}
+		if publisher != nil {
+			publisher.Reconfigure(&current.Storage)
+		}
+	})
+	manager.OnReload(func() {
+		needRestart, err := config.Reload()
+		if err != nil {
+			logger.Errorf("Failed to reload config, keep the current one: %s", err)
+		} else if len(needRestart) > 0 {
+			logger.Infof("Reloaded config, changes of %s take effect after restart", strings.Join(needRestart, ", "))
+		} else {
+			logger.Infof("Reloaded config")
+		}
+		err = users.Reload()
+		if err != nil {
+			logger.Errorf("Failed to reload users, keep the current ones: %s", err)
+		}
+	})
+
+	return manager.Run()
+}
+
+func isComponent(name string) bool {
+	for _, component := range components {
+		if name == component {
+			return true
+		}
+	}
+	return false
+}
+
+func newManager(logger log_driver.Logger) *lifecycle.Manager {
+	manager := lifecycle.New(time.Duration(config.Current.ShutdownTimeout)*time.Second, logger)
+	manager.OnShutdown(func() {
+		logger.Infof("Bye")
+		log_driver.Flush(logger)
+	})
+	manager.OnReopen(func() {
+		err := log_driver.Reopen(logger)
+		if err != nil {
+			logger.Errorf("Failed to reopen log file due to %s", err)
+		}
+	})
+	return manager
+}
+
+// openAuditor opens the audit log, which is reopened on SIGUSR1 along with the log file
+func openAuditor(manager *lifecycle.Manager, logger log_driver.Logger) *audit.Auditor {
+	auditor, err := audit.New(&config.Current.Audit, logger)
+	if err != nil {
+		logger.Fatalf("Failed to open audit log: %s", err)
+	}
+	manager.OnShutdown(func() { auditor.Close() })
+	manager.OnReopen(func() {
+		err := auditor.Reopen()
+		if err != nil {
+			logger.Errorf("Failed to reopen audit log due to %s", err)
+		}
+	})
+	return auditor
+}
+
+// addGitFs mounts GitFS, which is mounted in background if restarted, since the previous process
+// unmounts the mount point only after this one has taken over the listeners
+func addGitFs(manager *lifecycle.Manager, restarted bool, logger log_driver.Logger) *gitfuse.GitFs {
+	fuseConfig := &config.Current.Fuse
+	deferred := restarted && fuseConfig.MountPoint != ""
+	var gitfs *gitfuse.GitFs
+	var err error
+	if deferred {
+		gitfs, err = gitfuse.Open(fuseConfig, logger)
+	} else {
+		gitfs, err = gitfuse.New(fuseConfig, logger)
+	}
+	if err != nil {
+		logger.Fatalf("Failed to start GitFS: %s", err)
+	}
+	manager.Add("GitFS", func() error {
+		if deferred {
+			err := gitfs.Mount(fuseConfig, handoffTimeout)
+			if err != nil {
+				return err
+			}
+		}
+		gitfs.Start()
+		return nil
+	}, func(ctx context.Context) error {
+		return gitfs.Unmount()
+	})
+	return gitfs
+}
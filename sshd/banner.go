@@ -0,0 +1,120 @@
+package sshd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/publish"
+	"github.com/bachue/pages/repos"
+	"golang.org/x/crypto/ssh"
+)
+
+// handleShellRequest shows the banner instead of a shell, then exits with status 0
+func (server *Server) handleShellRequest(channel ssh.Channel, request *ssh.Request, conn *ssh.ServerConn, pty bool,
+	logger log_driver.Logger) {
+	err := request.Reply(true, nil)
+	if err != nil {
+		logger.Errorf("Failed to reply true to SSH Request due to %s", err)
+	}
+	banner := server.banner(getIdentity(conn), logger)
+	if pty {
+		banner = strings.Replace(banner, "\n", "\r\n", -1)
+	}
+	_, err = io.WriteString(channel, banner)
+	if err != nil && err != io.EOF {
+		logger.Errorf("Failed to write banner due to %s", err)
+	}
+	sendExitStatus(channel, 0)
+}
+
+// banner greets identity with the repositories they may push to, along with the URLs and the latest
+// outcomes of publishing them
+func (server *Server) banner(identity *auth.Identity, logger log_driver.Logger) string {
+	var banner bytes.Buffer
+	fmt.Fprintf(&banner, "Hi %s! You've successfully authenticated, but Pages does not provide shell access.\n",
+		identity.User)
+
+	names := server.pushableRepos(identity, logger)
+	if len(names) == 0 {
+		fmt.Fprintf(&banner, "\nYou have no repositories to push to yet.\n")
+	} else {
+		fmt.Fprintf(&banner, "\nRepositories you can push to:\n")
+		server.writeSites(&banner, names, "    ", logger)
+	}
+	if identity.Repo == "" {
+		fmt.Fprintf(&banner, "\nRun the `help` command over SSH for the commands managing your sites.\n")
+	}
+	return banner.String()
+}
+
+// pushableRepos returns the names of the repositories identity may push to
+func (server *Server) pushableRepos(identity *auth.Identity, logger log_driver.Logger) []string {
+	var names []string
+	if identity.Repo != "" {
+		names = []string{identity.Repo}
+	} else {
+		var err error
+		names, err = repos.List(server.GitRepoDir, identity.User)
+		if err != nil {
+			logger.Errorf("Failed to list repositories of %s due to %s", identity.User, err)
+		}
+	}
+	pushable := []string{}
+	for _, name := range names {
+		user, repo, err := repos.Split(name)
+		if err == nil && identity.CanWrite(user, repo) {
+			pushable = append(pushable, name)
+		}
+	}
+	return pushable
+}
+
+// writeSites writes a line of the URL and the publish status of each repository in names, aligned
+// in columns after indent
+func (server *Server) writeSites(output io.Writer, names []string, indent string, logger log_driver.Logger) {
+	writer := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		url := ""
+		if server.Publisher != nil {
+			url = server.Publisher.SiteUrl(name)
+		}
+		if url == "" {
+			url = "-"
+		}
+		fmt.Fprintf(writer, "%s%s\t%s\t%s\n", indent, name, url, server.publishStatus(name, logger))
+	}
+	writer.Flush()
+}
+
+// publishStatus describes the latest outcome of publishing the repository name
+func (server *Server) publishStatus(name string, logger log_driver.Logger) string {
+	user, repo, _ := repos.Split(name)
+	history, err := publish.History(repos.Open(repos.Path(server.GitRepoDir, user, repo)), 1)
+	if err != nil {
+		logger.Errorf("Failed to read publish history of %s due to %s", name, err)
+		return "unknown"
+	} else if len(history) == 0 {
+		return "never published"
+	}
+	latest := history[0]
+	at := latest.Time.Local().Format("2006-01-02 15:04")
+	if latest.Type == events.PublishSucceeded {
+		return fmt.Sprintf("published %s at %s", shortSha(latest.NewSha), at)
+	}
+	// The error may end with the output of the build, which is left to the publish history
+	reason := strings.SplitN(strings.TrimSpace(latest.Error), "\n", 2)[0]
+	return fmt.Sprintf("failed to publish %s at %s: %s", shortSha(latest.NewSha), at, reason)
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,51 @@
+package sshd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/repos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "banner")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	for _, name := range []string{"pry/ruby-pry", "pry/pry-doc", "rails/rails"} {
+		user, repo, err := repos.Split(name)
+		assert.Nil(t, err)
+		_, err = repos.Create(dir, user, repo)
+		assert.Nil(t, err)
+	}
+	at := time.Date(2017, 3, 1, 10, 30, 0, 0, time.Local)
+	for _, event := range []*events.Event{
+		{Type: events.PublishSucceeded, Repo: "pry/ruby-pry", NewSha: "0123456789abcdef", Time: at},
+		{Type: events.PublishFailed, Repo: "pry/ruby-pry", NewSha: "fedcba9876543210", Time: at,
+			Error: "Source `dist` is not found\nbuild output"},
+	} {
+		line, err := json.Marshal(event)
+		assert.Nil(t, err)
+		assert.Nil(t, repos.Open(repos.Path(dir, "pry", "ruby-pry")).AppendLog("history.log", line))
+	}
+	server := &Server{GitRepoDir: dir}
+
+	assert.EqualValues(t, server.banner(&auth.Identity{User: "pry"}, logger),
+		"Hi pry! You've successfully authenticated, but Pages does not provide shell access.\n\n"+
+			"Repositories you can push to:\n"+
+			"    pry/pry-doc   -  never published\n"+
+			"    pry/ruby-pry  -  failed to publish fedcba9 at 2017-03-01 10:30: Source `dist` is not found\n\n"+
+			"Run the `help` command over SSH for the commands managing your sites.\n")
+	assert.EqualValues(t, server.banner(&auth.Identity{User: auth.DeployUser("rails/rails"), Repo: "rails/rails"}, logger),
+		"Hi deploy:rails/rails! You've successfully authenticated, but Pages does not provide shell access.\n\n"+
+			"You have no repositories to push to yet.\n")
+}
@@ -0,0 +1,359 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bachue/pages/audit"
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/publish"
+	"github.com/bachue/pages/repos"
+	"golang.org/x/crypto/ssh"
+)
+
+// siteCommand is a command managing sites run over SSH, such as `ssh git@pages sites`. They are run
+// in place of a shell, which is never executed.
+type siteCommand struct {
+	name        string
+	args        string
+	description string
+	run         func(session *siteSession, args []string) int
+}
+
+var siteCommands []*siteCommand
+
+func init() {
+	siteCommands = []*siteCommand{
+		{"help", "", "List the commands", siteHelp},
+		{"sites", "", "List the sites you can push to with their URLs and publish status", listSites},
+		{"publish", "<user>/<repo>", "Publish the head of the publish branch of a site", publishSite},
+		{"rollback", "<user>/<repo> <sha>", "Publish a commit of a site published before again", rollbackSite},
+		{"logs", "<user>/<repo> [<count>]", "Show the latest outcomes of publishing a site, 10 by default", showLogs},
+		{"domain set", "<user>/<repo> <domain>", "Serve a site at a custom domain", setDomain},
+		{"domain unset", "<user>/<repo>", "Remove the custom domain of a site", unsetDomain},
+		{"keys list", "", "List your SSH public keys", listKeys},
+		{"keys add", "", "Authorize the SSH public key read from stdin", addKey},
+		{"keys remove", "<fingerprint>", "Revoke an SSH public key of yours", removeKey},
+	}
+}
+
+// maxKeySize limits the public key read by `keys add`
+const maxKeySize = 16 * 1024
+
+// siteSession is where a site command runs, it keeps the outcome to be audited. cert tells if identity
+// is authenticated by a certificate rather than a key of its own.
+type siteSession struct {
+	server   *Server
+	identity *auth.Identity
+	cert     bool
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	logger   log_driver.Logger
+	command  string
+	// repo is the repository the command is about, and denied tells if identity may not access it
+	repo   string
+	denied bool
+}
+
+// handleSiteCommand runs the site command cmd on channel, and audits it
+func (server *Server) handleSiteCommand(channel ssh.Channel, cmd string, conn *ssh.ServerConn,
+	logger log_driver.Logger, doReply func(bool)) {
+	_, cert := conn.Permissions.Extensions[certExtension]
+	session := &siteSession{server: server, identity: getIdentity(conn), cert: cert, stdin: channel,
+		stdout: channel, stderr: channel.Stderr(), logger: logger}
+	command, args := findSiteCommand(strings.Fields(cmd))
+	doReply(true)
+
+	status := session.run(command, cmd, args)
+	sendExitStatus(channel, status)
+	outcome := exitOutcome(status)
+	if session.denied {
+		outcome = audit.Denied
+	}
+	server.auditCommand(conn, session.command, session.repo, outcome, map[string]interface{}{"status": status})
+}
+
+// siteCommandName returns the name of the site command cmd runs, which labels metrics.SshCommandDuration
+func siteCommandName(cmd string) string {
+	if command, _ := findSiteCommand(strings.Fields(cmd)); command != nil {
+		return command.name
+	}
+	return "unknown"
+}
+
+// findSiteCommand returns the command named by the leading words of args, and the rest of args
+func findSiteCommand(args []string) (*siteCommand, []string) {
+	for _, command := range siteCommands {
+		words := strings.Fields(command.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == command.name {
+			return command, args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+// run runs command with args, cmd is the whole command line which may be unknown
+func (session *siteSession) run(command *siteCommand, cmd string, args []string) int {
+	if command == nil {
+		session.command = strings.TrimSpace(cmd)
+		session.logger.Warnf("Rejected unknown command `%s`", session.command)
+		fmt.Fprintf(session.stderr, "error: Unknown command `%s`, run `help` for the commands\n", session.command)
+		return 2
+	}
+	session.command = command.name
+	return command.run(session, args)
+}
+
+// openRepo returns the repository name if identity may access it, to push to it if write is set
+func (session *siteSession) openRepo(name string, write bool) (*repos.Repo, error) {
+	user, repo, err := repos.Split(name)
+	if err != nil {
+		session.denied = true
+		return nil, err
+	}
+	session.repo = user + "/" + repo
+	allowed := session.identity.CanRead(user, repo)
+	if allowed && write {
+		allowed = session.identity.CanWrite(user, repo)
+	}
+	repoPath := repos.Path(session.server.GitRepoDir, user, repo)
+	if allowed {
+		_, err = os.Stat(repoPath)
+		allowed = err == nil
+	}
+	if !allowed {
+		// Not telling apart missing repositories from forbidden ones, to keep their existence private
+		session.denied = true
+		return nil, fmt.Errorf("Repository %s/%s is not found", user, repo)
+	}
+	return repos.Open(repoPath), nil
+}
+
+func (session *siteSession) publisher() (*publish.Publisher, error) {
+	if session.server.Publisher == nil {
+		return nil, fmt.Errorf("Publishing is disabled")
+	}
+	return session.server.Publisher, nil
+}
+
+// allowPublish applies the rate limit of the pushes, since publishing builds and uploads the same
+func (session *siteSession) allowPublish() error {
+	if session.server.guard.allowPush(session.identity.User) {
+		return nil
+	}
+	session.logger.With("repo", session.repo).Warnf("Rejected `%s` due to too many pushes", session.command)
+	session.denied = true
+	return fmt.Errorf("Too many pushes, please retry later")
+}
+
+func (session *siteSession) badUsage() int {
+	for _, command := range siteCommands {
+		if command.name == session.command {
+			fmt.Fprintf(session.stderr, "usage: %s\n", strings.TrimSpace(command.name+" "+command.args))
+		}
+	}
+	return 2
+}
+
+func (session *siteSession) report(err error, format string, args ...interface{}) int {
+	if err != nil {
+		if !session.denied {
+			session.logger.With("repo", session.repo).Warnf("Failed to run `%s` due to %s", session.command, err)
+		}
+		fmt.Fprintf(session.stderr, "error: %s\n", err)
+		return 1
+	}
+	if format != "" {
+		fmt.Fprintf(session.stdout, format+"\n", args...)
+	}
+	return 0
+}
+
+func siteHelp(session *siteSession, args []string) int {
+	fmt.Fprintf(session.stdout, "Commands:\n")
+	for _, command := range siteCommands {
+		fmt.Fprintf(session.stdout, "  %-40s %s\n", strings.TrimSpace(command.name+" "+command.args),
+			command.description)
+	}
+	fmt.Fprintf(session.stdout, "\nAs well as git, which pushes to and fetches from the sites.\n")
+	return 0
+}
+
+func listSites(session *siteSession, args []string) int {
+	if len(args) != 0 {
+		return session.badUsage()
+	}
+	names := session.server.pushableRepos(session.identity, session.logger)
+	session.server.writeSites(session.stdout, names, "", session.logger)
+	return 0
+}
+
+func publishSite(session *siteSession, args []string) int {
+	if len(args) != 1 {
+		return session.badUsage()
+	}
+	publisher, err := session.publisher()
+	if err == nil {
+		_, err = session.openRepo(args[0], true)
+	}
+	if err == nil {
+		err = session.allowPublish()
+	}
+	var event *events.Event
+	if err == nil {
+		event, err = publisher.Republish(session.repo, session.identity.User)
+	}
+	if err != nil {
+		return session.report(err, "")
+	}
+	return session.report(nil, "Publishing %s at %s, see `logs %s` for the outcome",
+		session.repo, shortSha(event.NewSha), session.repo)
+}
+
+func rollbackSite(session *siteSession, args []string) int {
+	if len(args) != 2 {
+		return session.badUsage()
+	}
+	publisher, err := session.publisher()
+	if err == nil {
+		_, err = session.openRepo(args[0], true)
+	}
+	if err == nil {
+		err = session.allowPublish()
+	}
+	var event *events.Event
+	if err == nil {
+		event, err = publisher.Rollback(session.repo, args[1], session.identity.User)
+	}
+	if err != nil {
+		return session.report(err, "")
+	}
+	return session.report(nil, "Rolling %s back to %s, see `logs %s` for the outcome",
+		session.repo, shortSha(event.NewSha), session.repo)
+}
+
+func showLogs(session *siteSession, args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		return session.badUsage()
+	}
+	count := 10
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count <= 0 {
+			return session.badUsage()
+		}
+	}
+	repo, err := session.openRepo(args[0], false)
+	var history []*events.Event
+	if err == nil {
+		history, err = publish.History(repo, count)
+	}
+	if err != nil {
+		return session.report(err, "")
+	}
+	for _, event := range history {
+		at := event.Time.Local().Format("2006-01-02 15:04:05")
+		if event.Type == events.PublishSucceeded {
+			fmt.Fprintf(session.stdout, "%s  published %s  %s by %s\n", at, shortSha(event.NewSha), event.Ref, event.Pusher)
+			continue
+		}
+		fmt.Fprintf(session.stdout, "%s  failed to publish %s  %s by %s\n", at, shortSha(event.NewSha), event.Ref,
+			event.Pusher)
+		for _, line := range strings.Split(strings.TrimSpace(event.Error), "\n") {
+			fmt.Fprintf(session.stdout, "    %s\n", line)
+		}
+	}
+	return 0
+}
+
+func setDomain(session *siteSession, args []string) int {
+	if len(args) != 2 {
+		return session.badUsage()
+	}
+	domain := strings.ToLower(args[1])
+	repo, err := session.openRepo(args[0], true)
+	if err == nil && !repos.IsValidDomain(domain) {
+		err = fmt.Errorf("Invalid domain `%s`", args[1])
+	}
+	session.server.domainMutex.Lock()
+	defer session.server.domainMutex.Unlock()
+	owner := ""
+	if err == nil {
+		owner, err = repos.FindByDomain(session.server.GitRepoDir, domain)
+	}
+	if err == nil && owner != "" && owner != session.repo {
+		err = fmt.Errorf("Domain %s is already used by another site", domain)
+	}
+	if err == nil {
+		err = repo.SetDomain(domain)
+	}
+	return session.report(err, "Set the domain of %s to %s", session.repo, domain)
+}
+
+func unsetDomain(session *siteSession, args []string) int {
+	if len(args) != 1 {
+		return session.badUsage()
+	}
+	repo, err := session.openRepo(args[0], true)
+	if err == nil {
+		session.server.domainMutex.Lock()
+		err = repo.SetDomain("")
+		session.server.domainMutex.Unlock()
+	}
+	return session.report(err, "Removed the custom domain of %s", session.repo)
+}
+
+func listKeys(session *siteSession, args []string) int {
+	if len(args) != 0 {
+		return session.badUsage()
+	}
+	user := session.server.Users.User(session.identity.User)
+	if user == nil {
+		return session.report(fmt.Errorf("User %s is not found", session.identity.User), "")
+	}
+	for _, line := range user.Keys {
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(session.stdout, "%s %s %s\n", ssh.FingerprintSHA256(key), key.Type(), comment)
+	}
+	return 0
+}
+
+func addKey(session *siteSession, args []string) int {
+	if len(args) != 0 {
+		return session.badUsage()
+	}
+	// Otherwise a certificate, which expires and may be revoked, would be turned into a permanent key
+	if session.cert {
+		session.denied = true
+		return session.report(fmt.Errorf("Keys may not be added when authenticated by a certificate"), "")
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(session.stdin, maxKeySize))
+	line := strings.TrimSpace(string(content))
+	if err == nil && strings.Contains(line, "\n") {
+		err = fmt.Errorf("Expected a single public key")
+	}
+	fingerprint := ""
+	if err == nil {
+		fingerprint, err = session.server.Users.AddKey(session.identity.User, line)
+	}
+	return session.report(err, "Added key %s", fingerprint)
+}
+
+func removeKey(session *siteSession, args []string) int {
+	if len(args) != 1 {
+		return session.badUsage()
+	}
+	err := session.server.Users.RevokeKey(session.identity.User, args[0])
+	return session.report(err, "Revoked key %s", args[0])
+}
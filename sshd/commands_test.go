@@ -0,0 +1,182 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/publish"
+	"github.com/bachue/pages/repos"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSiteCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commands")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "ERROR"})
+	assert.Nil(t, err)
+	for _, name := range []string{"pry/ruby-pry", "rails/rails"} {
+		user, repo, err := repos.Split(name)
+		assert.Nil(t, err)
+		_, err = repos.Create(dir, user, repo)
+		assert.Nil(t, err)
+	}
+	event := &events.Event{Type: events.PublishFailed, Repo: "pry/ruby-pry", Ref: "refs/heads/master",
+		NewSha: "fedcba9876543210", Pusher: "pry", Time: time.Date(2017, 3, 1, 10, 30, 0, 0, time.Local),
+		Error: "Source `dist` is not found\nbuild output"}
+	line, err := json.Marshal(event)
+	assert.Nil(t, err)
+	assert.Nil(t, repos.Open(repos.Path(dir, "pry", "ruby-pry")).AppendLog("history.log", line))
+	assert.Nil(t, ioutil.WriteFile(dir+"/users.yml", []byte("users:\n  pry:\n  rails:\n"), 0600))
+	users, err := auth.NewStore(dir + "/users.yml")
+	assert.Nil(t, err)
+	server := &Server{GitRepoDir: dir, Users: users}
+
+	pry := &auth.Identity{User: "pry"}
+	run := func(identity *auth.Identity, cmd string, stdin string) (int, string, string, bool) {
+		var stdout, stderr bytes.Buffer
+		session := &siteSession{server: server, identity: identity, stdin: strings.NewReader(stdin),
+			stdout: &stdout, stderr: &stderr, logger: logger}
+		command, args := findSiteCommand(strings.Fields(cmd))
+		status := session.run(command, cmd, args)
+		return status, stdout.String(), stderr.String(), session.denied
+	}
+
+	assert.EqualValues(t, siteCommandName("domain set pry/ruby-pry pry.example.com"), "domain set")
+	assert.EqualValues(t, siteCommandName("bash -c id"), "unknown")
+	status, _, stderr, _ := run(pry, "bash -c id", "")
+	assert.EqualValues(t, status, 2)
+	assert.EqualValues(t, stderr, "error: Unknown command `bash -c id`, run `help` for the commands\n")
+	status, stdout, _, _ := run(pry, "help", "")
+	assert.EqualValues(t, status, 0)
+	assert.Contains(t, stdout, "domain set <user>/<repo> <domain>")
+	status, _, stderr, _ = run(pry, "logs", "")
+	assert.EqualValues(t, status, 2)
+	assert.EqualValues(t, stderr, "usage: logs <user>/<repo> [<count>]\n")
+
+	status, stdout, _, _ = run(pry, "sites", "")
+	assert.EqualValues(t, status, 0)
+	assert.EqualValues(t, stdout, "pry/ruby-pry  -  failed to publish fedcba9 at 2017-03-01 10:30: Source `dist` is not found\n")
+	status, stdout, _, _ = run(pry, "logs pry/ruby-pry", "")
+	assert.EqualValues(t, status, 0)
+	assert.EqualValues(t, stdout, "2017-03-01 10:30:00  failed to publish fedcba9  refs/heads/master by pry\n"+
+		"    Source `dist` is not found\n    build output\n")
+	status, _, stderr, _ = run(pry, "publish pry/ruby-pry", "")
+	assert.EqualValues(t, status, 1)
+	assert.EqualValues(t, stderr, "error: Publishing is disabled\n")
+
+	// Publishing is limited the same as pushing
+	server.Publisher, err = publish.New(&config.Storage{Type: "local", Root: dir + "/sites", Bucket: "pages"},
+		&config.Build{Timeout: 60, Workers: 1}, dir, events.NewBus(logger), logger)
+	assert.Nil(t, err)
+	server.guard = newGuard(&config.Sshd{Limits: config.Limits{Pushes: config.Limit{Rate: 1, Burst: 1}}})
+	status, _, stderr, _ = run(pry, "publish pry/ruby-pry", "")
+	assert.EqualValues(t, status, 1)
+	assert.EqualValues(t, stderr, "error: Repository pry/ruby-pry has no publish branch\n")
+	status, _, stderr, denied := run(pry, "rollback pry/ruby-pry fedcba9", "")
+	assert.EqualValues(t, status, 1)
+	assert.EqualValues(t, stderr, "error: Too many pushes, please retry later\n")
+	assert.True(t, denied)
+
+	// The repositories of the others are not found
+	status, _, stderr, denied = run(pry, "logs rails/rails", "")
+	assert.EqualValues(t, status, 1)
+	assert.EqualValues(t, stderr, "error: Repository rails/rails is not found\n")
+	assert.True(t, denied)
+	deployKey := &auth.Identity{User: auth.DeployUser("pry/ruby-pry"), Repo: "pry/ruby-pry"}
+	status, _, _, denied = run(deployKey, "domain set pry/ruby-pry pry.example.com", "")
+	assert.EqualValues(t, status, 1)
+	assert.True(t, denied)
+
+	status, stdout, _, _ = run(pry, "domain set pry/ruby-pry Pry.Example.com", "")
+	assert.EqualValues(t, status, 0)
+	assert.EqualValues(t, stdout, "Set the domain of pry/ruby-pry to pry.example.com\n")
+	domain, err := repos.Open(repos.Path(dir, "pry", "ruby-pry")).Domain()
+	assert.Nil(t, err)
+	assert.EqualValues(t, domain, "pry.example.com")
+	status, _, stderr, _ = run(&auth.Identity{User: "rails"}, "domain set rails/rails pry.example.com", "")
+	assert.EqualValues(t, status, 1)
+	assert.EqualValues(t, stderr, "error: Domain pry.example.com is already used by another site\n")
+	status, _, stderr, _ = run(pry, "domain set pry/ruby-pry pry.example.com/docs", "")
+	assert.EqualValues(t, status, 1)
+	assert.EqualValues(t, stderr, "error: Invalid domain `pry.example.com/docs`\n")
+	status, _, _, _ = run(pry, "domain unset pry/ruby-pry", "")
+	assert.EqualValues(t, status, 0)
+	domain, err = repos.Open(repos.Path(dir, "pry", "ruby-pry")).Domain()
+	assert.Nil(t, err)
+	assert.Empty(t, domain)
+
+	// Only one of the sites setting the same domain at once gets it
+	var wait sync.WaitGroup
+	var succeeded int32
+	for i := 0; i < 10; i++ {
+		identity, repo := pry, "pry/ruby-pry"
+		if i%2 == 1 {
+			identity, repo = &auth.Identity{User: "rails"}, "rails/rails"
+		}
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if status, _, _, _ := run(identity, "domain set "+repo+" docs.example.com", ""); status == 0 {
+				atomic.AddInt32(&succeeded, 1)
+			}
+		}()
+	}
+	wait.Wait()
+	owner, err := repos.FindByDomain(dir, "docs.example.com")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, owner)
+	assert.True(t, succeeded >= 1)
+	for _, name := range []string{"pry/ruby-pry", "rails/rails"} {
+		user, repo, _ := repos.Split(name)
+		domain, err = repos.Open(repos.Path(dir, user, repo)).Domain()
+		assert.Nil(t, err)
+		if name != owner {
+			assert.Empty(t, domain)
+		}
+	}
+	status, _, _, _ = run(pry, "domain unset pry/ruby-pry", "")
+	assert.EqualValues(t, status, 0)
+	status, _, _, _ = run(&auth.Identity{User: "rails"}, "domain unset rails/rails", "")
+	assert.EqualValues(t, status, 0)
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	key, err := ssh.NewPublicKey(publicKey)
+	assert.Nil(t, err)
+	fingerprint := ssh.FingerprintSHA256(key)
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " pry@laptop\n"
+	var stderrBuffer bytes.Buffer
+	certSession := &siteSession{server: server, identity: pry, cert: true, stdin: strings.NewReader(authorizedKey),
+		stdout: ioutil.Discard, stderr: &stderrBuffer, logger: logger}
+	command, args := findSiteCommand([]string{"keys", "add"})
+	assert.EqualValues(t, certSession.run(command, "keys add", args), 1)
+	assert.EqualValues(t, stderrBuffer.String(), "error: Keys may not be added when authenticated by a certificate\n")
+	assert.True(t, certSession.denied)
+	assert.Empty(t, users.User("pry").Keys)
+	status, stdout, _, _ = run(pry, "keys add", authorizedKey)
+	assert.EqualValues(t, status, 0)
+	assert.EqualValues(t, stdout, "Added key "+fingerprint+"\n")
+	status, stdout, _, _ = run(pry, "keys list", "")
+	assert.EqualValues(t, status, 0)
+	assert.EqualValues(t, stdout, fingerprint+" ssh-ed25519 pry@laptop\n")
+	status, _, _, _ = run(&auth.Identity{User: "rails"}, "keys remove "+fingerprint, "")
+	assert.EqualValues(t, status, 1)
+	status, _, _, _ = run(pry, "keys remove "+fingerprint, "")
+	assert.EqualValues(t, status, 0)
+	assert.Empty(t, users.User("pry").Keys)
+}
@@ -0,0 +1,156 @@
+package sshd
+
+import (
+	"net"
+	"sync"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/ratelimit"
+)
+
+// The reasons of rejecting a connection, also the labels of metrics.SshRejectedConnections
+const (
+	reasonDenied      = "denied"
+	reasonBanned      = "banned"
+	reasonRateLimited = "rate_limited"
+	reasonMaxPerIp    = "max_per_ip"
+	reasonMaxPerUser  = "max_per_user"
+)
+
+// guard applies the access lists, the bans and the rate limits of sshd to the source IPs and the users
+type guard struct {
+	mutex           sync.Mutex
+	limits          config.Limits
+	allow           []*net.IPNet
+	deny            []*net.IPNet
+	connections     *ratelimit.Limiter
+	auth            *ratelimit.Limiter
+	userConnections *ratelimit.Limiter
+	pushes          *ratelimit.Limiter
+	jail            *ratelimit.Jail
+	ipConns         *ratelimit.Counter
+	userConns       *ratelimit.Counter
+}
+
+func newGuard(sshdConfig *config.Sshd) *guard {
+	limits := sshdConfig.Limits
+	guard := &guard{
+		connections:     ratelimit.NewLimiter(limits.Connections),
+		auth:            ratelimit.NewLimiter(limits.Auth),
+		userConnections: ratelimit.NewLimiter(limits.UserConnections),
+		pushes:          ratelimit.NewLimiter(limits.Pushes),
+		jail:            ratelimit.NewJail(sshdConfig.Ban),
+		ipConns:         ratelimit.NewCounter(),
+		userConns:       ratelimit.NewCounter(),
+	}
+	guard.reconfigure(sshdConfig)
+	return guard
+}
+
+// reconfigure applies the limits of sshdConfig, the tokens, the failures and the bans are kept
+func (guard *guard) reconfigure(sshdConfig *config.Sshd) {
+	limits := sshdConfig.Limits
+	guard.connections.Reconfigure(limits.Connections)
+	guard.auth.Reconfigure(limits.Auth)
+	guard.userConnections.Reconfigure(limits.UserConnections)
+	guard.pushes.Reconfigure(limits.Pushes)
+	guard.jail.Reconfigure(sshdConfig.Ban)
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.limits = limits
+	guard.allow = parseNetworks(sshdConfig.Allow)
+	guard.deny = parseNetworks(sshdConfig.Deny)
+}
+
+// admit returns why a new connection from ip is rejected, or "" if it's admitted, then leave must be
+// called once it's closed.
+func (guard *guard) admit(ip string) string {
+	guard.mutex.Lock()
+	allow, deny, maxPerIp := guard.allow, guard.deny, guard.limits.MaxPerIp
+	guard.mutex.Unlock()
+	parsed := net.ParseIP(ip)
+	if (len(allow) > 0 && !contains(allow, parsed)) || contains(deny, parsed) {
+		return reasonDenied
+	}
+	if guard.jail.IsBanned(ip) {
+		return reasonBanned
+	}
+	if !guard.connections.Allow(ip) {
+		return reasonRateLimited
+	}
+	if !guard.ipConns.Acquire(ip, maxPerIp) {
+		return reasonMaxPerIp
+	}
+	return ""
+}
+
+func (guard *guard) leave(ip string) {
+	guard.ipConns.Release(ip)
+}
+
+// admitUser is admit for the user authenticated, then leaveUser must be called once it's closed
+func (guard *guard) admitUser(user string) string {
+	guard.mutex.Lock()
+	maxPerUser := guard.limits.MaxPerUser
+	guard.mutex.Unlock()
+	if !guard.userConnections.Allow(user) {
+		return reasonRateLimited
+	}
+	if !guard.userConns.Acquire(user, maxPerUser) {
+		return reasonMaxPerUser
+	}
+	return ""
+}
+
+func (guard *guard) leaveUser(user string) {
+	guard.userConns.Release(user)
+}
+
+// allowAuth tells if ip may attempt to authenticate
+func (guard *guard) allowAuth(ip string) bool {
+	return !guard.jail.IsBanned(ip) && guard.auth.Allow(ip)
+}
+
+// authFailed records a failed authentication of ip, it returns true if ip is banned due to it
+func (guard *guard) authFailed(ip string) bool {
+	return guard.jail.Fail(ip)
+}
+
+func (guard *guard) allowPush(user string) bool {
+	return guard.pushes.Allow(user)
+}
+
+// parseNetworks parses the CIDRs validated by config
+func parseNetworks(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIp returns the IP of addr without the port
+func remoteIp(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,158 @@
+package sshd
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/log_driver"
+	"golang.org/x/crypto/ssh"
+)
+
+// The OpenSSH extensions to advertise the host keys after authentication, and to prove the server
+// holds the ones which the client doesn't know yet, see PROTOCOL of OpenSSH
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// loadHostKeys returns the host keys used in the handshakes, and all of them including the pending
+// ones, which are advertised. The missing host key files are generated.
+func loadHostKeys(sshdConfig *config.Sshd, logger log_driver.Logger) ([]ssh.Signer, []ssh.Signer, error) {
+	var active, all []ssh.Signer
+	if sshdConfig.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(sshdConfig.PrivateKey))
+		if err != nil {
+			return nil, nil, err
+		}
+		active = append(active, signer)
+		all = append(all, signer)
+	}
+	for _, hostKey := range sshdConfig.HostKeys {
+		content, err := ioutil.ReadFile(hostKey.File)
+		if os.IsNotExist(err) {
+			content, err = generateHostKey(hostKey.File, hostKey.Type)
+			if err == nil {
+				logger.Infof("Generated %s host key %s", hostKey.Type, hostKey.File)
+			}
+		}
+		if err != nil {
+			logger.Errorf("Failed to load host key %s due to %s", hostKey.File, err)
+			return nil, nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			logger.Errorf("Failed to parse host key %s due to %s", hostKey.File, err)
+			return nil, nil, err
+		}
+		if !hostKey.Pending {
+			active = append(active, signer)
+		}
+		all = append(all, signer)
+	}
+	return active, all, nil
+}
+
+// generateHostKey writes a new private key of keyType into path in PEM, and returns the content
+func generateHostKey(path string, keyType string) ([]byte, error) {
+	var privateKey interface{}
+	var err error
+	switch keyType {
+	case "ed25519":
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		err = fmt.Errorf("Unsupported host key type `%s`", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	// Never overwrite a key created meanwhile
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return content, nil
+}
+
+// hostKeysPayload lists the public keys of hostKeys, as the payload of hostKeysRequest
+func hostKeysPayload(hostKeys []ssh.Signer) []byte {
+	var payload []byte
+	for _, hostKey := range hostKeys {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{hostKey.PublicKey().Marshal()})...)
+	}
+	return payload
+}
+
+// proveHostKeys signs each public key requested by payload with the session id, it returns an error if
+// any of them is not a host key.
+func proveHostKeys(hostKeys []ssh.Signer, sessionId []byte, payload []byte) ([]byte, error) {
+	var response []byte
+	for len(payload) > 0 {
+		var key struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		err := ssh.Unmarshal(payload, &key)
+		if err != nil {
+			return nil, err
+		}
+		payload = key.Rest
+		var signer ssh.Signer
+		for _, hostKey := range hostKeys {
+			if string(hostKey.PublicKey().Marshal()) == string(key.Key) {
+				signer = hostKey
+			}
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("Unknown host key to prove")
+		}
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionId []byte
+			Key       []byte
+		}{hostKeysProveRequest, sessionId, key.Key})
+		var signature *ssh.Signature
+		// OpenSSH clients accept any RSA signature algorithm unless RSA was negotiated in the handshake,
+		// when it's rsa-sha2-512 by default
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		} else {
+			signature, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, ssh.Marshal(struct{ Signature []byte }{ssh.Marshal(signature)})...)
+	}
+	return response, nil
+}
@@ -0,0 +1,64 @@
+package sshd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/log_driver"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host-keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+
+	sshdConfig := &config.Sshd{HostKeys: []config.HostKey{
+		{File: dir + "/ed25519", Type: "ed25519"},
+		{File: dir + "/keys/ecdsa", Type: "ecdsa"},
+		{File: dir + "/next_ed25519", Type: "ed25519", Pending: true},
+	}}
+	active, all, err := loadHostKeys(sshdConfig, logger)
+	assert.Nil(t, err)
+	assert.Len(t, active, 2)
+	assert.Len(t, all, 3)
+	assert.EqualValues(t, active[0].PublicKey().Type(), ssh.KeyAlgoED25519)
+	assert.EqualValues(t, active[1].PublicKey().Type(), ssh.KeyAlgoECDSA256)
+	info, err := os.Stat(dir + "/keys/ecdsa")
+	assert.Nil(t, err)
+	assert.EqualValues(t, info.Mode().Perm(), 0600)
+
+	// Loaded rather than generated again
+	_, reloaded, err := loadHostKeys(sshdConfig, logger)
+	assert.Nil(t, err)
+	for i := range all {
+		assert.EqualValues(t, reloaded[i].PublicKey().Marshal(), all[i].PublicKey().Marshal())
+	}
+
+	sessionId := []byte("session")
+	payload := hostKeysPayload(all[2:])
+	response, err := proveHostKeys(all, sessionId, payload)
+	assert.Nil(t, err)
+	var proof struct {
+		Signature []byte
+		Rest      []byte `ssh:"rest"`
+	}
+	assert.Nil(t, ssh.Unmarshal(response, &proof))
+	assert.Len(t, proof.Rest, 0)
+	signature := &ssh.Signature{}
+	assert.Nil(t, ssh.Unmarshal(proof.Signature, signature))
+	data := ssh.Marshal(struct {
+		Request   string
+		SessionId []byte
+		Key       []byte
+	}{hostKeysProveRequest, sessionId, all[2].PublicKey().Marshal()})
+	assert.Nil(t, all[2].PublicKey().Verify(data, signature))
+
+	_, err = proveHostKeys(all[:2], sessionId, payload)
+	assert.NotNil(t, err)
+}
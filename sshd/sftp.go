@@ -0,0 +1,114 @@
+package sshd
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bachue/pages/auth"
+	"github.com/pkg/sftp"
+)
+
+// Files is the read-only view of the Git repositories served by SFTP, such as GitFs. The names are
+// `<user>/<repo>/<path>` of the files in the tree of their master branch.
+type Files interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	// OpenFile opens a file to be read, which is closed once read if it's an io.Closer
+	OpenFile(name string) (io.ReaderAt, error)
+	LinkTarget(name string) (string, error)
+}
+
+// sftpHandlers serves files read-only, hiding the repositories identity can't read
+type sftpHandlers struct {
+	files    Files
+	identity *auth.Identity
+}
+
+func newSftpServer(channel io.ReadWriteCloser, files Files, identity *auth.Identity) *sftp.RequestServer {
+	handlers := &sftpHandlers{files: files, identity: identity}
+	return sftp.NewRequestServer(channel, sftp.Handlers{FileGet: handlers, FilePut: handlers, FileCmd: handlers,
+		FileList: handlers})
+}
+
+func (handlers *sftpHandlers) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	name, err := handlers.resolve(request.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return handlers.files.OpenFile(name)
+}
+
+func (handlers *sftpHandlers) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	return nil, sftp.ErrSSHFxPermissionDenied
+}
+
+func (handlers *sftpHandlers) Filecmd(request *sftp.Request) error {
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+func (handlers *sftpHandlers) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	name, err := handlers.resolve(request.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch request.Method {
+	case "List":
+		infos, err := handlers.files.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		readable := make(listerAt, 0, len(infos))
+		for _, info := range infos {
+			if _, err := handlers.resolve(name + "/" + info.Name()); err == nil {
+				readable = append(readable, info)
+			}
+		}
+		return readable, nil
+	case "Stat":
+		info, err := handlers.files.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (handlers *sftpHandlers) Readlink(filePath string) (string, error) {
+	name, err := handlers.resolve(filePath)
+	if err != nil {
+		return "", err
+	}
+	return handlers.files.LinkTarget(name)
+}
+
+// resolve returns the name of filePath in files. Only the repositories identity can read and their
+// parent directories are found, the others are not told apart from the missing ones.
+func (handlers *sftpHandlers) resolve(filePath string) (string, error) {
+	name := strings.Trim(path.Clean("/"+filePath), "/")
+	parts := strings.SplitN(name, "/", 3)
+	switch {
+	case name == "":
+		return name, nil
+	case len(parts) == 1 && handlers.identity.CanBrowse(parts[0]):
+		return name, nil
+	case len(parts) > 1 && handlers.identity.CanRead(parts[0], parts[1]):
+		return name, nil
+	}
+	return "", os.ErrNotExist
+}
+
+type listerAt []os.FileInfo
+
+func (lister listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(lister)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, lister[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
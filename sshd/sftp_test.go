@@ -0,0 +1,108 @@
+package sshd
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/bachue/pages/auth"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+)
+
+// dirFiles reads the files from a directory, in place of GitFs
+type dirFiles string
+
+func (dir dirFiles) Stat(name string) (os.FileInfo, error) {
+	return os.Lstat(string(dir) + "/" + name)
+}
+
+func (dir dirFiles) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(string(dir) + "/" + name)
+}
+
+func (dir dirFiles) OpenFile(name string) (io.ReaderAt, error) {
+	return os.Open(string(dir) + "/" + name)
+}
+
+func (dir dirFiles) LinkTarget(name string) (string, error) {
+	return os.Readlink(string(dir) + "/" + name)
+}
+
+func TestSftp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, repo := range []string{"pry/ruby-pry/lib", "pry/pry-doc", "rails/rails"} {
+		assert.Nil(t, os.MkdirAll(dir+"/"+repo, 0755))
+	}
+	assert.Nil(t, ioutil.WriteFile(dir+"/pry/ruby-pry/index.html", []byte("<h1>Pry</h1>"), 0644))
+	assert.Nil(t, ioutil.WriteFile(dir+"/rails/rails/index.html", []byte("<h1>Rails</h1>"), 0644))
+	assert.Nil(t, os.Symlink("index.html", dir+"/pry/ruby-pry/home.html"))
+
+	connect := func(identity *auth.Identity) *sftp.Client {
+		serverConn, clientConn := net.Pipe()
+		go newSftpServer(serverConn, dirFiles(dir), identity).Serve()
+		client, err := sftp.NewClientPipe(clientConn, clientConn)
+		assert.Nil(t, err)
+		return client
+	}
+	names := func(infos []os.FileInfo) []string {
+		var result []string
+		for _, info := range infos {
+			result = append(result, info.Name())
+		}
+		return result
+	}
+
+	client := connect(&auth.Identity{User: "pry"})
+	defer client.Close()
+	infos, err := client.ReadDir("/")
+	assert.Nil(t, err)
+	assert.EqualValues(t, names(infos), []string{"pry"})
+	infos, err = client.ReadDir("/pry")
+	assert.Nil(t, err)
+	assert.EqualValues(t, names(infos), []string{"pry-doc", "ruby-pry"})
+	infos, err = client.ReadDir("/pry/ruby-pry")
+	assert.Nil(t, err)
+	assert.EqualValues(t, names(infos), []string{"home.html", "index.html", "lib"})
+
+	file, err := client.Open("/pry/ruby-pry/index.html")
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	assert.EqualValues(t, string(content), "<h1>Pry</h1>")
+	file.Close()
+	target, err := client.ReadLink("/pry/ruby-pry/home.html")
+	assert.Nil(t, err)
+	assert.EqualValues(t, target, "index.html")
+	info, err := client.Stat("/pry/ruby-pry/lib")
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	// Read-only
+	_, err = client.Create("/pry/ruby-pry/new.html")
+	assert.NotNil(t, err)
+	assert.NotNil(t, client.Remove("/pry/ruby-pry/index.html"))
+	assert.NotNil(t, client.Mkdir("/pry/ruby-pry/new"))
+	_, err = os.Stat(dir + "/pry/ruby-pry/index.html")
+	assert.Nil(t, err)
+
+	// The repositories of the others are not found
+	_, err = client.Open("/rails/rails/index.html")
+	assert.True(t, os.IsNotExist(err))
+	_, err = client.ReadDir("/rails")
+	assert.True(t, os.IsNotExist(err))
+	_, err = client.Open("/pry/../rails/rails/index.html")
+	assert.True(t, os.IsNotExist(err))
+
+	deployClient := connect(&auth.Identity{User: auth.DeployUser("pry/pry-doc"), Repo: "pry/pry-doc"})
+	defer deployClient.Close()
+	infos, err = deployClient.ReadDir("/pry")
+	assert.Nil(t, err)
+	assert.EqualValues(t, names(infos), []string{"pry-doc"})
+	_, err = deployClient.Stat("/pry/ruby-pry")
+	assert.True(t, os.IsNotExist(err))
+}
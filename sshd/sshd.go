@@ -1,18 +1,31 @@
 package sshd
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/bachue/pages/audit"
+	"github.com/bachue/pages/auth"
 	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/hooks"
+	"github.com/bachue/pages/listeners"
 	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/metrics"
+	"github.com/bachue/pages/publish"
+	"github.com/bachue/pages/repos"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -21,31 +34,264 @@ type Server struct {
 	ServerConfig *ssh.ServerConfig
 	Logger       log_driver.Logger
 	ClientCount  int32
+	GitRepoDir   string
+	Files        Files
+	Users        *auth.Store
+	Receiver     *hooks.Receiver
+	Events       *events.Bus
+	Publisher    *publish.Publisher
+	Auditor      *audit.Auditor
+	maxClient    int32
+	guard        *guard
+	hostKeys     []ssh.Signer
+	authority    *auth.CertAuthority
+	mutex        sync.Mutex
+	closing      bool
+	listener     net.Listener
+	acceptErr    error
+	conns        map[net.Conn]bool
+	commands     sync.WaitGroup
+	// domainMutex serializes the changes of the custom domains, so no two sites take the same one
+	domainMutex sync.Mutex
+	// authFailures holds the remote addresses of the connections being authenticated which have failed
+	// at least once
+	authFailures map[string]bool
 }
 
-func NewServer(sshdConfig *config.Sshd, logger log_driver.Logger) (*Server, error) {
-	serverConfig, err := getSshServerConfig(sshdConfig)
+// errTooManyAuths rejects the authentication attempts over the rate limit, which are not failures
+var errTooManyAuths = fmt.Errorf("Too many authentication attempts")
+
+// maxAcceptDelay is the longest delay between the retries of a failing accept
+const maxAcceptDelay = time.Second
+
+// The SSH permission extensions carrying the name of the authenticated pages user, the repository and
+// the write permission of a deploy key, and the certificate authenticating them if any
+const (
+	userExtension  = "pages-user"
+	repoExtension  = "pages-repo"
+	writeExtension = "pages-write"
+	certExtension  = "pages-cert"
+)
+
+// NewServer creates the SSH server of the repositories in gitRepoDir, which serves files over SFTP unless
+// it's nil. publisher is nil if publishing is disabled.
+func NewServer(sshdConfig *config.Sshd, gitRepoDir string, files Files, users *auth.Store, receiver *hooks.Receiver,
+	bus *events.Bus, publisher *publish.Publisher, auditor *audit.Auditor, logger log_driver.Logger) (*Server, error) {
+	if sshdConfig.ShellPath != "" {
+		logger.Warnf("Ignored sshd.shell, which is deprecated since the site commands are run in place of a shell")
+	}
+	authority, err := newCertAuthority(sshdConfig, users)
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{Config: sshdConfig, Logger: logger, ClientCount: 0,
+		GitRepoDir: gitRepoDir, Files: files, Users: users, Receiver: receiver, Events: bus, Publisher: publisher,
+		Auditor: auditor, maxClient: sshdConfig.MaxClient, guard: newGuard(sshdConfig), authority: authority, conns: map[net.Conn]bool{},
+		authFailures: map[string]bool{}}
+	serverConfig, err := server.getSshServerConfig()
 	if err != nil {
 		return nil, err
 	}
-	return &Server{Config: sshdConfig, ServerConfig: serverConfig, Logger: logger, ClientCount: 0}, nil
+	server.ServerConfig = serverConfig
+	return server, nil
 }
 
+// Reconfigure applies the settings of sshdConfig which don't need restarting, i.e. `max_client`,
+// the limits, the ban, the access lists and the cert authority
+func (server *Server) Reconfigure(sshdConfig *config.Sshd) {
+	atomic.StoreInt32(&server.maxClient, sshdConfig.MaxClient)
+	server.guard.reconfigure(sshdConfig)
+	authority, err := newCertAuthority(sshdConfig, server.Users)
+	if err != nil {
+		server.Logger.Errorf("Failed to reconfigure cert authority, keep the current one: %s", err)
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.authority = authority
+}
+
+// newCertAuthority returns nil if neither CA keys nor revocation list is configured
+func newCertAuthority(sshdConfig *config.Sshd, users *auth.Store) (*auth.CertAuthority, error) {
+	certAuthority := sshdConfig.CertAuthority
+	if len(certAuthority.Keys) == 0 && certAuthority.RevocationList == "" {
+		return nil, nil
+	}
+	return auth.NewCertAuthority(users, certAuthority.Keys, certAuthority.RevocationList)
+}
+
+func (server *Server) getAuthority() *auth.CertAuthority {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.authority
+}
+
+// Start serves until Shutdown is called, or returns the error once accepting fails permanently.
+// The temporary failures, such as running out of file descriptors, are retried with backoff.
 func (server *Server) Start() error {
 	listener, err := server.doListen()
 	if err != nil {
 		return err
 	}
+	return server.serve(listener)
+}
+
+func (server *Server) serve(listener net.Listener) error {
 	defer listener.Close()
+	server.mutex.Lock()
+	if server.closing {
+		server.mutex.Unlock()
+		return nil
+	}
+	server.listener = listener
+	server.mutex.Unlock()
+	var delay time.Duration
+	for {
+		err := server.doAccept(listener)
+		if err == nil {
+			delay = 0
+			continue
+		} else if server.isClosing() {
+			return nil
+		} else if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
+			server.Logger.Errorf("Stop accepting connections due to %s", err)
+			return err
+		}
+		// Same as net/http, from 5ms doubling up to 1s
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else if delay *= 2; delay > maxAcceptDelay {
+			delay = maxAcceptDelay
+		}
+		server.Logger.Errorf("Retrying to accept connections in %s", delay)
+		time.Sleep(delay)
+	}
+}
+
+// Shutdown stops accepting connections and commands, then waits for the running commands to finish
+// until ctx is done. The remaining connections are closed at last.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mutex.Lock()
+	server.closing = true
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	server.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.commands.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.Logger.Infof("Closing %d SSH connections", len(server.conns))
+	for conn := range server.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Ping tells if the server is accepting connections, i.e. it's listening, not shutting down, and the
+// last accept succeeded.
+func (server *Server) Ping() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closing {
+		return fmt.Errorf("SSH server is shutting down")
+	} else if server.listener == nil {
+		return fmt.Errorf("SSH server is not listening yet")
+	}
+	return server.acceptErr
+}
+
+// acquireClient counts a connection in ClientCount, unless there are `max_client` connections already
+func (server *Server) acquireClient() bool {
 	for {
-		server.doAccept(listener)
+		count := atomic.LoadInt32(&server.ClientCount)
+		if count >= atomic.LoadInt32(&server.maxClient) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&server.ClientCount, count, count+1) {
+			metrics.SshConnections.Set(float64(count + 1))
+			return true
+		}
 	}
-	return nil
+}
+
+func (server *Server) isClosing() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.closing
+}
+
+// track registers conn to be closed on shutdown, it returns false if the server is shutting down already.
+func (server *Server) track(conn net.Conn) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closing {
+		return false
+	}
+	server.conns[conn] = true
+	return true
+}
+
+func (server *Server) untrack(conn net.Conn) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	delete(server.conns, conn)
+}
+
+func (server *Server) markAuthFailed(addr net.Addr) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.authFailures[addr.String()] = true
+}
+
+// takeAuthFailed tells if the connection from addr has failed to authenticate, and forgets it
+func (server *Server) takeAuthFailed(addr net.Addr) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	failed := server.authFailures[addr.String()]
+	delete(server.authFailures, addr.String())
+	return failed
+}
+
+// authFailed records a connection which ends without authenticating, the source IP is banned once
+// it fails too many times
+func (server *Server) authFailed(addr net.Addr, logger log_driver.Logger) {
+	ip := remoteIp(addr)
+	if !server.guard.authFailed(ip) {
+		return
+	}
+	logger.Warnf("Banned %s due to repeated authentication failures", ip)
+	metrics.SshBans.Inc()
+	server.Auditor.Record(&audit.Entry{Action: audit.SshBan, Outcome: audit.Success, Source: ip,
+		Details: map[string]interface{}{"duration": server.Config.Ban.Duration}})
+}
+
+// beginCommand registers a running command to wait for on shutdown, it returns false if the server
+// is shutting down already.
+func (server *Server) beginCommand() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closing {
+		return false
+	}
+	server.commands.Add(1)
+	return true
 }
 
 func (server *Server) doListen() (net.Listener, error) {
 	host_port := server.getHostPort()
-	listener, err := net.Listen("tcp", host_port)
+	listener, err := listeners.Listen("sshd", host_port)
 	if err != nil {
 		server.Logger.Errorf("Failed to listen on %s due to %s", host_port, err)
 		return nil, err
@@ -54,209 +300,487 @@ func (server *Server) doListen() (net.Listener, error) {
 	return listener, nil
 }
 
-func (server *Server) doAccept(listener net.Listener) {
+func (server *Server) doAccept(listener net.Listener) error {
 	tcpConn, err := listener.Accept()
 	if err != nil {
-		// TODO: Sleep to retry on accept failure, refer to: https://golang.org/src/net/http/server.go#L1883
+		if server.isClosing() {
+			return err
+		}
 		server.Logger.Errorf("Failed to accept connection due to %s", err)
-		return
+		server.setAcceptErr(err)
+		return err
 	}
-	server.Logger.Debugf("Accepted incoming connection from %s", tcpConn.RemoteAddr().String())
+	server.setAcceptErr(nil)
+	server.Logger.With("remote", tcpConn.RemoteAddr().String()).Debugf("Accepted incoming connection")
 	go server.handleConnection(tcpConn)
+	return nil
+}
+
+func (server *Server) setAcceptErr(err error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if err != nil {
+		err = fmt.Errorf("Failed to accept connection due to %s", err)
+	}
+	server.acceptErr = err
 }
 
 func (server *Server) handleConnection(conn net.Conn) {
+	logger := server.Logger.With("remote", conn.RemoteAddr().String())
 	showConnCount := func() {
-		server.Logger.Debugf("Current Connections: (%d/%d)",
-			atomic.LoadInt32(&server.ClientCount), server.Config.MaxClient)
+		logger.Debugf("Current Connections: (%d/%d)",
+			atomic.LoadInt32(&server.ClientCount), atomic.LoadInt32(&server.maxClient))
 	}
 
+	if !server.track(conn) {
+		metrics.SshRejectedConnections.WithLabelValues("shutting_down").Inc()
+		conn.Close()
+		return
+	}
 	defer func() {
+		server.untrack(conn)
 		conn.Close()
-		server.Logger.Debugf("The connection from %s is closed", conn.RemoteAddr().String())
-		atomic.AddInt32(&server.ClientCount, -1)
-		showConnCount()
+		logger.Debugf("The connection is closed")
 	}()
 
-	atomic.AddInt32(&server.ClientCount, 1)
-	showConnCount()
-	if atomic.LoadInt32(&server.ClientCount) > server.Config.MaxClient {
-		server.Logger.Errorf("Failed to accept incoming connection due to too many connections (%d/%d)",
-			server.ClientCount, server.Config.MaxClient)
+	ip := remoteIp(conn.RemoteAddr())
+	if reason := server.guard.admit(ip); reason != "" {
+		logger.Warnf("Rejected incoming connection (%s)", reason)
+		metrics.SshRejectedConnections.WithLabelValues(reason).Inc()
+		return
+	}
+	defer server.guard.leave(ip)
+
+	if !server.acquireClient() {
+		logger.Warnf("Failed to accept incoming connection due to too many connections (%d/%d)",
+			atomic.LoadInt32(&server.ClientCount), atomic.LoadInt32(&server.maxClient))
+		metrics.SshRejectedConnections.WithLabelValues("max_client").Inc()
 		return
 	}
+	showConnCount()
+	defer func() {
+		metrics.SshConnections.Set(float64(atomic.AddInt32(&server.ClientCount, -1)))
+		showConnCount()
+	}()
 
-	sshConnection, chans, reqs, err := ssh.NewServerConn(conn, server.ServerConfig)
+	timeouts := server.Config.Timeouts
+	// The handshake is bounded as a whole, since a client may keep it going by sending slowly
+	handshakeTimer := time.AfterFunc(time.Duration(timeouts.Handshake)*time.Second, func() { conn.Close() })
+	idle := &idleConn{Conn: conn, timeout: time.Duration(timeouts.Idle) * time.Second}
+	sshConnection, chans, reqs, err := ssh.NewServerConn(idle, server.ServerConfig)
+	timedOut := !handshakeTimer.Stop()
+	// Counted once per connection, since the clients offer every key they have until one is accepted
+	authFailed := server.takeAuthFailed(conn.RemoteAddr())
 	if err != nil {
+		if authFailed {
+			server.authFailed(conn.RemoteAddr(), logger)
+		}
+		if timedOut {
+			logger.Warnf("Failed to start SSH connection due to handshake timeout after %ds", timeouts.Handshake)
+			metrics.SshRejectedConnections.WithLabelValues("handshake_timeout").Inc()
+			return
+		}
+		metrics.SshRejectedConnections.WithLabelValues("handshake").Inc()
 		if err != io.EOF {
-			server.Logger.Errorf("Failed to start SSL connection with %s due to %s",
-				conn.RemoteAddr().String(), err)
+			logger.Warnf("Failed to start SSH connection due to %s", err)
 		}
 		return
 	}
-	server.Logger.Debugf("Built SSL connection with %s, sessionId: %s, client version: %s, user: %s",
-		conn.RemoteAddr().String(), hex.EncodeToString(sshConnection.SessionID()),
+	sessionId := hex.EncodeToString(sshConnection.SessionID())
+	user := getIdentity(sshConnection).User
+	logger = logger.WithFields(log_driver.Fields{"session": sessionId, "user": user})
+	if reason := server.guard.admitUser(user); reason != "" {
+		logger.Warnf("Rejected SSH connection (%s)", reason)
+		metrics.SshRejectedConnections.WithLabelValues(reason).Inc()
+		sshConnection.Close()
+		return
+	}
+	defer server.guard.leaveUser(user)
+	done := make(chan struct{})
+	defer close(done)
+	go keepAlive(sshConnection, time.Duration(timeouts.Keepalive)*time.Second, timeouts.KeepaliveMax, done, logger)
+	// The failed attempts are recorded by AuthLogCallback, where the pages user is still unknown
+	details := map[string]interface{}{"session": sessionId, "login": sshConnection.User()}
+	if cert, ok := sshConnection.Permissions.Extensions[certExtension]; ok {
+		details["cert"] = cert
+	}
+	server.Auditor.Record(&audit.Entry{Action: audit.SshAuth, Outcome: audit.Success,
+		User: user, Source: conn.RemoteAddr().String(), Details: details})
+	logger.Debugf("Built SSH connection, client version: %s, login: %s",
 		sshConnection.ClientVersion(), sshConnection.User())
-	go ssh.DiscardRequests(reqs)
-	server.handleChannels(chans, sshConnection)
+	go server.handleGlobalRequests(reqs, sshConnection, logger)
+	// Advertised to every client, so that the OpenSSH ones with UpdateHostKeys learn the pending keys and
+	// forget the retired ones
+	_, _, err = sshConnection.SendRequest(hostKeysRequest, false, hostKeysPayload(server.hostKeys))
+	if err != nil {
+		logger.Warnf("Failed to advertise host keys due to %s", err)
+	}
+	server.handleChannels(chans, sshConnection, logger)
 }
 
-func (server *Server) handleChannels(chans <-chan ssh.NewChannel, conn *ssh.ServerConn) {
+func (server *Server) handleGlobalRequests(requests <-chan *ssh.Request, conn *ssh.ServerConn, logger log_driver.Logger) {
+	for request := range requests {
+		if request.Type != hostKeysProveRequest {
+			if request.WantReply {
+				request.Reply(false, nil)
+			}
+			continue
+		}
+		response, err := proveHostKeys(server.hostKeys, conn.SessionID(), request.Payload)
+		if err != nil {
+			logger.Warnf("Failed to prove host keys due to %s", err)
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, response)
+	}
+}
+
+func (server *Server) handleChannels(chans <-chan ssh.NewChannel, conn *ssh.ServerConn, logger log_driver.Logger) {
 	// Service the incoming Channel channel in go routine
 	for newChannel := range chans {
-		server.Logger.Debugf("New SSH Channel Request %s from %s", newChannel.ChannelType(), conn.RemoteAddr().String())
+		logger.Debugf("New SSH Channel Request %s", newChannel.ChannelType())
 		// TODO: Find Channel ID to log
-		go server.handleChannel(newChannel, conn)
+		go server.handleChannel(newChannel, conn, logger)
 	}
 }
 
-func (server *Server) handleChannel(newChannel ssh.NewChannel, conn *ssh.ServerConn) {
+func (server *Server) handleChannel(newChannel ssh.NewChannel, conn *ssh.ServerConn, logger log_driver.Logger) {
 	channelType := newChannel.ChannelType()
 	if channelType != "session" {
 		newChannel.Reject(ssh.UnknownChannelType,
 			fmt.Sprintf("Unknown SSH Channel Type: %s, only `session` is supported", channelType))
-		server.Logger.Errorf("Rejected SSH Channel Request from %s due to unknown channel type: %s",
-			conn.RemoteAddr().String(), newChannel.ChannelType())
+		logger.Warnf("Rejected SSH Channel Request due to unknown channel type: %s", newChannel.ChannelType())
 		return
 	}
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		newChannel.Reject(ssh.ConnectionFailed, "Failed to accept SSH Channel Request, developers are working on it.")
-		server.Logger.Errorf("Rejected SSH Channel Request from %s due to accept request failure: %s",
-			conn.RemoteAddr().String(), err)
+		logger.Errorf("Rejected SSH Channel Request due to accept request failure: %s", err)
 		return
 	}
-	server.Logger.Debugf("Accepted new SSH Channel Request from %s", conn.RemoteAddr().String())
+	logger.Debugf("Accepted new SSH Channel Request")
 
-	server.handleRequest(channel, requests, conn)
+	server.handleRequest(channel, requests, conn, logger)
 }
 
-func (server *Server) handleRequest(channel ssh.Channel, requests <-chan *ssh.Request, conn *ssh.ServerConn) {
+func (server *Server) handleRequest(channel ssh.Channel, requests <-chan *ssh.Request, conn *ssh.ServerConn,
+	logger log_driver.Logger) {
 	defer func() {
 		err := channel.Close()
 		if err != nil {
-			server.Logger.Errorf("Failed to close SSH Channel from %s due to %s",
-				conn.RemoteAddr().String(), err)
+			logger.Errorf("Failed to close SSH Channel due to %s", err)
 		}
-		server.Logger.Debugf("Close SSH Channel from %s", conn.RemoteAddr().String())
+		logger.Debugf("Close SSH Channel")
 	}()
+	pty := false
 	for req := range requests {
-		server.Logger.Debugf("Received new SSH Request (type = %s) from %s", req.Type, conn.RemoteAddr().String())
+		logger.Debugf("Received new SSH Request (type = %s)", req.Type)
 
 		switch req.Type {
+		case "pty-req", "env":
+			// Sent by `ssh` ahead of the shell or the command. The variables are ignored, and the
+			// terminal only decides the line endings of the banner.
+			pty = pty || req.Type == "pty-req"
+			err := req.Reply(req.Type == "pty-req", nil)
+			if err != nil && err != io.EOF {
+				logger.Errorf("Failed to Reply to SSH Request due to %s", err)
+			}
+			continue
 		case "exec":
-			server.handleExecRequest(channel, req, conn)
+			server.handleExecRequest(channel, req, conn, logger)
+		case "subsystem":
+			server.handleSubsystemRequest(channel, req, conn, logger)
+		case "shell":
+			server.handleShellRequest(channel, req, conn, pty, logger)
 		default:
-			var err error
-			if req.Type == "env" {
-				_, err = channel.Stderr().Write([]byte("error: Pages does not support SendEnv.\n"))
-			} else {
-				_, err = channel.Write([]byte("You've successfully authenticated, but Pages does not provide shell access.\n"))
-			}
+			_, err := channel.Write([]byte("You've successfully authenticated, but Pages does not provide shell access.\n"))
 			if err != nil && err != io.EOF {
-				server.Logger.Errorf("Failed to Talk to SSH Request due to %s", err)
+				logger.Errorf("Failed to Talk to SSH Request due to %s", err)
 			}
 			err = req.Reply(false, nil)
 			if err != nil && err != io.EOF {
-				server.Logger.Errorf("Failed to Reply false to SSH Request due to %s", err)
+				logger.Errorf("Failed to Reply false to SSH Request due to %s", err)
 			}
 			err = channel.Close()
 			if err != nil && err != io.EOF {
-				server.Logger.Errorf("Failed to close SSH Request due to %s", err)
+				logger.Errorf("Failed to close SSH Request due to %s", err)
 			}
-			server.Logger.Errorf("Close SSH Request due to unsupported SSH Request type: %s", req.Type)
+			logger.Warnf("Close SSH Request due to unsupported SSH Request type: %s", req.Type)
 		}
 		return
 	}
 }
 
-func (server *Server) handleExecRequest(channel ssh.Channel, request *ssh.Request, conn *ssh.ServerConn) {
+func (server *Server) handleExecRequest(channel ssh.Channel, request *ssh.Request, conn *ssh.ServerConn,
+	logger log_driver.Logger) {
 	doReply := func(ok bool) {
 		err := request.Reply(ok, nil)
 		if err != nil {
-			server.Logger.Errorf("Failed to reply %t to SSH Request from %s due to %s",
-				ok, conn.RemoteAddr().String(), err)
+			logger.Errorf("Failed to reply %t to SSH Request due to %s", ok, err)
 		}
-		server.Logger.Debugf("Reply to SSH Request `%t` from %s", ok, conn.RemoteAddr().String())
+		logger.Debugf("Reply to SSH Request `%t`", ok)
 	}
 	if len(request.Payload) < 4 {
-		server.Logger.Errorf("Payload must not be shorter than 4 bytes, but only %d bytes", len(request.Payload))
+		logger.Errorf("Payload must not be shorter than 4 bytes, but only %d bytes", len(request.Payload))
 		doReply(false)
 		return
 	}
 	header := request.Payload[:4]
 	cmdLen := int64(binary.BigEndian.Uint32(header))
 	if int64(len(request.Payload)) < 4+cmdLen {
-		server.Logger.Errorf("Payload must not be shorter than %d bytes, but only %d bytes", 4+cmdLen, len(request.Payload))
+		logger.Errorf("Payload must not be shorter than %d bytes, but only %d bytes", 4+cmdLen, len(request.Payload))
 		doReply(false)
 		return
 	}
 	cmd := request.Payload[4 : 4+cmdLen]
-	server.Logger.Debugf("Execute command `%s` via SSH from %s",
-		string(cmd), conn.RemoteAddr().String())
+	logger.Debugf("Execute command `%s` via SSH", string(cmd))
+	if !server.beginCommand() {
+		fmt.Fprintf(channel.Stderr(), "error: Pages is shutting down, please retry later\n")
+		doReply(true)
+		sendExitStatus(channel, 1)
+		return
+	}
+	defer server.commands.Done()
+
+	verb, repoName, ok := parseGitCommand(string(cmd))
+	if !ok {
+		verb = siteCommandName(string(cmd))
+	}
+	defer metrics.ObserveSince(metrics.SshCommandDuration.WithLabelValues(verb), time.Now())
+	if ok {
+		server.handleGitCommand(channel, verb, repoName, conn, logger, doReply)
+		return
+	}
+	if getIdentity(conn).Repo != "" {
+		logger.Warnf("Rejected command `%s` of deploy key", string(cmd))
+		server.auditCommand(conn, string(cmd), "", audit.Denied, map[string]interface{}{"reason": "deploy key"})
+		fmt.Fprintf(channel.Stderr(), "error: Deploy keys may only run git commands\n")
+		doReply(true)
+		sendExitStatus(channel, 1)
+		return
+	}
+	server.handleSiteCommand(channel, string(cmd), conn, logger, doReply)
+}
+
+// handleSubsystemRequest serves the `sftp` subsystem read-only, the other subsystems are rejected
+func (server *Server) handleSubsystemRequest(channel ssh.Channel, request *ssh.Request, conn *ssh.ServerConn,
+	logger log_driver.Logger) {
+	doReply := func(ok bool) {
+		err := request.Reply(ok, nil)
+		if err != nil {
+			logger.Errorf("Failed to reply %t to SSH Request due to %s", ok, err)
+		}
+		logger.Debugf("Reply to SSH Request `%t`", ok)
+	}
+	var payload struct{ Name string }
+	err := ssh.Unmarshal(request.Payload, &payload)
+	if err != nil || payload.Name != "sftp" || server.Files == nil {
+		logger.Warnf("Rejected unsupported SSH subsystem `%s`", payload.Name)
+		doReply(false)
+		return
+	}
+	if !server.beginCommand() {
+		logger.Warnf("Rejected SSH subsystem `%s` due to shutting down", payload.Name)
+		doReply(false)
+		return
+	}
+	defer server.commands.Done()
+	defer metrics.ObserveSince(metrics.SshCommandDuration.WithLabelValues("sftp"), time.Now())
+	doReply(true)
+
+	logger.Debugf("Serve SFTP")
+	sftpServer := newSftpServer(channel, server.Files, getIdentity(conn))
+	defer sftpServer.Close()
+	if maxSession := server.Config.Timeouts.MaxSession; maxSession > 0 {
+		timer := time.AfterFunc(time.Duration(maxSession)*time.Second, func() {
+			logger.Warnf("Closing SFTP due to exceeding max session of %ds", maxSession)
+			sftpServer.Close()
+		})
+		defer timer.Stop()
+	}
+	status, outcome := 0, audit.Success
+	err = sftpServer.Serve()
+	if err != nil && err != io.EOF {
+		logger.Errorf("Failed to serve SFTP due to %s", err)
+		status, outcome = 1, audit.Failure
+	}
+	sendExitStatus(channel, status)
+	server.auditCommand(conn, "sftp", "", outcome, nil)
+}
 
-	shellCmd := exec.Command(server.Config.ShellPath, "-c", string(cmd))
+// auditCommand records the command run by conn on repo, which is "" if it's not a git command
+func (server *Server) auditCommand(conn *ssh.ServerConn, command string, repo string, outcome string,
+	details map[string]interface{}) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["command"] = command
+	details["session"] = hex.EncodeToString(conn.SessionID())
+	server.Auditor.Record(&audit.Entry{Action: audit.SshCommand, Outcome: outcome, User: getIdentity(conn).User,
+		Source: conn.RemoteAddr().String(), Repo: repo, Details: details})
+}
 
-	stdinPipe, err := shellCmd.StdinPipe()
+func exitOutcome(status int) string {
+	if status != 0 {
+		return audit.Failure
+	}
+	return audit.Success
+}
+
+func (server *Server) handleGitCommand(channel ssh.Channel, verb string, repoName string,
+	conn *ssh.ServerConn, logger log_driver.Logger, doReply func(bool)) {
+	user, repo, err := repos.Split(repoName)
+	if err != nil {
+		logger.Warnf("Rejected `%s`: %s", verb, err)
+		server.auditCommand(conn, verb, repoName, audit.Denied, map[string]interface{}{"reason": err.Error()})
+		fmt.Fprintf(channel.Stderr(), "error: %s\n", err)
+		doReply(true)
+		sendExitStatus(channel, 1)
+		return
+	}
+	identity := getIdentity(conn)
+	allowed := identity.CanRead(user, repo)
+	if allowed && verb == "git-receive-pack" {
+		allowed = identity.CanWrite(user, repo)
+	}
+	repoPath := repos.Path(server.GitRepoDir, user, repo)
+	if allowed {
+		_, err = os.Stat(repoPath)
+		allowed = err == nil
+	}
+	if !allowed {
+		// Not telling apart missing repositories from forbidden ones, to keep their existence private
+		logger.With("repo", user+"/"+repo).Warnf("Rejected `%s`", verb)
+		server.auditCommand(conn, verb, user+"/"+repo, audit.Denied, nil)
+		fmt.Fprintf(channel.Stderr(), "error: Repository %s/%s is not found\n", user, repo)
+		doReply(true)
+		sendExitStatus(channel, 1)
+		return
+	}
+	if verb == "git-receive-pack" && !server.guard.allowPush(identity.User) {
+		logger.With("repo", user+"/"+repo).Warnf("Rejected `%s` due to too many pushes", verb)
+		server.auditCommand(conn, verb, user+"/"+repo, audit.Denied, map[string]interface{}{"reason": reasonRateLimited})
+		fmt.Fprintf(channel.Stderr(), "error: Too many pushes, please retry later\n")
+		doReply(true)
+		sendExitStatus(channel, 1)
+		return
+	}
+
+	if verb != "git-receive-pack" {
+		status := server.runCommand(channel, exec.Command("git", strings.TrimPrefix(verb, "git-"), repoPath), logger, doReply)
+		server.auditCommand(conn, verb, user+"/"+repo, exitOutcome(status), map[string]interface{}{"status": status})
+		return
+	}
+	gitCmd, session, err := server.Receiver.Command(repoPath)
 	if err != nil {
-		server.Logger.Errorf("Failed to create STDIN pipe error for command: %s", err)
 		doReply(false)
+		server.auditCommand(conn, verb, user+"/"+repo, audit.Failure, map[string]interface{}{"reason": err.Error()})
 		return
 	}
+	defer session.Close()
+	go session.Serve(channel.Stderr())
+	status := server.runCommand(channel, gitCmd, logger, doReply)
+	if status != 0 {
+		server.auditCommand(conn, verb, user+"/"+repo, audit.Failure, map[string]interface{}{"status": status})
+		return
+	}
+	var updates []map[string]string
+	for _, update := range session.Landed() {
+		event := &events.Event{Id: events.NewId(), Type: events.Push, Repo: user + "/" + repo, Ref: update.Ref,
+			OldSha: update.OldSha, NewSha: update.NewSha, Pusher: identity.User}
+		updates = append(updates, map[string]string{"ref": update.Ref, "old": update.OldSha, "new": update.NewSha,
+			"event": event.Id})
+		server.Events.Emit(event)
+	}
+	server.auditCommand(conn, verb, user+"/"+repo, audit.Success,
+		map[string]interface{}{"status": status, "updates": updates})
+}
+
+// runCommand runs cmd with its standard streams attached to channel, and returns its exit status,
+// or -1 if it could not start. It's terminated along with its children once it runs over `max_session`.
+func (server *Server) runCommand(channel ssh.Channel, cmd *exec.Cmd, logger log_driver.Logger, doReply func(bool)) int {
+	// In its own process group, so that the children such as the hooks are terminated as well
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdinPipe, err := cmd.StdinPipe()
+	if err != nil {
+		logger.Errorf("Failed to create STDIN pipe error for command: %s", err)
+		doReply(false)
+		return -1
+	}
 	defer stdinPipe.Close()
 
-	stdoutPipe, err := shellCmd.StdoutPipe()
+	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		server.Logger.Errorf("Failed to create STDOUT pipe error for command: %s", err)
+		logger.Errorf("Failed to create STDOUT pipe error for command: %s", err)
 		doReply(false)
-		return
+		return -1
 	}
 	defer stdoutPipe.Close()
 
-	stderrPipe, err := shellCmd.StderrPipe()
+	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		server.Logger.Errorf("Failed to create STDERR pipe error for command: %s", err)
+		logger.Errorf("Failed to create STDERR pipe error for command: %s", err)
 		doReply(false)
-		return
+		return -1
 	}
 	defer stderrPipe.Close()
 
-	sendExitStatus := func() {
-		channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
-		server.Logger.Debugf("Sent exit status 0 to %s", conn.RemoteAddr().String())
+	err = cmd.Start()
+	if err != nil {
+		logger.Errorf("Close SSH Channel due to command error: %s", err)
+		doReply(false)
+		return -1
 	}
+	doReply(true)
 
-	var once sync.Once
+	exited := make(chan struct{})
+	defer close(exited)
+	if maxSession := server.Config.Timeouts.MaxSession; maxSession > 0 {
+		pid := cmd.Process.Pid
+		timer := time.AfterFunc(time.Duration(maxSession)*time.Second, func() {
+			logger.Warnf("Terminating command(PID = %d) due to exceeding max session of %ds", pid, maxSession)
+			fmt.Fprintf(channel.Stderr(), "error: Session exceeds %d seconds, terminated\n", maxSession)
+			terminate(pid, exited)
+		})
+		defer timer.Stop()
+	}
 
+	var outputs sync.WaitGroup
+	outputs.Add(2)
 	go func() {
 		io.Copy(stdinPipe, channel)
-		once.Do(sendExitStatus)
+		stdinPipe.Close()
 	}()
 	go func() {
 		io.Copy(channel, stdoutPipe)
-		once.Do(sendExitStatus)
+		outputs.Done()
 	}()
 	go func() {
 		io.Copy(channel.Stderr(), stderrPipe)
-		once.Do(sendExitStatus)
+		outputs.Done()
 	}()
+	outputs.Wait()
 
-	err = shellCmd.Start()
-	if err != nil {
-		server.Logger.Errorf("Close SSH Channel from %s due to command error: %s", conn.RemoteAddr().String(), err)
-		doReply(false)
-		return
-	}
-
-	doReply(true)
-	_, err = shellCmd.Process.Wait()
+	status := 0
+	err = cmd.Wait()
 	if err != nil {
-		_, ok := err.(*exec.ExitError)
+		exitErr, ok := err.(*exec.ExitError)
 		if !ok {
-			server.Logger.Errorf("Failed to wait command(PID = %d) due to %s", shellCmd.Process.Pid, err)
+			logger.Errorf("Failed to wait command(PID = %d) due to %s", cmd.Process.Pid, err)
+		}
+		status = 1
+		if ok {
+			if waitStatus, ok := exitErr.Sys().(interface {
+				ExitStatus() int
+			}); ok {
+				status = waitStatus.ExitStatus()
+			}
 		}
-		return
 	}
+	sendExitStatus(channel, status)
+	logger.Debugf("Sent exit status %d", status)
+	return status
 }
 
 func (server *Server) getHostPort() string {
@@ -266,44 +790,99 @@ func (server *Server) getHostPort() string {
 	return host_port
 }
 
-func getSshServerConfig(sshdConfig *config.Sshd) (*ssh.ServerConfig, error) {
+func sendExitStatus(channel ssh.Channel, status int) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+}
+
+// parseGitCommand recognizes the git transport commands, such as `git-receive-pack '/user/repo.git'`
+func parseGitCommand(cmd string) (string, string, bool) {
+	cmd = strings.TrimSpace(cmd)
+	if strings.HasPrefix(cmd, "git ") {
+		cmd = "git-" + strings.TrimSpace(strings.TrimPrefix(cmd, "git "))
+	}
+	parts := strings.SplitN(cmd, " ", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	switch parts[0] {
+	case "git-receive-pack", "git-upload-pack", "git-upload-archive":
+		return parts[0], strings.TrimSpace(parts[1]), true
+	}
+	return "", "", false
+}
+
+// getIdentity returns who the connection is authenticated as, by the public key callback
+func getIdentity(conn *ssh.ServerConn) *auth.Identity {
+	extensions := conn.Permissions.Extensions
+	return &auth.Identity{User: extensions[userExtension], Repo: extensions[repoExtension],
+		Write: extensions[writeExtension] == "true"}
+}
+
+func (server *Server) getSshServerConfig() (*ssh.ServerConfig, error) {
 	// In the latest version of crypto/ssh (after Go 1.3), the SSH server type has been removed
 	// in favour of an SSH connection type. A ssh.ServerConn is created by passing an existing
 	// net.Conn and a ssh.ServerConfig to ssh.NewServerConn, in effect, upgrading the net.Conn
 	// into an ssh.ServerConn
 
 	serverConfig := ssh.ServerConfig{
-		//Define a function to run when a client attempts a password login
-		// TODO: Avoid Login by Password
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// Should use constant-time compare (or better, salt+hash) in a production setting.
-			if c.User() == "foo" && string(pass) == "bar" {
-				return nil, nil
+		// Clients connect as any SSH user (usually `git`), and are identified by their public key
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !server.guard.allowAuth(remoteIp(conn.RemoteAddr())) {
+				return nil, errTooManyAuths
+			}
+			authority := server.getAuthority()
+			if cert, ok := key.(*ssh.Certificate); ok {
+				if authority == nil {
+					return nil, fmt.Errorf("Certificate %s is not accepted without cert authority", cert.KeyId)
+				}
+				identity, err := authority.Authenticate(conn.User(), cert)
+				if err != nil {
+					return nil, err
+				}
+				// The source address of the critical options is checked by crypto/ssh
+				return &ssh.Permissions{CriticalOptions: cert.CriticalOptions, Extensions: map[string]string{
+					userExtension: identity.User,
+					certExtension: fmt.Sprintf("%s (serial %d)", cert.KeyId, cert.Serial),
+				}}, nil
+			}
+			if authority.IsRevoked(key) {
+				return nil, fmt.Errorf("Revoked public key %s", ssh.FingerprintSHA256(key))
+			}
+			identity, err := server.Users.AuthenticateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			extensions := map[string]string{userExtension: identity.User}
+			if identity.Repo != "" {
+				extensions[repoExtension] = identity.Repo
+				extensions[writeExtension] = strconv.FormatBool(identity.Write)
+			}
+			return &ssh.Permissions{Extensions: extensions}, nil
+		},
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			// Clients always try `none` first to query the methods allowed
+			if err == nil || method == "none" {
+				return
+			}
+			metrics.SshAuthFailures.WithLabelValues(method).Inc()
+			server.Auditor.Record(&audit.Entry{Action: audit.SshAuth, Outcome: audit.Failure, Source: conn.RemoteAddr().String(),
+				Details: map[string]interface{}{"method": method, "login": conn.User()}, Error: err.Error()})
+			if err != errTooManyAuths {
+				server.markAuthFailed(conn.RemoteAddr())
 			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
 		},
-		// TODO: Use PublicKeyCallback instead
-		// PublicKeyCallback: func(conn ssh.ConnMetadata, key crypto.PublicKey) (*ssh.Permissions, error) {
-		// TODO
-		// }
-		// TODO:
-		// AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
-		// TODO
-		// }
 		//
 		// You may also explicitly allow anonymous client authentication, though anon bash
 		// sessions may not be a wise idea
 		// NoClientAuth: true,
 	}
-	private_key, err := getPrivateKey(sshdConfig)
+	active, all, err := loadHostKeys(server.Config, server.Logger)
 	if err != nil {
 		return nil, err
 	}
-	serverConfig.AddHostKey(private_key)
+	for _, hostKey := range active {
+		serverConfig.AddHostKey(hostKey)
+	}
+	server.hostKeys = all
 	return &serverConfig, nil
 }
-
-func getPrivateKey(sshdConfig *config.Sshd) (ssh.Signer, error) {
-	private, err := ssh.ParsePrivateKey([]byte(sshdConfig.PrivateKey))
-	return private, err
-}
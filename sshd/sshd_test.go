@@ -0,0 +1,161 @@
+package sshd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bachue/pages/auth"
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/log_driver"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshd")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "ERROR"})
+	assert.Nil(t, err)
+	newSigner := func() ssh.Signer {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+		signer, err := ssh.NewSignerFromKey(privateKey)
+		assert.Nil(t, err)
+		return signer
+	}
+	pry := newSigner()
+	assert.Nil(t, ioutil.WriteFile(dir+"/users.yml",
+		[]byte("users:\n  pry:\n    keys:\n      - "+string(ssh.MarshalAuthorizedKey(pry.PublicKey()))), 0600))
+	users, err := auth.NewStore(dir + "/users.yml")
+	assert.Nil(t, err)
+	sshdConfig := &config.Sshd{
+		HostKeys:  []config.HostKey{{File: dir + "/ed25519", Type: "ed25519"}},
+		MaxClient: 10,
+		Timeouts:  config.Timeouts{Handshake: 10, Idle: 10, Keepalive: 60, KeepaliveMax: 3},
+		Ban:       config.Ban{MaxFailures: 2, Window: 60, Duration: 60},
+	}
+	server, err := NewServer(sshdConfig, dir, nil, users, nil, nil, nil, nil, logger)
+	assert.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	handled := make(chan bool)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.handleConnection(conn)
+			handled <- true
+		}
+	}()
+	dial := func(signers ...ssh.Signer) error {
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{User: "git",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...)}, HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		if err == nil {
+			client.Close()
+		}
+		<-handled
+		return err
+	}
+
+	// The keys rejected before one is accepted are not failures
+	assert.Nil(t, dial(newSigner(), newSigner(), newSigner(), pry))
+	assert.NotNil(t, dial(newSigner(), newSigner(), newSigner()))
+	assert.False(t, server.guard.jail.IsBanned("127.0.0.1"))
+	assert.NotNil(t, dial(newSigner()))
+	assert.True(t, server.guard.jail.IsBanned("127.0.0.1"))
+	assert.NotNil(t, dial(pry))
+	assert.Empty(t, server.authFailures)
+}
+
+type acceptError struct {
+	temporary bool
+}
+
+func (err acceptError) Error() string   { return "accept failed" }
+func (err acceptError) Timeout() bool   { return false }
+func (err acceptError) Temporary() bool { return err.temporary }
+
+// failingListener fails to accept with errors, then with temporary errors once they run out
+type failingListener struct {
+	mutex  sync.Mutex
+	errors []error
+	times  []time.Time
+	closed chan struct{}
+}
+
+func (listener *failingListener) Accept() (net.Conn, error) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	listener.times = append(listener.times, time.Now())
+	select {
+	case <-listener.closed:
+		return nil, fmt.Errorf("use of closed network connection")
+	default:
+	}
+	if len(listener.errors) == 0 {
+		return nil, acceptError{temporary: true}
+	}
+	err := listener.errors[0]
+	listener.errors = listener.errors[1:]
+	return nil, err
+}
+
+func (listener *failingListener) Close() error {
+	select {
+	case <-listener.closed:
+	default:
+		close(listener.closed)
+	}
+	return nil
+}
+
+func (listener *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+}
+
+func TestServeAcceptErrors(t *testing.T) {
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "FATAL"})
+	assert.Nil(t, err)
+
+	// The temporary errors are retried with backoff, until a permanent one
+	temporary := acceptError{temporary: true}
+	listener := &failingListener{errors: []error{temporary, temporary, temporary, acceptError{}},
+		closed: make(chan struct{})}
+	server := &Server{Logger: logger}
+	assert.EqualValues(t, server.serve(listener), acceptError{})
+	assert.Len(t, listener.times, 4)
+	for i, delay := range []time.Duration{5, 10, 20} {
+		assert.True(t, listener.times[i+1].Sub(listener.times[i]) >= delay*time.Millisecond)
+	}
+	assert.EqualValues(t, server.Ping().Error(), "Failed to accept connection due to accept failed")
+	select {
+	case <-listener.closed:
+	default:
+		t.Error("The listener is not closed")
+	}
+
+	// Retrying until shut down
+	listener = &failingListener{closed: make(chan struct{})}
+	server = &Server{Logger: logger}
+	served := make(chan error)
+	go func() { served <- server.serve(listener) }()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, server.Shutdown(context.Background()))
+	assert.Nil(t, <-served)
+	listener.mutex.Lock()
+	assert.True(t, len(listener.times) > 1)
+	listener.mutex.Unlock()
+}
@@ -0,0 +1,78 @@
+package sshd
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/bachue/pages/log_driver"
+	"golang.org/x/crypto/ssh"
+)
+
+// killGracePeriod is how long a command is given to exit on SIGTERM before it's killed
+const killGracePeriod = 5 * time.Second
+
+// idleConn fails the reads and writes which are blocked longer than timeout
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (conn *idleConn) Read(buffer []byte) (int, error) {
+	conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Read(buffer)
+}
+
+func (conn *idleConn) Write(buffer []byte) (int, error) {
+	conn.Conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Write(buffer)
+}
+
+// keepAlive sends a keepalive request every interval, and closes conn once max of them are unanswered,
+// until done is closed.
+func keepAlive(conn *ssh.ServerConn, interval time.Duration, max int, done <-chan struct{}, logger log_driver.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					// Clients reply failure to the requests unknown to them, which is still an answer
+					_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+					replies <- err
+				}()
+				continue
+			}
+			missed++
+			if missed >= max {
+				logger.Warnf("Closing SSH connection due to %d keepalive requests unanswered", missed)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// terminate sends SIGTERM to the process group of pid, then SIGKILL if it doesn't exit within
+// killGracePeriod.
+func terminate(pid int, exited <-chan struct{}) {
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(killGracePeriod):
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+}
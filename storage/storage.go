@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	conf "github.com/bachue/pages/config"
+)
+
+// Storage is where the published files are uploaded to, keys are `/` separated paths.
+type Storage interface {
+	Put(bucket string, key string, content io.Reader, headers map[string]string) error
+	Delete(bucket string, key string) error
+	List(bucket string, prefix string) ([]string, error)
+	// Ping tells if the storage is reachable
+	Ping() error
+}
+
+func New(config *conf.Storage) (Storage, error) {
+	switch config.Type {
+	case "local":
+		return NewLocal(config.Root)
+	default:
+		return nil, fmt.Errorf("Unsupported storage type `%s`", config.Type)
+	}
+}
+
+// Local stores each bucket as a directory under Root, headers are not kept.
+type Local struct {
+	Root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	if root == "" {
+		return nil, fmt.Errorf("Root of local storage must be set")
+	}
+	return &Local{Root: root}, nil
+}
+
+func (local *Local) Put(bucket string, key string, content io.Reader, _ map[string]string) error {
+	path, err := local.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// Write aside then rename, so that readers never see a partial file
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (local *Local) Delete(bucket string, key string) error {
+	path, err := local.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (local *Local) List(bucket string, prefix string) ([]string, error) {
+	root, err := local.path(bucket, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		key := filepath.ToSlash(strings.TrimPrefix(path, root+string(filepath.Separator)))
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (local *Local) Ping() error {
+	info, err := os.Stat(local.Root)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", local.Root)
+	}
+	return nil
+}
+
+func (local *Local) path(bucket string, key string) (string, error) {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || strings.HasPrefix(bucket, ".") {
+		return "", fmt.Errorf("Invalid bucket `%s`", bucket)
+	}
+	cleaned := filepath.Clean("/" + key)
+	if key != "" && cleaned == "/" {
+		return "", fmt.Errorf("Invalid key `%s`", key)
+	}
+	return filepath.Join(local.Root, bucket, cleaned), nil
+}
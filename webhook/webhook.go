@@ -0,0 +1,265 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/repos"
+)
+
+const (
+	queueSize  = 1024
+	maxBackoff = 5 * time.Minute
+)
+
+// Hook is an outgoing webhook of a repository, read from its git config:
+//
+//	[webhook "ci"]
+//		url = https://ci.example.com/pages
+//		secret = s3cr3t
+//		events = push publish.failed
+//
+// A hook without `events` receives all of them.
+type Hook struct {
+	Name   string
+	Url    string
+	Secret string
+	Events []string
+}
+
+func (hook *Hook) Accepts(eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, accepted := range hook.Events {
+		if accepted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadHooks(repo *repos.Repo) ([]*Hook, error) {
+	sections, err := repo.ConfigSection("webhook")
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]*Hook, 0, len(sections))
+	for name, entries := range sections {
+		if entries["url"] == "" {
+			continue
+		}
+		hooks = append(hooks, &Hook{Name: name, Url: entries["url"], Secret: entries["secret"],
+			Events: strings.FieldsFunc(entries["events"], func(r rune) bool { return r == ',' || r == ' ' })})
+	}
+	return hooks, nil
+}
+
+// Sign returns the value of the `X-Pages-Signature` header of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delivery is a line of the delivery log, one is written for each attempt.
+type Delivery struct {
+	Id         string    `json:"id"`
+	Hook       string    `json:"hook"`
+	Url        string    `json:"url"`
+	Event      string    `json:"event"`
+	EventId    string    `json:"event_id"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   float64   `json:"duration_ms"`
+	Succeeded  bool      `json:"succeeded"`
+	Retrying   bool      `json:"retrying"`
+	Time       time.Time `json:"time"`
+}
+
+type job struct {
+	id      string
+	hook    *Hook
+	repo    *repos.Repo
+	event   *events.Event
+	body    []byte
+	attempt int
+}
+
+// Dispatcher delivers events to the webhooks of their repository, retrying failed deliveries
+// with exponential backoff and logging every attempt into `pages/deliveries.log` of the repository.
+type Dispatcher struct {
+	GitRepoDir  string
+	MaxAttempts int
+	client      *http.Client
+	queue       chan *job
+	backoff     func(attempt int) time.Duration
+	logger      log_driver.Logger
+	logMutex    sync.Mutex
+	closeMutex  sync.RWMutex
+	closed      bool
+	workers     sync.WaitGroup
+}
+
+func NewDispatcher(config *conf.Webhooks, gitRepoDir string, logger log_driver.Logger) *Dispatcher {
+	dispatcher := &Dispatcher{
+		GitRepoDir:  gitRepoDir,
+		MaxAttempts: config.MaxAttempts,
+		client:      &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		queue:       make(chan *job, queueSize),
+		backoff:     exponentialBackoff,
+		logger:      logger,
+	}
+	dispatcher.workers.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go dispatcher.work()
+	}
+	return dispatcher
+}
+
+// Handle enqueues a delivery of event to every webhook of its repository accepting it.
+func (dispatcher *Dispatcher) Handle(event *events.Event) {
+	user, repoName, err := repos.Split(event.Repo)
+	if err != nil {
+		dispatcher.logger.Errorf("Failed to find webhooks of %s: %s", event.Repo, err)
+		return
+	}
+	repo := repos.Open(repos.Path(dispatcher.GitRepoDir, user, repoName))
+	hooks, err := LoadHooks(repo)
+	if err != nil {
+		dispatcher.logger.Errorf("Failed to load webhooks of %s due to %s", event.Repo, err)
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		dispatcher.logger.Errorf("Failed to encode event %s due to %s", event.Id, err)
+		return
+	}
+	for _, hook := range hooks {
+		if hook.Accepts(event.Type) {
+			dispatcher.enqueue(&job{id: events.NewId(), hook: hook, repo: repo, event: event, body: body, attempt: 1})
+		}
+	}
+}
+
+// Close stops the workers once the queued deliveries are sent, pending retries are dropped.
+func (dispatcher *Dispatcher) Close() {
+	dispatcher.closeMutex.Lock()
+	if !dispatcher.closed {
+		dispatcher.closed = true
+		close(dispatcher.queue)
+	}
+	dispatcher.closeMutex.Unlock()
+	dispatcher.workers.Wait()
+}
+
+func (dispatcher *Dispatcher) enqueue(job *job) {
+	dispatcher.closeMutex.RLock()
+	defer dispatcher.closeMutex.RUnlock()
+	if dispatcher.closed {
+		dispatcher.logger.Errorf("Dropped delivery %s of %s to webhook %s since dispatcher is closed",
+			job.id, job.event.Type, job.hook.Name)
+		return
+	}
+	select {
+	case dispatcher.queue <- job:
+	default:
+		dispatcher.logger.Errorf("Dropped delivery %s of %s to webhook %s since the queue is full",
+			job.id, job.event.Type, job.hook.Name)
+	}
+}
+
+func (dispatcher *Dispatcher) work() {
+	defer dispatcher.workers.Done()
+	for job := range dispatcher.queue {
+		dispatcher.deliver(job)
+	}
+}
+
+func (dispatcher *Dispatcher) deliver(job *job) {
+	delivery := &Delivery{Id: job.id, Hook: job.hook.Name, Url: job.hook.Url, Event: job.event.Type,
+		EventId: job.event.Id, Attempt: job.attempt, Time: time.Now()}
+	retryable := dispatcher.post(job, delivery)
+	delivery.Duration = float64(time.Since(delivery.Time)) / float64(time.Millisecond)
+	delivery.Retrying = !delivery.Succeeded && retryable && job.attempt < dispatcher.MaxAttempts
+	dispatcher.record(job.repo, delivery)
+
+	if delivery.Succeeded {
+		dispatcher.logger.Debugf("Delivered %s (%s) to webhook %s", job.event.Type, job.event.Id, job.hook.Name)
+	} else if delivery.Retrying {
+		backoff := dispatcher.backoff(job.attempt)
+		dispatcher.logger.Infof("Failed to deliver %s (%s) to webhook %s (attempt %d), retry in %s",
+			job.event.Type, job.event.Id, job.hook.Name, job.attempt, backoff)
+		job.attempt++
+		time.AfterFunc(backoff, func() { dispatcher.enqueue(job) })
+	} else {
+		dispatcher.logger.Errorf("Gave up delivering %s (%s) to webhook %s after %d attempts: %s",
+			job.event.Type, job.event.Id, job.hook.Name, job.attempt, delivery.Error)
+	}
+}
+
+// post sends the job once and fills the outcome into delivery, it returns whether a failure is worth retrying.
+func (dispatcher *Dispatcher) post(job *job, delivery *Delivery) bool {
+	request, err := http.NewRequest("POST", job.hook.Url, bytes.NewReader(job.body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "pages-webhook")
+	request.Header.Set("X-Pages-Event", job.event.Type)
+	request.Header.Set("X-Pages-Delivery", job.id)
+	if job.hook.Secret != "" {
+		request.Header.Set("X-Pages-Signature", Sign(job.hook.Secret, job.body))
+	}
+	response, err := dispatcher.client.Do(request)
+	if err != nil {
+		delivery.Error = err.Error()
+		return true
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+	response.Body.Close()
+	delivery.StatusCode = response.StatusCode
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		delivery.Succeeded = true
+		return false
+	}
+	delivery.Error = response.Status
+	return response.StatusCode >= 500 || response.StatusCode == http.StatusRequestTimeout ||
+		response.StatusCode == http.StatusTooManyRequests
+}
+
+func (dispatcher *Dispatcher) record(repo *repos.Repo, delivery *Delivery) {
+	line, err := json.Marshal(delivery)
+	if err != nil {
+		dispatcher.logger.Errorf("Failed to encode delivery %s due to %s", delivery.Id, err)
+		return
+	}
+	dispatcher.logMutex.Lock()
+	defer dispatcher.logMutex.Unlock()
+	err = repo.AppendLog("deliveries.log", line)
+	if err != nil {
+		dispatcher.logger.Errorf("Failed to log delivery %s of %s due to %s", delivery.Id, repo.Path, err)
+	}
+}
+
+func exponentialBackoff(attempt int) time.Duration {
+	backoff := time.Second << uint(attempt-1)
+	if backoff > maxBackoff || backoff <= 0 {
+		return maxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bachue/pages/config"
+	"github.com/bachue/pages/events"
+	"github.com/bachue/pages/log_driver"
+	"github.com/bachue/pages/repos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliverWithRetries(t *testing.T) {
+	var requests int32
+	received := make(chan *http.Request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.EqualValues(t, r.Header.Get("X-Pages-Signature"), Sign("s3cr3t", body))
+		var event events.Event
+		assert.Nil(t, json.Unmarshal(body, &event))
+		assert.EqualValues(t, event.Repo, "pry/ruby-pry")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		received <- r
+	}))
+	defer server.Close()
+
+	dispatcher, repo, cleaner := setupWebhookTest(t)
+	defer cleaner()
+	git(t, repo.Path, "config", "webhook.ci.url", server.URL)
+	git(t, repo.Path, "config", "webhook.ci.secret", "s3cr3t")
+	git(t, repo.Path, "config", "webhook.ci.events", "push publish.failed")
+	git(t, repo.Path, "config", "webhook.chat.url", server.URL)
+	git(t, repo.Path, "config", "webhook.chat.events", "publish.succeeded")
+
+	dispatcher.Handle(&events.Event{Id: "1", Type: events.Push, Repo: "pry/ruby-pry", Ref: "refs/heads/master"})
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-received:
+			assert.EqualValues(t, r.Header.Get("X-Pages-Event"), events.Push)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook is not delivered")
+		}
+	}
+	dispatcher.Close()
+	assert.EqualValues(t, atomic.LoadInt32(&requests), 2)
+
+	file, err := os.Open(repo.StateDir() + "/deliveries.log")
+	assert.Nil(t, err)
+	defer file.Close()
+	var deliveries []Delivery
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var delivery Delivery
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &delivery))
+		deliveries = append(deliveries, delivery)
+	}
+	assert.EqualValues(t, len(deliveries), 2)
+	assert.EqualValues(t, deliveries[0].Hook, "ci")
+	assert.EqualValues(t, deliveries[0].StatusCode, http.StatusBadGateway)
+	assert.True(t, deliveries[0].Retrying)
+	assert.False(t, deliveries[0].Succeeded)
+	assert.EqualValues(t, deliveries[1].Attempt, 2)
+	assert.True(t, deliveries[1].Succeeded)
+	assert.EqualValues(t, deliveries[0].Id, deliveries[1].Id)
+}
+
+func git(t *testing.T, repoPath string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_DIR="+repoPath)
+	assert.Nil(t, cmd.Run())
+}
+
+func setupWebhookTest(t *testing.T) (*Dispatcher, *repos.Repo, func()) {
+	dir, err := ioutil.TempDir("", "webhook-test")
+	assert.Nil(t, err)
+	repo := repos.Open(repos.Path(dir, "pry", "ruby-pry"))
+	assert.Nil(t, exec.Command("git", "init", "-q", "--bare", repo.Path).Run())
+
+	logger, err := log_driver.New(&config.Log{Local: "STDERR", Level: "WARN"})
+	assert.Nil(t, err)
+	dispatcher := NewDispatcher(&config.Webhooks{MaxAttempts: 3, Timeout: 5, Workers: 1}, dir, logger)
+	dispatcher.backoff = func(int) time.Duration { return 10 * time.Millisecond }
+	return dispatcher, repo, func() {
+		err := os.RemoveAll(dir)
+		assert.Nil(t, err)
+	}
+}